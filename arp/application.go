@@ -1,47 +1,142 @@
 package arp
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/framework-arp/ARP4G/copy"
 )
 
+var ErrEntityTypeNotRegistered = errors.New("entity type not registered, create a repository for it first")
+
+//保护下面的注册表，仓库可以在别的过程运行时创建
+var registryMutex sync.RWMutex
+
 var repositories map[string]innerRepository = make(map[string]innerRepository)
 
 var entityCopiers map[string]*copy.EntityCopier = make(map[string]*copy.EntityCopier)
 
 var newZeroEntityFuncs map[string]newZeroEntity = make(map[string]newZeroEntity)
 
+//实体类型自己实现的DeepCopy，比如arpgen生成的，优先于反射的copier
+var entityDeepCopiers map[string]func(entity any) any = make(map[string]func(entity any) any)
+
+//实体类型自己实现的Equal，比如arpgen生成的，优先于reflect.DeepEqual
+var entityEqualers map[string]func(a, b any) bool = make(map[string]func(a, b any) bool)
+
+//字段里有实现了Equal的类型或者arp:"-"标签的实体类型，用copy.Equal比较
+var customEqualEntities map[string]bool = make(map[string]bool)
+
 var singletonRepositories map[string]innerSingletonRepository = make(map[string]innerSingletonRepository)
 
 func registerRepository[T any](repository *RepositoryImpl[T]) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
 	repositories[repository.entityType] = repository
 }
 
 func getRepository(typeFullname string) innerRepository {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
 	return repositories[typeFullname]
 }
 
 func generateEntityCopier[T any](typeFullname string, entityType reflect.Type, newZeroEntityFunc NewZeroEntity[T]) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
 	newZeroEntityFuncs[typeFullname] = func() any {
 		return newZeroEntityFunc()
 	}
 	copy.GenerateEntityCopier(entityType, entityCopiers)
+	zeroEntity := any(newZeroEntityFunc())
+	if _, ok := zeroEntity.(Copier[T]); ok {
+		entityDeepCopiers[typeFullname] = func(entity any) any {
+			return entity.(Copier[T]).DeepCopy()
+		}
+	}
+	if _, ok := zeroEntity.(Equaler[T]); ok {
+		entityEqualers[typeFullname] = func(a, b any) bool {
+			return a.(Equaler[T]).Equal(b.(T))
+		}
+	}
+	customEqualEntities[typeFullname] = copy.HasCustomEqual(entityType)
+}
+
+//实体或者字段的类型自己实现深拷贝，比如arpgen生成的方法，或者不能逐个字段复制的类型。
+//实体类型T是指针类型，对应指针接收者的DeepCopy() *Entity；字段类型也可以是值接收者的DeepCopy() Field。
+//DeepCopy里不能用CopyEntity复制同一个类型，否则会无限递归
+type Copier[T any] interface {
+	DeepCopy() T
 }
 
-//完整复制一个实体（深拷贝），这里约定，实体只能是一个struct，实体的field只能是基本类型或者实体或者集合（Array，Map，Slice），集合的元素只能是基本类型或者实体
+//实体或者字段的类型自己实现相等的判断，用于过程提交时判断实体有没有被修改，比如time.Time的Equal
+type Equaler[T any] interface {
+	Equal(other T) bool
+}
+
+//完整复制一个实体（深拷贝），实体只能是一个struct，字段可以是任意类型：指针、集合（Array，Map，Slice）和接口按实际的值递归复制，
+//map的key、func和chan直接使用原来的值
+//实体可以是递归的类型，指向同一个实体的多个指针复制之后仍然指向同一个实体，有环的对象图也可以复制。
+//实体类型实现了Copier时改用它的DeepCopy，共享引用和环是否保留由DeepCopy决定，arpgen生成的DeepCopy按树复制，不保留
 func CopyEntity(typeFullname string, entity any) any {
-	newEntity := newZeroEntityFuncs[typeFullname]()
-	entityCopiers[typeFullname].Copy(entity, newEntity)
+	newEntity, err := CopyRegisteredEntity(typeFullname, entity)
+	if err != nil {
+		panic(err)
+	}
 	return newEntity
 }
 
+//和CopyEntity一样，实体类型没有通过NewRepository注册时返回ErrEntityTypeNotRegistered，给仓库之外的代码（比如store的装饰器）用
+func CopyRegisteredEntity(typeFullname string, entity any) (any, error) {
+	registryMutex.RLock()
+	deepCopy, newZeroEntityFunc, copier := entityDeepCopiers[typeFullname], newZeroEntityFuncs[typeFullname], entityCopiers[typeFullname]
+	registryMutex.RUnlock()
+	if deepCopy != nil {
+		return deepCopy(entity), nil
+	}
+	if newZeroEntityFunc == nil || copier == nil {
+		return nil, fmt.Errorf("%w: %s", ErrEntityTypeNotRegistered, typeFullname)
+	}
+	newEntity := newZeroEntityFunc()
+	copier.Copy(entity, newEntity)
+	return newEntity, nil
+}
+
 type newZeroEntity func() any
 
-func registerSingletonRepository[T any](repository *SingletonRepositoryImpl[T]) {
-	singletonRepositories[repository.entityType] = repository
+//比较实体的两个版本，用于判断实体有没有被修改
+func entityEqual(typeFullname string, a, b any) bool {
+	registryMutex.RLock()
+	equal, customEqual := entityEqualers[typeFullname], customEqualEntities[typeFullname]
+	registryMutex.RUnlock()
+	if equal != nil {
+		return equal(a, b)
+	}
+	if customEqual {
+		return copy.Equal(a, b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+//实体类型的全名，和仓库注册时用的一致。T可以是实体类型，也可以是实体的指针类型
+func TypeFullname[T any]() string {
+	entityType := reflect.TypeOf((*T)(nil)).Elem()
+	if entityType.Kind() == reflect.Pointer {
+		entityType = entityType.Elem()
+	}
+	return entityType.PkgPath() + "." + entityType.Name()
+}
+
+func registerSingletonRepository(entityType string, repository innerSingletonRepository) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	singletonRepositories[entityType] = repository
 }
 
 func getSingletonRepository(typeFullname string) innerSingletonRepository {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
 	return singletonRepositories[typeFullname]
 }
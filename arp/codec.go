@@ -0,0 +1,7 @@
+package arp
+
+//实体和字节之间的编解码，持久化的store可以用它来决定实体的保存格式
+type Codec[T any] interface {
+	Encode(entity T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
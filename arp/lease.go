@@ -0,0 +1,159 @@
+package arp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+//租约已过期，锁可能已经被别人获得
+var ErrLeaseExpired = errors.New("lease expired")
+
+//写入者的fencing token比store已经见过的小，说明它的租约已过期
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+//带租约的锁，持有者崩溃之后锁会在租约到期时自动失效。每次获得锁都会得到一个单调递增的fencing token。
+//仓库在过程持有锁期间自动续约，并在调用Store.SaveAll、Store.RemoveAll、Mutexes.UnlockAll和Renew时，
+//在ctx中带上过程持有的token，可以用FencingToken(ctx, id)取得，store据此拒绝租约已过期的持有者的写入
+type LeasedMutexes interface {
+	Mutexes
+	LockLease(ctx context.Context, id any) (token uint64, ok bool, absent bool, err error)
+	NewAndLockLease(ctx context.Context, id any) (token uint64, ok bool, err error)
+	//为ctx中带有token的id续约，租约已经失效的返回ErrLeaseExpired
+	Renew(ctx context.Context, ids []any) error
+	LeaseTTL() time.Duration
+}
+
+//支持尝试加锁的带租约的锁
+type TryLeasedMutexes interface {
+	LeasedMutexes
+	TryLockLease(ctx context.Context, id any, wait time.Duration) (token uint64, ok bool, absent bool, err error)
+}
+
+type fencingTokensKey int
+
+var fencingTokensCtxKey fencingTokensKey
+
+//取得ctx中id的fencing token
+func FencingToken(ctx context.Context, id any) (token uint64, ok bool) {
+	tokens, _ := ctx.Value(fencingTokensCtxKey).(map[any]uint64)
+	token, ok = tokens[id]
+	return
+}
+
+func withFencingTokens(ctx context.Context, tokens map[any]uint64) context.Context {
+	if len(tokens) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, fencingTokensCtxKey, tokens)
+}
+
+//一个过程在某个仓库持有的租约，持有期间定时续约
+type processLeases struct {
+	mutex   sync.Mutex
+	tokens  map[any]uint64
+	mutexes LeasedMutexes
+	stop    chan struct{}
+}
+
+func newProcessLeases(ctx context.Context, mutexes LeasedMutexes) *processLeases {
+	leases := &processLeases{tokens: make(map[any]uint64), mutexes: mutexes, stop: make(chan struct{})}
+	interval := mutexes.LeaseTTL() / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go leases.keepAlive(ctx, interval)
+	return leases
+}
+
+func (leases *processLeases) keepAlive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-leases.stop:
+			return
+		case <-ticker.C:
+			tokens := leases.copyTokens()
+			ids := make([]any, 0, len(tokens))
+			for id := range tokens {
+				ids = append(ids, id)
+			}
+			//续约失败的持有者，在保存时会被store拒绝
+			leases.mutexes.Renew(withFencingTokens(ctx, tokens), ids)
+		}
+	}
+}
+
+func (leases *processLeases) add(id any, token uint64) {
+	leases.mutex.Lock()
+	leases.tokens[id] = token
+	leases.mutex.Unlock()
+}
+
+func (leases *processLeases) remove(id any) {
+	leases.mutex.Lock()
+	delete(leases.tokens, id)
+	leases.mutex.Unlock()
+}
+
+func (leases *processLeases) copyTokens() map[any]uint64 {
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	tokens := make(map[any]uint64, len(leases.tokens))
+	for id, token := range leases.tokens {
+		tokens[id] = token
+	}
+	return tokens
+}
+
+func (leases *processLeases) stopKeepAlive() {
+	close(leases.stop)
+}
+
+func (pc *ProcessContext) addLease(ctx context.Context, entityType string, id any, token uint64, mutexes LeasedMutexes) {
+	leases := pc.leases[entityType]
+	if leases == nil {
+		leases = newProcessLeases(ctx, mutexes)
+		pc.leases[entityType] = leases
+	}
+	leases.add(id, token)
+}
+
+func leasedInProcess(ctx context.Context, entityType string, id any, token uint64, mutexes LeasedMutexes) {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return
+	}
+	pc.addLease(ctx, entityType, id, token, mutexes)
+}
+
+func leaseReleasedInProcess(ctx context.Context, entityType string, id any) {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return
+	}
+	if leases := pc.leases[entityType]; leases != nil {
+		leases.remove(id)
+	}
+}
+
+//带上过程中某个仓库持有的fencing token
+func withProcessFencingTokens(ctx context.Context, entityType string) context.Context {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return ctx
+	}
+	leases := pc.leases[entityType]
+	if leases == nil {
+		return ctx
+	}
+	return withFencingTokens(ctx, leases.copyTokens())
+}
+
+func stopProcessLeases(pc *ProcessContext) {
+	for _, leases := range pc.leases {
+		leases.stopKeepAlive()
+	}
+}
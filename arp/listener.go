@@ -0,0 +1,124 @@
+package arp
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+//一个过程中某个实体类型的变化。实体是过程中的实体本身，监听者需要保留时要自己复制
+type ChangeSet struct {
+	EntityType string
+	//包括PutIfAbsent、TakeOrPutIfAbsent在过程中直接保存的新实体
+	Inserted map[any]any
+	Updated  map[any]any
+	Removed  []any
+	//取出之后没有修改的
+	Unchanged map[any]any
+}
+
+//监听某个实体类型在过程结束时的变化。通知在过程释放锁之前发出，所以同一个id的通知和提交的顺序一致。
+//监听者的panic不影响过程的结果，会用slog记录。Committed panic之后会再用变化涉及的id调用Aborted，
+//让监听者（比如缓存）丢弃这些id可能不一致的状态
+type ProcessListener interface {
+	//过程的所有变化都保存成功之后调用
+	Committed(ctx context.Context, changes *ChangeSet)
+	//过程被放弃或者保存失败时调用，ids是过程中涉及的这个实体类型的所有id，其中一些可能已经保存了
+	Aborted(ctx context.Context, entityType string, ids []any)
+}
+
+var listenersMutex sync.RWMutex
+
+var processListeners map[string][]ProcessListener = make(map[string][]ProcessListener)
+
+func AddProcessListener(entityType string, listener ProcessListener) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	processListeners[entityType] = append(processListeners[entityType], listener)
+}
+
+func RemoveProcessListener(entityType string, listener ProcessListener) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	listeners := processListeners[entityType]
+	for i, l := range listeners {
+		if l == listener {
+			processListeners[entityType] = append(listeners[:i:i], listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func getProcessListeners(entityType string) []ProcessListener {
+	listenersMutex.RLock()
+	defer listenersMutex.RUnlock()
+	return processListeners[entityType]
+}
+
+func notifyCommitted(ctx context.Context, changeSets map[string]*ChangeSet) {
+	for entityType, changes := range changeSets {
+		for _, listener := range getProcessListeners(entityType) {
+			if !callListener(entityType, "Committed", func() { listener.Committed(ctx, changes) }) {
+				ids := changes.ids()
+				callListener(entityType, "Aborted", func() { listener.Aborted(ctx, entityType, ids) })
+			}
+		}
+	}
+}
+
+func notifyAborted(ctx context.Context, pc *ProcessContext) {
+	for entityType, repoPes := range pc.entities {
+		listeners := getProcessListeners(entityType)
+		if len(listeners) == 0 || len(repoPes.entities) == 0 {
+			continue
+		}
+		ids := make([]any, 0, len(repoPes.entities))
+		for id := range repoPes.entities {
+			ids = append(ids, id)
+		}
+		for _, listener := range listeners {
+			callListener(entityType, "Aborted", func() { listener.Aborted(ctx, entityType, ids) })
+		}
+	}
+}
+
+//调用监听者，panic时记录日志并返回false
+func callListener(entityType string, method string, call func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("process listener panicked", "entityType", entityType, "method", method, "panic", r)
+			ok = false
+		}
+	}()
+	call()
+	return true
+}
+
+//变化涉及的所有id
+func (changes *ChangeSet) ids() []any {
+	ids := make([]any, 0, len(changes.Inserted)+len(changes.Updated)+len(changes.Removed)+len(changes.Unchanged))
+	for id := range changes.Inserted {
+		ids = append(ids, id)
+	}
+	for id := range changes.Updated {
+		ids = append(ids, id)
+	}
+	ids = append(ids, changes.Removed...)
+	for id := range changes.Unchanged {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+//取得过程中的实体的副本，inProcess表示实体在过程中，在过程中被删除的实体返回的entity为nil
+func FindEntityInProcess(ctx context.Context, entityType string, id any) (inProcess bool, entity any) {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return false, nil
+	}
+	processEntity := pc.getEntityInProcess(entityType, id)
+	if processEntity == nil {
+		return false, nil
+	}
+	return true, processEntity.copyEntity(entityType)
+}
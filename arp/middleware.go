@@ -0,0 +1,309 @@
+package arp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//Store的中间件，返回包装了next的Store
+type StoreMiddleware[T any] func(next Store[T]) Store[T]
+
+//Mutexes的中间件，返回包装了next的Mutexes
+type MutexesMiddleware func(next Mutexes) Mutexes
+
+//用中间件包装store，第一个中间件在最外层
+func ChainStore[T any](store Store[T], middlewares ...StoreMiddleware[T]) Store[T] {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		store = middlewares[i](store)
+	}
+	return store
+}
+
+//用中间件包装mutexes，第一个中间件在最外层
+func ChainMutexes(mutexes Mutexes, middlewares ...MutexesMiddleware) Mutexes {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		mutexes = middlewares[i](mutexes)
+	}
+	return mutexes
+}
+
+//仓库创建时用中间件包装store，多次使用时先加入的在外层
+func WithStoreMiddleware[T any](middlewares ...StoreMiddleware[T]) RepositoryOption {
+	return func(options *repositoryOptions) {
+		for _, middleware := range middlewares {
+			options.storeMiddlewares = append(options.storeMiddlewares, middleware)
+		}
+	}
+}
+
+//仓库创建时用中间件包装mutexes，多次使用时先加入的在外层
+func WithMutexesMiddleware(middlewares ...MutexesMiddleware) RepositoryOption {
+	return func(options *repositoryOptions) {
+		options.mutexesMiddlewares = append(options.mutexesMiddlewares, middlewares...)
+	}
+}
+
+func applyStoreMiddlewares[T any](store Store[T], middlewares []any) Store[T] {
+	typedMiddlewares := make([]StoreMiddleware[T], len(middlewares))
+	for i, middleware := range middlewares {
+		typedMiddleware, ok := middleware.(StoreMiddleware[T])
+		if !ok {
+			panic(fmt.Sprintf("store middleware %T does not match the entity type of the repository", middleware))
+		}
+		typedMiddlewares[i] = typedMiddleware
+	}
+	return ChainStore(store, typedMiddlewares...)
+}
+
+//拦截一次调用，method是被调用的方法名，ids是调用涉及的id（查询类的方法为nil），
+//call执行被拦截的调用，可以用不同的ctx调用零次或多次
+type Interceptor func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error
+
+//用interceptor拦截store的每一次调用。如果store实现了QueryStore，返回的Store也实现QueryStore
+func InterceptStore[T any](store Store[T], interceptor Interceptor) Store[T] {
+	intercepted := &interceptedStore[T]{store, interceptor}
+	if queryStore, ok := store.(QueryStore[T]); ok {
+		return &interceptedQueryStore[T]{intercepted, queryStore}
+	}
+	return intercepted
+}
+
+type interceptedStore[T any] struct {
+	store       Store[T]
+	interceptor Interceptor
+}
+
+func (store *interceptedStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	err = store.interceptor(ctx, "Load", []any{id}, func(ctx context.Context) error {
+		var err error
+		entity, found, err = store.store.Load(ctx, id)
+		return err
+	})
+	return
+}
+
+func (store *interceptedStore[T]) Save(ctx context.Context, id any, entity T) error {
+	return store.interceptor(ctx, "Save", []any{id}, func(ctx context.Context) error {
+		return store.store.Save(ctx, id, entity)
+	})
+}
+
+func (store *interceptedStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*ProcessEntity) error {
+	ids := make([]any, 0, len(entitiesToInsert)+len(entitiesToUpdate))
+	for id := range entitiesToInsert {
+		ids = append(ids, id)
+	}
+	for id := range entitiesToUpdate {
+		ids = append(ids, id)
+	}
+	return store.interceptor(ctx, "SaveAll", ids, func(ctx context.Context) error {
+		return store.store.SaveAll(ctx, entitiesToInsert, entitiesToUpdate)
+	})
+}
+
+func (store *interceptedStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	return store.interceptor(ctx, "RemoveAll", ids, func(ctx context.Context) error {
+		return store.store.RemoveAll(ctx, ids)
+	})
+}
+
+type interceptedQueryStore[T any] struct {
+	*interceptedStore[T]
+	queryStore QueryStore[T]
+}
+
+func (store *interceptedQueryStore[T]) QueryAllIds(ctx context.Context) (ids []any, err error) {
+	err = store.interceptor(ctx, "QueryAllIds", nil, func(ctx context.Context) error {
+		var err error
+		ids, err = store.queryStore.QueryAllIds(ctx)
+		return err
+	})
+	return
+}
+
+func (store *interceptedQueryStore[T]) Count(ctx context.Context) (count uint64, err error) {
+	err = store.interceptor(ctx, "Count", nil, func(ctx context.Context) error {
+		var err error
+		count, err = store.queryStore.Count(ctx)
+		return err
+	})
+	return
+}
+
+func (store *interceptedQueryStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) (entities []T, err error) {
+	err = store.interceptor(ctx, "QueryAllByField", nil, func(ctx context.Context) error {
+		var err error
+		entities, err = store.queryStore.QueryAllByField(ctx, fieldName, fieldValue)
+		return err
+	})
+	return
+}
+
+func (store *interceptedQueryStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) (ids []any, err error) {
+	err = store.interceptor(ctx, "QueryIdsByField", nil, func(ctx context.Context) error {
+		var err error
+		ids, err = store.queryStore.QueryIdsByField(ctx, fieldName, fieldValue)
+		return err
+	})
+	return
+}
+
+//用interceptor拦截mutexes的每一次调用（LeaseTTL除外）。返回的Mutexes实现mutexes所实现的TryMutexes、LeasedMutexes和TryLeasedMutexes，
+//没有租约时还实现mutexes所实现的OrderedMutexes（带租约时仓库不会用到LockAll）。
+//UnlockAll没有返回值，interceptor返回的错误会被忽略
+func InterceptMutexes(mutexes Mutexes, interceptor Interceptor) Mutexes {
+	intercepted := &interceptedMutexes{mutexes, interceptor}
+	var tryMutexes *interceptedTryMutexes
+	if m, ok := mutexes.(TryMutexes); ok {
+		tryMutexes = &interceptedTryMutexes{intercepted, m}
+	}
+	if m, ok := mutexes.(LeasedMutexes); ok {
+		leasedMutexes := &interceptedLeasedMutexes{intercepted, m}
+		if m, ok := mutexes.(TryLeasedMutexes); ok {
+			tryLeasedMutexes := &interceptedTryLeasedMutexes{leasedMutexes, m}
+			if tryMutexes != nil {
+				return &struct {
+					*interceptedTryLeasedMutexes
+					tryLock
+				}{tryLeasedMutexes, tryLock{tryMutexes}}
+			}
+			return tryLeasedMutexes
+		}
+		if tryMutexes != nil {
+			return &struct {
+				*interceptedLeasedMutexes
+				tryLock
+			}{leasedMutexes, tryLock{tryMutexes}}
+		}
+		return leasedMutexes
+	}
+	if m, ok := mutexes.(OrderedMutexes); ok {
+		if tryMutexes != nil {
+			return &struct {
+				*interceptedTryMutexes
+				lockAll
+			}{tryMutexes, lockAll{intercepted, m}}
+		}
+		return &struct {
+			*interceptedMutexes
+			lockAll
+		}{intercepted, lockAll{intercepted, m}}
+	}
+	if tryMutexes != nil {
+		return tryMutexes
+	}
+	return intercepted
+}
+
+type interceptedMutexes struct {
+	mutexes     Mutexes
+	interceptor Interceptor
+}
+
+func (mutexes *interceptedMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	err = mutexes.interceptor(ctx, "Lock", []any{id}, func(ctx context.Context) error {
+		var err error
+		ok, absent, err = mutexes.mutexes.Lock(ctx, id)
+		return err
+	})
+	return
+}
+
+func (mutexes *interceptedMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	err = mutexes.interceptor(ctx, "NewAndLock", []any{id}, func(ctx context.Context) error {
+		var err error
+		ok, err = mutexes.mutexes.NewAndLock(ctx, id)
+		return err
+	})
+	return
+}
+
+func (mutexes *interceptedMutexes) UnlockAll(ctx context.Context, ids []any) {
+	mutexes.interceptor(ctx, "UnlockAll", ids, func(ctx context.Context) error {
+		mutexes.mutexes.UnlockAll(ctx, ids)
+		return nil
+	})
+}
+
+type interceptedTryMutexes struct {
+	*interceptedMutexes
+	tryMutexes TryMutexes
+}
+
+func (mutexes *interceptedTryMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	err = mutexes.interceptor(ctx, "TryLock", []any{id}, func(ctx context.Context) error {
+		var err error
+		ok, absent, err = mutexes.tryMutexes.TryLock(ctx, id, wait)
+		return err
+	})
+	return
+}
+
+//组合时只取TryLock，避免和其他包装类型的方法冲突
+type tryLock struct {
+	mutexes *interceptedTryMutexes
+}
+
+func (t tryLock) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	return t.mutexes.TryLock(ctx, id, wait)
+}
+
+//组合时只取LockAll
+type lockAll struct {
+	mutexes        *interceptedMutexes
+	orderedMutexes OrderedMutexes
+}
+
+func (l lockAll) LockAll(ctx context.Context, ids []any) error {
+	return l.mutexes.interceptor(ctx, "LockAll", ids, func(ctx context.Context) error {
+		return l.orderedMutexes.LockAll(ctx, ids)
+	})
+}
+
+type interceptedLeasedMutexes struct {
+	*interceptedMutexes
+	leasedMutexes LeasedMutexes
+}
+
+func (mutexes *interceptedLeasedMutexes) LockLease(ctx context.Context, id any) (token uint64, ok bool, absent bool, err error) {
+	err = mutexes.interceptor(ctx, "LockLease", []any{id}, func(ctx context.Context) error {
+		var err error
+		token, ok, absent, err = mutexes.leasedMutexes.LockLease(ctx, id)
+		return err
+	})
+	return
+}
+
+func (mutexes *interceptedLeasedMutexes) NewAndLockLease(ctx context.Context, id any) (token uint64, ok bool, err error) {
+	err = mutexes.interceptor(ctx, "NewAndLockLease", []any{id}, func(ctx context.Context) error {
+		var err error
+		token, ok, err = mutexes.leasedMutexes.NewAndLockLease(ctx, id)
+		return err
+	})
+	return
+}
+
+func (mutexes *interceptedLeasedMutexes) Renew(ctx context.Context, ids []any) error {
+	return mutexes.interceptor(ctx, "Renew", ids, func(ctx context.Context) error {
+		return mutexes.leasedMutexes.Renew(ctx, ids)
+	})
+}
+
+func (mutexes *interceptedLeasedMutexes) LeaseTTL() time.Duration {
+	return mutexes.leasedMutexes.LeaseTTL()
+}
+
+type interceptedTryLeasedMutexes struct {
+	*interceptedLeasedMutexes
+	tryLeasedMutexes TryLeasedMutexes
+}
+
+func (mutexes *interceptedTryLeasedMutexes) TryLockLease(ctx context.Context, id any, wait time.Duration) (token uint64, ok bool, absent bool, err error) {
+	err = mutexes.interceptor(ctx, "TryLockLease", []any{id}, func(ctx context.Context) error {
+		var err error
+		token, ok, absent, err = mutexes.tryLeasedMutexes.TryLockLease(ctx, id, wait)
+		return err
+	})
+	return
+}
@@ -0,0 +1,84 @@
+package arp
+
+import (
+	"context"
+	"errors"
+)
+
+//在过程之外调用会改变仓库的方法（Take，Put，PutIfAbsent，Remove，TakeOrPutIfAbsent）时返回的错误。
+//独立实体仓库的Take和Put直接返回这个错误
+var ErrNoProcess = errors.New("no process in context, use arp.Go or arp.Start to start a process")
+
+//仓库的方法在过程之外被调用时的处理方式
+type ProcessMode int
+
+const (
+	//不做检查。注意过程之外Take的锁不会被释放，变化也不会被保存
+	ProcessModeLenient ProcessMode = iota
+	//过程之外调用会改变仓库的方法，以ErrNoProcess panic
+	ProcessModeStrict
+	//过程之外调用会改变仓库的方法，自动为这一次调用开启一个过程，调用返回前结束过程。
+	//注意调用返回后对实体的修改不会被保存。Take、TryTake、TakeAll、TakeAny和TakeOrPutIfAbsent
+	//在调用返回时已经释放了锁，得到的实体相当于Find的结果，要修改实体需要用Go或者Start开启过程
+	ProcessModeAuto
+)
+
+type repositoryOptions struct {
+	processMode ProcessMode
+	//元素是StoreMiddleware[T]，RepositoryOption不带类型参数，创建仓库时再检查类型
+	storeMiddlewares   []any
+	mutexesMiddlewares []MutexesMiddleware
+}
+
+type RepositoryOption func(options *repositoryOptions)
+
+func WithProcessMode(mode ProcessMode) RepositoryOption {
+	return func(options *repositoryOptions) {
+		options.processMode = mode
+	}
+}
+
+func newRepositoryOptions(opts []RepositoryOption) *repositoryOptions {
+	options := &repositoryOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+//按照ProcessMode在过程中执行f
+func runInProcess(ctx context.Context, mode ProcessMode, f func(ctx context.Context)) {
+	if _, ok := getProcessContext(ctx); ok {
+		f(ctx)
+		return
+	}
+	switch mode {
+	case ProcessModeStrict:
+		panic(ErrNoProcess)
+	case ProcessModeAuto:
+		err := Go(ctx, func(ctx context.Context) error {
+			f(ctx)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	default:
+		f(ctx)
+	}
+}
+
+//独立实体仓库的方法返回错误而不是panic，按照ProcessMode在过程中执行f
+func runInProcessWithError(ctx context.Context, mode ProcessMode, f func(ctx context.Context) error) error {
+	if _, ok := getProcessContext(ctx); ok {
+		return f(ctx)
+	}
+	switch mode {
+	case ProcessModeStrict:
+		return ErrNoProcess
+	case ProcessModeAuto:
+		return Go(ctx, f)
+	default:
+		return f(ctx)
+	}
+}
@@ -3,36 +3,43 @@ package arp
 import (
 	"context"
 	"errors"
-	"reflect"
 )
 
 func Start(ctx context.Context) context.Context {
 	return context.WithValue(ctx, procCtxKey, newProcessContext())
 }
 
-func Finish(ctx context.Context) error {
-	defer func() {
-		pc, ok := getProcessContext(ctx)
-		if !ok {
-			return
-		}
-		releaseProcessEntities(ctx, pc)
-	}()
+//store或者mutexes在flush中的panic也作为错误返回，同时通知过程中止，Finish返回之前已经释放了过程中的实体
+func Finish(ctx context.Context) (err error) {
 	pc, ok := getProcessContext(ctx)
 	if !ok {
 		return nil
 	}
-	if err := flushProcessEntities(ctx, pc); err != nil {
+	defer releaseProcessEntities(ctx, pc)
+	changeSets, err := flushRecovered(ctx, pc)
+	if err != nil {
+		notifyAborted(ctx, pc)
 		return err
 	}
+	notifyCommitted(ctx, changeSets)
 	return nil
 }
 
+func flushRecovered(ctx context.Context, pc *ProcessContext) (changeSets map[string]*ChangeSet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicToError(r)
+		}
+	}()
+	return flushProcessEntities(ctx, pc)
+}
+
 func Abort(ctx context.Context) {
 	pc, ok := getProcessContext(ctx)
 	if !ok {
 		return
 	}
+	notifyAborted(ctx, pc)
 	releaseProcessEntities(ctx, pc)
 }
 
@@ -47,29 +54,34 @@ func Go(ctx context.Context, f func(ctx context.Context) error) (err error) {
 			err = Finish(ctx)
 		} else {
 			Abort(ctx)
-			switch x := r.(type) {
-			case string:
-				err = errors.New(x)
-			case error:
-				err = x
-			default:
-				err = errors.New("unknow panic")
-			}
+			err = panicToError(r)
 		}
 	}()
 	err = f(ctx)
 	return
 }
 
+func panicToError(r any) error {
+	switch x := r.(type) {
+	case string:
+		return errors.New(x)
+	case error:
+		return x
+	default:
+		return errors.New("unknow panic")
+	}
+}
+
 //收集，共享，输出一个过程中的数据。包括过程信息，过程中涉及到的实体的状态变化
 type ProcessContext struct {
 	entities       map[string]*repositoryProcessEntities
 	singletonTypes []string
+	leases         map[string]*processLeases
 }
 
-func (pc *ProcessContext) addEntityTakenFromRepo(entityType string, id any, entity any) {
+func (pc *ProcessContext) addEntityTakenFromRepo(entityType string, id any, entity any, created bool) {
 	rpes := pc.getRepositoryProcessEntities(entityType)
-	rpes.addEntityTaken(entityType, id, entity)
+	rpes.addEntityTaken(entityType, id, entity, created)
 }
 
 func (pc *ProcessContext) getRepositoryProcessEntities(entityType string) *repositoryProcessEntities {
@@ -101,7 +113,7 @@ func (pc *ProcessContext) addEntityTakenFromSingletonRepo(entityType string) {
 }
 
 func newProcessContext() *ProcessContext {
-	return &ProcessContext{entities: make(map[string]*repositoryProcessEntities)}
+	return &ProcessContext{entities: make(map[string]*repositoryProcessEntities), leases: make(map[string]*processLeases)}
 }
 
 //针对某个仓库收集的，在一个过程中变化的实体
@@ -113,8 +125,8 @@ func newRepositoryProcessEntities() *repositoryProcessEntities {
 	return &repositoryProcessEntities{make(map[any]*ProcessEntity)}
 }
 
-func (rpes *repositoryProcessEntities) addEntityTaken(entityType string, id any, entity any) {
-	rpes.entities[id] = &ProcessEntity{CopyEntity(entityType, entity), entity, &TakenFromRepoState{}}
+func (rpes *repositoryProcessEntities) addEntityTaken(entityType string, id any, entity any, created bool) {
+	rpes.entities[id] = &ProcessEntity{CopyEntity(entityType, entity), entity, &TakenFromRepoState{created}}
 }
 
 func (rpes *repositoryProcessEntities) copyEntityInProcess(entityType string, id any) any {
@@ -148,6 +160,16 @@ type ProcessEntity struct {
 	state    ProcessEntityState
 }
 
+//构造一个从仓库取出的实体，用于在仓库之外直接调用Store.SaveAll更新实体，比如数据迁移
+func NewTakenProcessEntity(snapshot any, entity any) *ProcessEntity {
+	return &ProcessEntity{snapshot, entity, &TakenFromRepoState{}}
+}
+
+//同样状态的ProcessEntity，但实体换成entity，用于store的装饰器在保存前转换实体
+func (pe *ProcessEntity) WithEntity(entity any) *ProcessEntity {
+	return &ProcessEntity{pe.snapshot, entity, pe.state}
+}
+
 func (pe *ProcessEntity) State() ProcessEntityState {
 	return pe.state
 }
@@ -199,6 +221,8 @@ type ProcessEntityState interface {
 
 //从仓库中取来的状态
 type TakenFromRepoState struct {
+	//是过程中通过PutIfAbsent直接保存到仓库的，提交时作为新增通知
+	created bool
 }
 
 func (state *TakenFromRepoState) transferByTake() ProcessEntityState {
@@ -326,32 +350,61 @@ func TakenFromRepository(ctx context.Context, entityType string, id any, entity
 	if !ok {
 		return
 	}
-	pc.addEntityTakenFromRepo(entityType, id, entity)
+	pc.addEntityTakenFromRepo(entityType, id, entity, false)
+}
+
+//过程中直接保存到仓库的新实体（PutIfAbsent），之后和取来的实体一样处理，只是提交时在ChangeSet中算作新增
+func CreatedInRepository(ctx context.Context, entityType string, id any, entity any) {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return
+	}
+	pc.addEntityTakenFromRepo(entityType, id, entity, true)
 }
 
-func flushProcessEntities(ctx context.Context, pc *ProcessContext) error {
+//保存过程中的变化，返回每个实体类型的变化
+func flushProcessEntities(ctx context.Context, pc *ProcessContext) (map[string]*ChangeSet, error) {
+	for _, entityType := range pc.singletonTypes {
+		if err := getSingletonRepository(entityType).FlushProcessEntity(ctx); err != nil {
+			return nil, err
+		}
+	}
+	changeSets := make(map[string]*ChangeSet, len(pc.entities))
 	for entityType, repoPes := range pc.entities {
 		entitiesToInsert := make(map[any]any)
 		entitiesToUpdate := make(map[any]*ProcessEntity)
 		idsToRemoveEntity := make([]any, 0, len(repoPes.entities))
+		changes := &ChangeSet{entityType, make(map[any]any), make(map[any]any), nil, make(map[any]any)}
 		for k, v := range repoPes.entities {
-			switch v.state.(type) {
+			switch state := v.state.(type) {
 			case *TakenFromRepoState:
-				if !reflect.DeepEqual(v.snapshot, v.entity) {
+				changed := !entityEqual(entityType, v.snapshot, v.entity)
+				if changed {
 					entitiesToUpdate[k] = v
 				}
+				switch {
+				case state.created:
+					changes.Inserted[k] = v.entity
+				case changed:
+					changes.Updated[k] = v.entity
+				default:
+					changes.Unchanged[k] = v.entity
+				}
 			case *CreatedInProcState:
 				entitiesToInsert[k] = v.entity
+				changes.Inserted[k] = v.entity
 			case *ToRemoveInRepoState:
 				idsToRemoveEntity = append(idsToRemoveEntity, k)
 			default:
 			}
 		}
+		changes.Removed = idsToRemoveEntity
 		if err := getRepository(entityType).FlushProcessEntities(ctx, entitiesToInsert, entitiesToUpdate, idsToRemoveEntity); err != nil {
-			return err
+			return nil, err
 		}
+		changeSets[entityType] = changes
 	}
-	return nil
+	return changeSets, nil
 }
 
 func releaseProcessEntities(ctx context.Context, pc *ProcessContext) {
@@ -367,6 +420,8 @@ func releaseProcessEntities(ctx context.Context, pc *ProcessContext) {
 	for _, entityType := range pc.singletonTypes {
 		getSingletonRepository(entityType).ReleaseProcessEntity(ctx)
 	}
+	stopProcessLeases(pc)
+	pc.leases = make(map[string]*processLeases)
 }
 
 func CopyEntityInProcess(ctx context.Context, entityType string, id any) any {
@@ -394,6 +449,23 @@ func TakeEntityInProcess(ctx context.Context, entityType string, id any) (exists
 	}
 }
 
+func entityInProcess(ctx context.Context, entityType string, id any) bool {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return false
+	}
+	return pc.getEntityInProcess(entityType, id) != nil
+}
+
+//把实体从过程中移除，不再参与保存和释放
+func releaseEntityInProcess(ctx context.Context, entityType string, id any) {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return
+	}
+	delete(pc.getRepositoryProcessEntities(entityType).entities, id)
+}
+
 func EntityAvailableInProcess(ctx context.Context, entityType string, id any) bool {
 	pc, ok := getProcessContext(ctx)
 	if !ok {
@@ -447,6 +519,19 @@ func GetFromOrPutEntityToProcessIfNotAvailable(ctx context.Context, entityType s
 	return
 }
 
+func SingletonTakenInProcess(ctx context.Context, entityType string) bool {
+	pc, ok := getProcessContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, singletonType := range pc.singletonTypes {
+		if singletonType == entityType {
+			return true
+		}
+	}
+	return false
+}
+
 func TakenFromSingletonRepository(ctx context.Context, entityType string) {
 	pc, ok := getProcessContext(ctx)
 	if !ok {
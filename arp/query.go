@@ -0,0 +1,131 @@
+package arp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//store不支持查询
+var ErrQueryUnsupported = errors.New("store does not support query")
+
+//可以查询的store
+type QueryStore[T any] interface {
+	Store[T]
+	QueryAllIds(ctx context.Context) (ids []any, err error)
+	Count(ctx context.Context) (uint64, error)
+	QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error)
+	QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error)
+}
+
+//按字段值相等过滤
+type QueryFilter struct {
+	FieldName  string
+	FieldValue any
+}
+
+func (filter QueryFilter) match(entity any) bool {
+	value, ok := util.FieldValue(entity, filter.FieldName)
+	return ok && reflect.DeepEqual(value, filter.FieldValue)
+}
+
+//可以查询的仓库
+type QueryRepository[T any] interface {
+	Repository[T]
+	QueryAllIds(ctx context.Context) (ids []any, err error)
+	Count(ctx context.Context) (uint64, error)
+	QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error)
+	//取得最多n个符合条件并且没有被别人占用的实体，被占用的直接跳过（类似SQL的SKIP LOCKED），
+	//适合多个worker各自领取不同的任务。mutexes不支持尝试加锁时返回ErrTryLockUnsupported，
+	//加锁出错时返回错误，已经取得的实体留在过程中
+	TakeAny(ctx context.Context, filter QueryFilter, n int) ([]T, error)
+}
+
+func (repository *RepositoryImpl[T]) queryStore() (QueryStore[T], error) {
+	queryStore, ok := repository.store.(QueryStore[T])
+	if !ok {
+		return nil, ErrQueryUnsupported
+	}
+	return queryStore, nil
+}
+
+func (repository *RepositoryImpl[T]) QueryAllIds(ctx context.Context) (ids []any, err error) {
+	queryStore, err := repository.queryStore()
+	if err != nil {
+		return nil, err
+	}
+	return queryStore.QueryAllIds(ctx)
+}
+
+func (repository *RepositoryImpl[T]) Count(ctx context.Context) (uint64, error) {
+	queryStore, err := repository.queryStore()
+	if err != nil {
+		return 0, err
+	}
+	return queryStore.Count(ctx)
+}
+
+func (repository *RepositoryImpl[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	queryStore, err := repository.queryStore()
+	if err != nil {
+		return nil, err
+	}
+	return queryStore.QueryAllByField(ctx, fieldName, fieldValue)
+}
+
+func (repository *RepositoryImpl[T]) TakeAny(ctx context.Context, filter QueryFilter, n int) (entities []T, err error) {
+	if n < 0 {
+		return nil, fmt.Errorf("TakeAny error: negative n %d", n)
+	}
+	queryStore, err := repository.queryStore()
+	if err != nil {
+		return nil, err
+	}
+	if !repository.tryLockSupported() {
+		return nil, ErrTryLockUnsupported
+	}
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		entities, err = repository.takeAny(ctx, queryStore, filter, n)
+	})
+	return
+}
+
+func (repository *RepositoryImpl[T]) takeAny(ctx context.Context, queryStore QueryStore[T], filter QueryFilter, n int) ([]T, error) {
+	ids, err := queryStore.QueryIdsByField(ctx, filter.FieldName, filter.FieldValue)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]T, 0, n)
+	for _, id := range ids {
+		if len(entities) >= n {
+			break
+		}
+		inProcess := entityInProcess(ctx, repository.entityType, id)
+		entity, found, occupied, err := repository.takeWithLock(ctx, id, "TakeAny", func(ctx context.Context, id any) (ok bool, absent bool, err error) {
+			return repository.tryLock(ctx, id, 0)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if occupied || !found {
+			continue
+		}
+		//查询和加锁之间实体可能被别人改变了，加锁之后要再检查一次
+		if !filter.match(entity) {
+			if !inProcess {
+				releaseEntityInProcess(ctx, repository.entityType, id)
+				repository.unlock(ctx, id)
+			}
+			continue
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+func NewQueryRepository[T any](store QueryStore[T], mutexes Mutexes, newZeroEntityFunc NewZeroEntity[T], opts ...RepositoryOption) QueryRepository[T] {
+	return newRepository[T](store, mutexes, newZeroEntityFunc, opts)
+}
@@ -3,8 +3,10 @@ package arp
 import (
 	"context"
 	"errors"
+	"fmt"
 	"reflect"
 	"sync"
+	"time"
 )
 
 //仓库是存放聚合的地方，聚合只会通过它的id来获取。
@@ -22,6 +24,28 @@ type Repository[T any] interface {
 	TakeOrPutIfAbsent(ctx context.Context, id any, newEntity T) T
 }
 
+//可以尝试获取实体的仓库，被别人占用的时候不会一直等待。
+//没有放进Repository里，这样已有的Repository实现不需要修改；NewRepository和NewQueryRepository返回的仓库都实现了它，
+//例如：
+//repo.(arp.TryRepository[*Order]).TryTake(ctx, id)
+type TryRepository[T any] interface {
+	Repository[T]
+	TryTake(ctx context.Context, id any) (entity T, found bool, occupied bool)
+	TakeWithin(ctx context.Context, id any, d time.Duration) (entity T, found bool, occupied bool)
+}
+
+//可以一次取得多个实体的仓库，NewRepository和NewQueryRepository返回的仓库都实现了它。
+//mutexes实现了OrderedMutexes时一次按固定的顺序锁住所有id，多个过程取有交集的多组实体也不会互相死锁；
+//否则按ids的顺序逐个加锁，顺序由业务保证
+type TakeAllRepository[T any] interface {
+	Repository[T]
+	//返回找到的实体，不存在的id不在结果中
+	TakeAll(ctx context.Context, ids []any) map[any]T
+}
+
+//被装饰的仓库没有实现TryRepository
+var ErrTryTakeUnsupported = errors.New("repository does not support try take")
+
 //对内的仓库操作集合
 type innerRepository interface {
 	FlushProcessEntities(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*ProcessEntity, idsToRemoveEntity []any) error
@@ -29,9 +53,10 @@ type innerRepository interface {
 }
 
 type RepositoryImpl[T any] struct {
-	entityType string
-	store      Store[T]
-	mutexes    Mutexes
+	entityType  string
+	store       Store[T]
+	mutexes     Mutexes
+	processMode ProcessMode
 }
 
 type Store[T any] interface {
@@ -51,6 +76,22 @@ type Mutexes interface {
 	UnlockAll(ctx context.Context, ids []any)
 }
 
+//Mutexes不支持尝试加锁
+var ErrTryLockUnsupported = errors.New("mutexes do not support try lock")
+
+//支持尝试加锁的Mutexes，TryTake和TakeWithin需要用到。
+//在wait时间内得不到锁返回的ok和absent都为false，wait为0表示不等待
+type TryMutexes interface {
+	Mutexes
+	TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error)
+}
+
+//可以按固定的顺序一次锁住多个id的Mutexes，返回错误时没有持有ids中任何一个的锁
+type OrderedMutexes interface {
+	Mutexes
+	LockAll(ctx context.Context, ids []any) error
+}
+
 func (repository *RepositoryImpl[T]) EntityType() string {
 	return repository.entityType
 }
@@ -69,53 +110,155 @@ func (repository *RepositoryImpl[T]) Find(ctx context.Context, id any) (entity T
 }
 
 func (repository *RepositoryImpl[T]) Take(ctx context.Context, id any) (entity T, found bool) {
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		entity, found = repository.take(ctx, id)
+	})
+	return
+}
+
+func (repository *RepositoryImpl[T]) take(ctx context.Context, id any) (entity T, found bool) {
+	entity, found, occupied, err := repository.takeWithLock(ctx, id, "Take", repository.lock)
+	if err != nil {
+		panic(err.Error())
+	}
+	if occupied {
+		panic("Take error: can not 'Take' since entity is occupied")
+	}
+	return entity, found
+}
+
+//不等待，entity被别人占用的时候occupied为true
+func (repository *RepositoryImpl[T]) TryTake(ctx context.Context, id any) (entity T, found bool, occupied bool) {
+	return repository.tryTake(ctx, id, 0, "TryTake")
+}
+
+//最多等待d时间，到时还被别人占用的话occupied为true
+func (repository *RepositoryImpl[T]) TakeWithin(ctx context.Context, id any, d time.Duration) (entity T, found bool, occupied bool) {
+	return repository.tryTake(ctx, id, d, "TakeWithin")
+}
+
+func (repository *RepositoryImpl[T]) tryTake(ctx context.Context, id any, d time.Duration, op string) (entity T, found bool, occupied bool) {
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		deadline := time.Now().Add(d)
+		var err error
+		entity, found, occupied, err = repository.takeWithLock(ctx, id, op, func(ctx context.Context, id any) (ok bool, absent bool, err error) {
+			wait := time.Until(deadline)
+			if wait < 0 {
+				wait = 0
+			}
+			return repository.tryLock(ctx, id, wait)
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+	})
+	return
+}
+
+//加锁的错误返回给调用者，错误信息以op开头
+func (repository *RepositoryImpl[T]) TakeAll(ctx context.Context, ids []any) (entities map[any]T) {
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		entities = repository.takeAll(ctx, ids)
+	})
+	return
+}
+
+func (repository *RepositoryImpl[T]) takeAll(ctx context.Context, ids []any) map[any]T {
+	lock := repository.lock
+	//带租约的锁要记录每个id的fencing token，只能逐个加锁
+	orderedMutexes, ordered := repository.mutexes.(OrderedMutexes)
+	if _, leased := repository.mutexes.(LeasedMutexes); ordered && !leased {
+		//过程中已有的实体已经持有锁，其余的一次锁住，之后逐个加载
+		locked := make(map[any]bool)
+		var idsToLock []any
+		for _, id := range ids {
+			if !entityInProcess(ctx, repository.entityType, id) && !locked[id] {
+				locked[id] = true
+				idsToLock = append(idsToLock, id)
+			}
+		}
+		if err := orderedMutexes.LockAll(ctx, idsToLock); err != nil {
+			panic("TakeAll error: " + err.Error())
+		}
+		defer func() {
+			//出错时还没有放进过程的锁要释放
+			if len(locked) > 0 {
+				notTaken := make([]any, 0, len(locked))
+				for id := range locked {
+					notTaken = append(notTaken, id)
+				}
+				repository.mutexes.UnlockAll(ctx, notTaken)
+			}
+		}()
+		lock = func(ctx context.Context, id any) (ok bool, absent bool, err error) {
+			delete(locked, id)
+			return true, false, nil
+		}
+	}
+	entities := make(map[any]T, len(ids))
+	for _, id := range ids {
+		entity, found, _, err := repository.takeWithLock(ctx, id, "TakeAll", lock)
+		if err != nil {
+			panic(err.Error())
+		}
+		if found {
+			entities[id] = entity
+		}
+	}
+	return entities
+}
+
+func (repository *RepositoryImpl[T]) takeWithLock(ctx context.Context, id any, op string, lock func(ctx context.Context, id any) (ok bool, absent bool, err error)) (entity T, found bool, occupied bool, err error) {
 	exists, ent := TakeEntityInProcess(ctx, repository.entityType, id)
 	if exists {
 		value, _ := ent.(T)
-		return value, true
+		return value, true, false, nil
 	}
-	ok, absent, err := repository.mutexes.Lock(ctx, id)
+	ok, absent, err := lock(ctx, id)
 	if err != nil {
-		panic("Take error: " + err.Error())
+		return entity, false, false, fmt.Errorf("%s error: %w", op, err)
 	}
 	var existsEntity T
-	if absent {
+	for absent {
 		//检查entity存在且补锁
-		existsEntity, found = repository.Find(ctx, id)
+		_, found = repository.Find(ctx, id)
 		if !found {
-			return entity, false
+			return entity, false, false, nil
 		}
-		ok, err := repository.mutexes.NewAndLock(ctx, id)
+		ok, err = repository.newAndLock(ctx, id)
 		if err != nil {
-			panic("Take error: " + err.Error())
-		}
-		if !ok {
-			//补锁不成功那就是有人抢先补锁，那么这里就需要再去获得锁了
-			ok, _, err = repository.mutexes.Lock(ctx, id)
-			if err != nil {
-				panic("Take error: " + err.Error())
-			}
-			if !ok {
-				panic("Take error: can not 'Take' since entity is occupied")
-			}
+			return entity, false, false, fmt.Errorf("%s error: %w", op, err)
 		}
-	} else {
-		if !ok {
-			panic("Take error: can not 'Take' since entity is occupied")
+		if ok {
+			break
 		}
-		existsEntity, found = repository.Find(ctx, id)
+		//补锁不成功那就是有人抢先补锁，那么这里就需要再去获得锁了。
+		//抢先补锁的人可能已经释放，锁又被回收了，那就要重新补锁
+		ok, absent, err = lock(ctx, id)
 		if err != nil {
-			panic("Take error: " + err.Error())
-		}
-		if !found {
-			return entity, false
+			return entity, false, false, fmt.Errorf("%s error: %w", op, err)
 		}
 	}
+	if !ok {
+		return entity, false, true, nil
+	}
+	//得到锁之后再加载，加锁之前加载的可能已经被别的过程改变或删除
+	existsEntity, found = repository.Find(ctx, id)
+	if !found {
+		repository.unlock(ctx, id)
+		return entity, false, false, nil
+	}
 	TakenFromRepository(ctx, repository.entityType, id, existsEntity)
-	return existsEntity, true
+	return existsEntity, true, false, nil
 }
 
 func (repository *RepositoryImpl[T]) Put(ctx context.Context, id any, entity T) {
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		repository.put(ctx, id, entity)
+	})
+}
+
+func (repository *RepositoryImpl[T]) put(ctx context.Context, id any, entity T) {
 	if EntityAvailableInProcess(ctx, repository.entityType, id) {
 		panic("can not 'Put' since entity already exists")
 	}
@@ -123,29 +266,54 @@ func (repository *RepositoryImpl[T]) Put(ctx context.Context, id any, entity T)
 }
 
 func (repository *RepositoryImpl[T]) PutIfAbsent(ctx context.Context, id any, entity T) (actual T, absent bool) {
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		actual, absent = repository.putIfAbsent(ctx, id, entity)
+	})
+	return
+}
+
+func (repository *RepositoryImpl[T]) putIfAbsent(ctx context.Context, id any, entity T) (actual T, absent bool) {
 	//先要看过程中的，如果有可用的那就拿来做实际值，如果有但是不可用那就取用新值且新值覆盖老值
 	entityGetOrPut, get := GetFromOrPutEntityToProcessIfNotAvailable(ctx, repository.entityType, id, entity)
 	if entityGetOrPut != nil {
 		actual, _ = entityGetOrPut.(T)
 		return actual, !get
 	}
-	ok, err := repository.mutexes.NewAndLock(ctx, id)
+	ok, err := repository.newAndLock(ctx, id)
 	if err != nil {
 		panic("PutIfAbsent error: " + err.Error())
 	}
 	if !ok {
-		actual, _ = repository.Take(ctx, id)
+		actual, _ = repository.take(ctx, id)
 		return actual, false
 	}
-	if err = repository.store.Save(ctx, id, entity); err != nil {
+	//锁可能在没有人使用时被回收了，所以补锁成功不代表entity不存在
+	existsEntity, found, err := repository.store.Load(ctx, id)
+	if err != nil {
+		repository.unlock(ctx, id)
+		panic("PutIfAbsent error: " + err.Error())
+	}
+	if found {
+		TakenFromRepository(ctx, repository.entityType, id, existsEntity)
+		return existsEntity, false
+	}
+	if err = repository.store.Save(withProcessFencingTokens(ctx, repository.entityType), id, entity); err != nil {
+		repository.unlock(ctx, id)
 		panic("PutIfAbsent error: " + err.Error())
 	}
-	TakenFromRepository(ctx, repository.entityType, id, entity)
+	CreatedInRepository(ctx, repository.entityType, id, entity)
 	return entity, true
 }
 
 func (repository *RepositoryImpl[T]) Remove(ctx context.Context, id any) (removed T, exists bool) {
-	entity, found := repository.Take(ctx, id)
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		removed, exists = repository.remove(ctx, id)
+	})
+	return
+}
+
+func (repository *RepositoryImpl[T]) remove(ctx context.Context, id any) (removed T, exists bool) {
+	entity, found := repository.take(ctx, id)
 	if found {
 		RemoveEntityInProcess(ctx, repository.entityType, id)
 		return entity, true
@@ -153,16 +321,80 @@ func (repository *RepositoryImpl[T]) Remove(ctx context.Context, id any) (remove
 	return removed, false
 }
 
-func (repository *RepositoryImpl[T]) TakeOrPutIfAbsent(ctx context.Context, id any, newEntity T) T {
-	entity, found := repository.Take(ctx, id)
+func (repository *RepositoryImpl[T]) TakeOrPutIfAbsent(ctx context.Context, id any, newEntity T) (entity T) {
+	runInProcess(ctx, repository.processMode, func(ctx context.Context) {
+		entity = repository.takeOrPutIfAbsent(ctx, id, newEntity)
+	})
+	return
+}
+
+func (repository *RepositoryImpl[T]) takeOrPutIfAbsent(ctx context.Context, id any, newEntity T) T {
+	entity, found := repository.take(ctx, id)
 	if !found {
-		actual, _ := repository.PutIfAbsent(ctx, id, newEntity)
+		actual, _ := repository.putIfAbsent(ctx, id, newEntity)
 		return actual
 	}
 	return entity
 }
 
+//加锁，如果是带租约的锁，把fencing token记录到过程中
+func (repository *RepositoryImpl[T]) lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	leasedMutexes, leased := repository.mutexes.(LeasedMutexes)
+	if !leased {
+		return repository.mutexes.Lock(ctx, id)
+	}
+	token, ok, absent, err := leasedMutexes.LockLease(ctx, id)
+	if ok {
+		leasedInProcess(ctx, repository.entityType, id, token, leasedMutexes)
+	}
+	return ok, absent, err
+}
+
+func (repository *RepositoryImpl[T]) newAndLock(ctx context.Context, id any) (ok bool, err error) {
+	leasedMutexes, leased := repository.mutexes.(LeasedMutexes)
+	if !leased {
+		return repository.mutexes.NewAndLock(ctx, id)
+	}
+	token, ok, err := leasedMutexes.NewAndLockLease(ctx, id)
+	if ok {
+		leasedInProcess(ctx, repository.entityType, id, token, leasedMutexes)
+	}
+	return ok, err
+}
+
+func (repository *RepositoryImpl[T]) tryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	if !repository.tryLockSupported() {
+		return false, false, ErrTryLockUnsupported
+	}
+	if tryLeasedMutexes, leased := repository.mutexes.(TryLeasedMutexes); leased {
+		token, ok, absent, err := tryLeasedMutexes.TryLockLease(ctx, id, wait)
+		if ok {
+			leasedInProcess(ctx, repository.entityType, id, token, tryLeasedMutexes)
+		}
+		return ok, absent, err
+	}
+	return repository.mutexes.(TryMutexes).TryLock(ctx, id, wait)
+}
+
+//带租约的mutexes要实现TryLeasedMutexes，否则要实现TryMutexes
+func (repository *RepositoryImpl[T]) tryLockSupported() bool {
+	if _, ok := repository.mutexes.(TryLeasedMutexes); ok {
+		return true
+	}
+	if _, leased := repository.mutexes.(LeasedMutexes); leased {
+		return false
+	}
+	_, ok := repository.mutexes.(TryMutexes)
+	return ok
+}
+
+func (repository *RepositoryImpl[T]) unlock(ctx context.Context, id any) {
+	repository.mutexes.UnlockAll(withProcessFencingTokens(ctx, repository.entityType), []any{id})
+	leaseReleasedInProcess(ctx, repository.entityType, id)
+}
+
 func (repository *RepositoryImpl[T]) FlushProcessEntities(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*ProcessEntity, idsToRemoveEntity []any) error {
+	ctx = withProcessFencingTokens(ctx, repository.entityType)
 	err := repository.store.SaveAll(ctx, entitiesToInsert, entitiesToUpdate)
 	if err != nil {
 		return err
@@ -175,20 +407,29 @@ func (repository *RepositoryImpl[T]) FlushProcessEntities(ctx context.Context, e
 }
 
 func (repository *RepositoryImpl[T]) ReleaseProcessEntities(ctx context.Context, ids []any) {
-	repository.mutexes.UnlockAll(ctx, ids)
+	repository.mutexes.UnlockAll(withProcessFencingTokens(ctx, repository.entityType), ids)
 }
 
-func NewRepository[T any](store Store[T], mutexes Mutexes, newZeroEntityFunc NewZeroEntity[T]) Repository[T] {
+func NewRepository[T any](store Store[T], mutexes Mutexes, newZeroEntityFunc NewZeroEntity[T], opts ...RepositoryOption) Repository[T] {
+	return newRepository(store, mutexes, newZeroEntityFunc, opts)
+}
+
+func newRepository[T any](store Store[T], mutexes Mutexes, newZeroEntityFunc NewZeroEntity[T], opts []RepositoryOption) *RepositoryImpl[T] {
+	options := newRepositoryOptions(opts)
 	zeroEntity := newZeroEntityFunc()
 	entityType := reflect.TypeOf(zeroEntity).Elem()
 	typeFullname := entityType.PkgPath() + "." + entityType.Name()
 	generateEntityCopier(typeFullname, entityType, newZeroEntityFunc)
-	repo := &RepositoryImpl[T]{typeFullname, store, mutexes}
+	store = applyStoreMiddlewares(store, options.storeMiddlewares)
+	mutexes = ChainMutexes(mutexes, options.mutexesMiddlewares...)
+	repo := &RepositoryImpl[T]{typeFullname, store, mutexes, options.processMode}
 	registerRepository(repo)
 	return repo
 }
 
-//保存的是一个不存在于某个集合当中的独立的实体。只在内存中，如需从数据库加载初始数据，则在系统启动时完成加载
+//保存的是一个不存在于某个集合当中的独立的实体。
+//NewSingletonRepository创建的仓库只在内存中，如需从数据库加载初始数据，则在系统启动时完成加载；
+//NewStoredSingletonRepository创建的仓库基于SingletonStore，首次使用时加载，过程Finish时保存变化
 type SingletonRepository[T any] interface {
 	Get(ctx context.Context) (*T, error)
 	Take(ctx context.Context) (*T, error)
@@ -197,38 +438,200 @@ type SingletonRepository[T any] interface {
 
 //对内的独立实体仓库操作集合
 type innerSingletonRepository interface {
+	FlushProcessEntity(ctx context.Context) error
 	ReleaseProcessEntity(ctx context.Context)
 }
 
 type SingletonRepositoryImpl[T any] struct {
-	entityType string
-	entity     *T
-	mutex      *sync.Mutex
+	entityType  string
+	entity      *T
+	mutex       *sync.Mutex
+	processMode ProcessMode
 }
 
 func (repo *SingletonRepositoryImpl[T]) Get(ctx context.Context) (*T, error) {
 	return repo.entity, nil
 }
 
-func (repo *SingletonRepositoryImpl[T]) Take(ctx context.Context) (*T, error) {
-	repo.mutex.Lock()
-	TakenFromSingletonRepository(ctx, repo.entityType)
-	return repo.entity, nil
+func (repo *SingletonRepositoryImpl[T]) Take(ctx context.Context) (entity *T, err error) {
+	err = runInProcessWithError(ctx, repo.processMode, func(ctx context.Context) error {
+		repo.mutex.Lock()
+		TakenFromSingletonRepository(ctx, repo.entityType)
+		entity = repo.entity
+		return nil
+	})
+	return
 }
 
 func (repo *SingletonRepositoryImpl[T]) Put(ctx context.Context, entity *T) error {
-	repo.entity = entity
+	return runInProcessWithError(ctx, repo.processMode, func(ctx context.Context) error {
+		repo.entity = entity
+		return nil
+	})
+}
+
+func (repo *SingletonRepositoryImpl[T]) FlushProcessEntity(ctx context.Context) error {
 	return nil
 }
+
 func (repo *SingletonRepositoryImpl[T]) ReleaseProcessEntity(ctx context.Context) {
 	repo.mutex.Unlock()
 }
 
-func NewSingletonRepository[T any](entity *T) SingletonRepository[T] {
+func NewSingletonRepository[T any](entity *T, opts ...RepositoryOption) SingletonRepository[T] {
 	entityType := reflect.TypeOf(entity)
 	typeFullname := entityType.PkgPath() + "." + entityType.Name()
-	repo := &SingletonRepositoryImpl[T]{typeFullname, entity, &sync.Mutex{}}
-	registerSingletonRepository(repo)
+	options := newRepositoryOptions(opts)
+	repo := &SingletonRepositoryImpl[T]{typeFullname, entity, &sync.Mutex{}, options.processMode}
+	registerSingletonRepository(typeFullname, repo)
+	return repo
+}
+
+//独立实体的存储
+type SingletonStore[T any] interface {
+	Load(ctx context.Context) (entity *T, found bool, err error)
+	Save(ctx context.Context, entity *T) error
+}
+
+//基于SingletonStore的独立实体仓库，首次使用时从store加载，过程Finish时把变化保存到store
+type StoredSingletonRepositoryImpl[T any] struct {
+	entityType    string
+	store         SingletonStore[T]
+	newZeroEntity NewZeroEntity[*T]
+	//已提交的实体
+	entity *T
+	loaded bool
+	rwLock sync.RWMutex
+	mutex  *sync.Mutex
+	//当前Take了实体的过程所使用的实体，同一时间只有一个过程持有
+	working     *T
+	processMode ProcessMode
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) load(ctx context.Context) error {
+	repo.rwLock.RLock()
+	loaded := repo.loaded
+	repo.rwLock.RUnlock()
+	if loaded {
+		return nil
+	}
+	repo.rwLock.Lock()
+	defer repo.rwLock.Unlock()
+	if repo.loaded {
+		return nil
+	}
+	entity, found, err := repo.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		entity = repo.newZeroEntity()
+	}
+	repo.entity = entity
+	repo.loaded = true
+	return nil
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) committed() *T {
+	repo.rwLock.RLock()
+	defer repo.rwLock.RUnlock()
+	return repo.entity
+}
+
+//Get得到的是实体的副本，修改它不会影响仓库
+func (repo *StoredSingletonRepositoryImpl[T]) Get(ctx context.Context) (*T, error) {
+	if SingletonTakenInProcess(ctx, repo.entityType) {
+		return CopyEntity(repo.entityType, repo.working).(*T), nil
+	}
+	if err := repo.load(ctx); err != nil {
+		return nil, err
+	}
+	return CopyEntity(repo.entityType, repo.committed()).(*T), nil
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) Find(ctx context.Context) (*T, error) {
+	return repo.Get(ctx)
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) Take(ctx context.Context) (entity *T, err error) {
+	err = runInProcessWithError(ctx, repo.processMode, func(ctx context.Context) error {
+		entity, err = repo.take(ctx)
+		return err
+	})
+	return
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) take(ctx context.Context) (*T, error) {
+	if SingletonTakenInProcess(ctx, repo.entityType) {
+		return repo.working, nil
+	}
+	if err := repo.load(ctx); err != nil {
+		return nil, err
+	}
+	repo.mutex.Lock()
+	repo.working = CopyEntity(repo.entityType, repo.committed()).(*T)
+	TakenFromSingletonRepository(ctx, repo.entityType)
+	return repo.working, nil
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) Put(ctx context.Context, entity *T) error {
+	return runInProcessWithError(ctx, repo.processMode, func(ctx context.Context) error {
+		return repo.put(ctx, entity)
+	})
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) put(ctx context.Context, entity *T) error {
+	if SingletonTakenInProcess(ctx, repo.entityType) {
+		repo.working = entity
+		return nil
+	}
+	if _, ok := getProcessContext(ctx); !ok {
+		//不在过程中，直接保存
+		repo.mutex.Lock()
+		defer repo.mutex.Unlock()
+		if err := repo.store.Save(ctx, entity); err != nil {
+			return err
+		}
+		repo.rwLock.Lock()
+		repo.entity = entity
+		repo.loaded = true
+		repo.rwLock.Unlock()
+		return nil
+	}
+	repo.mutex.Lock()
+	repo.working = entity
+	TakenFromSingletonRepository(ctx, repo.entityType)
+	return nil
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) FlushProcessEntity(ctx context.Context) error {
+	committed := repo.committed()
+	if entityEqual(repo.entityType, committed, repo.working) {
+		return nil
+	}
+	if err := repo.store.Save(ctx, repo.working); err != nil {
+		return err
+	}
+	repo.rwLock.Lock()
+	repo.entity = repo.working
+	repo.loaded = true
+	repo.rwLock.Unlock()
+	return nil
+}
+
+func (repo *StoredSingletonRepositoryImpl[T]) ReleaseProcessEntity(ctx context.Context) {
+	repo.working = nil
+	repo.mutex.Unlock()
+}
+
+func NewStoredSingletonRepository[T any](store SingletonStore[T], newZeroEntityFunc NewZeroEntity[*T], opts ...RepositoryOption) SingletonRepository[T] {
+	zeroEntity := newZeroEntityFunc()
+	entityType := reflect.TypeOf(zeroEntity).Elem()
+	typeFullname := entityType.PkgPath() + "." + entityType.Name()
+	generateEntityCopier(typeFullname, entityType, newZeroEntityFunc)
+	options := newRepositoryOptions(opts)
+	repo := &StoredSingletonRepositoryImpl[T]{entityType: typeFullname, store: store, newZeroEntity: newZeroEntityFunc, mutex: &sync.Mutex{}, processMode: options.processMode}
+	registerSingletonRepository(typeFullname, repo)
 	return repo
 }
 
@@ -283,6 +686,10 @@ func (mutexes *MockMutexes) Lock(ctx context.Context, id any) (ok bool, absent b
 	return true, false, nil
 }
 
+func (mutexes *MockMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	return true, false, nil
+}
+
 func (mutexes *MockMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
 	return true, nil
 }
@@ -305,6 +712,6 @@ func (qf *MockQueryFuncs[T]) QueryAllByField(ctx context.Context, fieldName stri
 	return nil, errors.New("unsupported")
 }
 
-func NewMockRepository[T any](newZeroEntityFunc NewZeroEntity[T]) Repository[T] {
-	return NewRepository[T](NewMockStore[T](), NewMockMutexes(), newZeroEntityFunc)
+func NewMockRepository[T any](newZeroEntityFunc NewZeroEntity[T], opts ...RepositoryOption) Repository[T] {
+	return NewRepository[T](NewMockStore[T](), NewMockMutexes(), newZeroEntityFunc, opts...)
 }
@@ -0,0 +1,562 @@
+//arpgen为聚合类型生成DeepCopy和Equal方法，arp.CopyEntity和过程提交时的变化检测会优先使用它们，比反射快很多。
+//
+//用法，在聚合类型所在的包里加上：
+//
+//	//go:generate go run github.com/framework-arp/ARP4G/cmd/arpgen -type Order,Category
+//
+//-type列出的类型和它们的字段用到的同一个包里的struct类型都会生成方法，所以同一个包的类型要在一次生成里列出。
+//生成的DeepCopy按树复制，多处引用同一个值时复制出来的是多个值，有环的对象图会无限递归，这样的类型请继续使用反射的copier。
+//通过指针引用自己的类型（比如children []*Folder）可能有共享引用和环，arpgen默认拒绝生成，
+//确定它们的值总是树的时候用-tree生成。
+//接口和其他包的类型按反射深拷贝、按copy.Equal比较。
+//字段的arp:"-"标签表示不复制也不比较，复制出来的是零值；arp:"shared"表示不可变的值，复制时共享引用
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of type names")
+	output := flag.String("output", "", "output file name; default <dir>/<first type>_arpgen.go")
+	tree := flag.Bool("tree", false, "allow types that reference themselves through pointers; their values must be trees without shared references or cycles")
+	flag.Parse()
+	if *typeNames == "" {
+		fmt.Fprintln(os.Stderr, "usage: arpgen -type T[,T...] [-output file] [-tree] [dir]")
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	names := strings.Split(*typeNames, ",")
+	outputFile := *output
+	if outputFile == "" {
+		outputFile = filepath.Join(dir, strings.ToLower(names[0])+"_arpgen.go")
+	}
+	src, err := generate(dir, names, filepath.Base(outputFile), *tree)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "arpgen:", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(outputFile, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "arpgen:", err)
+		os.Exit(1)
+	}
+}
+
+//解析dir里的包（跳过测试文件和之前生成的文件），生成names以及它们用到的struct类型的方法。
+//tree为false时拒绝通过指针引用自己的类型
+func generate(dir string, names []string, outputName string, tree bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && info.Name() != outputName
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+	g := &generator{types: make(map[string]*ast.TypeSpec), needs: make(map[string]bool), expanding: make(map[string]bool)}
+	for _, pkg := range pkgs {
+		g.pkgName = pkg.Name
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				genDecl, ok := decl.(*ast.GenDecl)
+				if !ok || genDecl.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range genDecl.Specs {
+					typeSpec := spec.(*ast.TypeSpec)
+					g.types[typeSpec.Name.Name] = typeSpec
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		if err := g.addStruct(strings.TrimSpace(name)); err != nil {
+			return nil, err
+		}
+	}
+	if !tree {
+		for _, name := range g.structs {
+			if g.referencesThroughPointer(name, g.types[name].Type, false, make(map[string]bool)) {
+				return nil, fmt.Errorf("type %s references itself through a pointer, the generated DeepCopy would copy it as a tree and lose shared references and cycles; use -tree if its values are always trees", name)
+			}
+		}
+	}
+	return g.output()
+}
+
+//从expr能否经过指针到达名为target的struct类型，不复制的字段不算
+func (g *generator) referencesThroughPointer(target string, expr ast.Expr, viaPointer bool, visited map[string]bool) bool {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		spec := g.types[t.Name]
+		if spec == nil {
+			return false
+		}
+		if t.Name == target && viaPointer {
+			return true
+		}
+		if visited[t.Name] {
+			return false
+		}
+		visited[t.Name] = true
+		return g.referencesThroughPointer(target, spec.Type, viaPointer, visited)
+	case *ast.StructType:
+		for _, field := range t.Fields.List {
+			if fieldTagOption(field) == "" && g.referencesThroughPointer(target, field.Type, viaPointer, visited) {
+				return true
+			}
+		}
+	case *ast.StarExpr:
+		return g.referencesThroughPointer(target, t.X, true, visited)
+	case *ast.ArrayType:
+		return g.referencesThroughPointer(target, t.Elt, viaPointer, visited)
+	case *ast.MapType:
+		return g.referencesThroughPointer(target, t.Value, viaPointer, visited)
+	case *ast.ParenExpr:
+		return g.referencesThroughPointer(target, t.X, viaPointer, visited)
+	}
+	return false
+}
+
+type generator struct {
+	pkgName string
+	//包里声明的所有类型
+	types map[string]*ast.TypeSpec
+	//要生成方法的struct类型，按加入的顺序
+	structs []string
+	added   map[string]bool
+	//类型名是否需要深拷贝，计算中的类型按需要处理
+	needs map[string]bool
+	//正在展开的非struct命名类型，比如type Tree map[string]Tree，再次遇到时改用反射
+	expanding   map[string]bool
+	usesCopy    bool
+	buf         bytes.Buffer
+	varSeq      int
+}
+
+func (g *generator) addStruct(name string) error {
+	if g.added == nil {
+		g.added = make(map[string]bool)
+	}
+	if g.added[name] {
+		return nil
+	}
+	spec := g.types[name]
+	if spec == nil {
+		return fmt.Errorf("type %s not found in package %s", name, g.pkgName)
+	}
+	if spec.TypeParams != nil {
+		return fmt.Errorf("generic type %s is not supported", name)
+	}
+	structType, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return fmt.Errorf("type %s is not a struct", name)
+	}
+	g.added[name] = true
+	g.structs = append(g.structs, name)
+	for _, field := range structType.Fields.List {
+		if err := g.addReferencedStructs(field.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//字段类型里用到的本包struct类型也需要生成方法
+func (g *generator) addReferencedStructs(expr ast.Expr) error {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		spec := g.types[t.Name]
+		if spec == nil {
+			return nil
+		}
+		if _, ok := spec.Type.(*ast.StructType); ok {
+			return g.addStruct(t.Name)
+		}
+		if g.added[t.Name] {
+			return nil
+		}
+		//非struct的命名类型，比如type Items []Item，只展开一次
+		g.added[t.Name] = true
+		return g.addReferencedStructs(spec.Type)
+	case *ast.StarExpr:
+		return g.addReferencedStructs(t.X)
+	case *ast.ArrayType:
+		return g.addReferencedStructs(t.Elt)
+	case *ast.MapType:
+		return g.addReferencedStructs(t.Value)
+	case *ast.ParenExpr:
+		return g.addReferencedStructs(t.X)
+	}
+	return nil
+}
+
+//类型的种类
+type kind int
+
+const (
+	//可以直接赋值和用==比较的基本类型
+	kindBasic kind = iota
+	//本包的struct，调用生成的方法
+	kindStruct
+	kindPointer
+	kindSlice
+	kindArray
+	kindMap
+	//func和chan，复制时共用同一个
+	kindFunc
+	kindChan
+	//接口和其他包的类型，用反射
+	kindOther
+)
+
+var basicTypes = map[string]bool{
+	"bool": true, "string": true, "byte": true, "rune": true, "uintptr": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true, "complex64": true, "complex128": true,
+}
+
+//解开本包的非struct命名类型，返回种类和底层的类型表达式
+func (g *generator) resolve(expr ast.Expr) (kind, ast.Expr) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if spec := g.types[t.Name]; spec != nil {
+			if _, ok := spec.Type.(*ast.StructType); ok {
+				return kindStruct, t
+			}
+			return g.resolve(spec.Type)
+		}
+		if basicTypes[t.Name] {
+			return kindBasic, t
+		}
+		return kindOther, t
+	case *ast.ParenExpr:
+		return g.resolve(t.X)
+	case *ast.StarExpr:
+		return kindPointer, t
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return kindSlice, t
+		}
+		return kindArray, t
+	case *ast.MapType:
+		return kindMap, t
+	case *ast.FuncType:
+		return kindFunc, t
+	case *ast.ChanType:
+		return kindChan, t
+	}
+	return kindOther, expr
+}
+
+func (g *generator) namedNonStruct(typeExpr ast.Expr, k kind) (string, bool) {
+	ident, ok := typeExpr.(*ast.Ident)
+	if !ok || k == kindStruct || g.types[ident.Name] == nil {
+		return "", false
+	}
+	return ident.Name, true
+}
+
+//类型的值是否需要深拷贝
+func (g *generator) needsCopy(expr ast.Expr) bool {
+	k, underlying := g.resolve(expr)
+	switch k {
+	case kindBasic, kindFunc, kindChan:
+		return false
+	case kindArray:
+		return g.needsCopy(underlying.(*ast.ArrayType).Elt)
+	case kindStruct:
+		name := underlying.(*ast.Ident).Name
+		if needs, ok := g.needs[name]; ok {
+			return needs
+		}
+		//计算中遇到自己说明是递归的类型，按需要处理
+		g.needs[name] = true
+		needs := false
+		for _, field := range g.types[name].Type.(*ast.StructType).Fields.List {
+			if fieldTagOption(field) == "" && g.needsCopy(field.Type) {
+				needs = true
+				break
+			}
+		}
+		g.needs[name] = needs
+		return needs
+	}
+	return true
+}
+
+func (g *generator) typeString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+func (g *generator) newVar(prefix string) string {
+	g.varSeq++
+	return fmt.Sprintf("%s%d", prefix, g.varSeq)
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+//生成把dst变成src的深拷贝的语句，执行前dst是src的浅拷贝，dst和src都是可寻址的表达式
+func (g *generator) copyInto(dst, src string, typeExpr ast.Expr) {
+	if !g.needsCopy(typeExpr) {
+		return
+	}
+	if copied, ok := g.copiedExpr(src, typeExpr); ok {
+		g.printf("%s = %s\n", dst, copied)
+		return
+	}
+	k, underlying := g.resolve(typeExpr)
+	if name, ok := g.namedNonStruct(typeExpr, k); ok {
+		g.expanding[name] = true
+		defer delete(g.expanding, name)
+	}
+	switch k {
+	case kindPointer:
+		elem := underlying.(*ast.StarExpr).X
+		g.printf("if %s != nil {\n", src)
+		g.printf("%s = new(%s)\n", dst, g.typeString(elem))
+		g.printf("*%s = *%s\n", dst, src)
+		g.copyInto("(*"+dst+")", "(*"+src+")", elem)
+		g.printf("}\n")
+	case kindSlice:
+		elem := underlying.(*ast.ArrayType).Elt
+		g.printf("if %s != nil {\n", src)
+		g.printf("%s = make(%s, len(%s), cap(%s))\n", dst, g.typeString(typeExpr), src, src)
+		g.printf("copy(%s, %s)\n", dst, src)
+		if g.needsCopy(elem) {
+			i := g.newVar("i")
+			g.printf("for %s := range %s {\n", i, src)
+			g.copyInto(dst+"["+i+"]", src+"["+i+"]", elem)
+			g.printf("}\n")
+		}
+		g.printf("}\n")
+	case kindArray:
+		elem := underlying.(*ast.ArrayType).Elt
+		i := g.newVar("i")
+		g.printf("for %s := range %s {\n", i, src)
+		g.copyInto(dst+"["+i+"]", src+"["+i+"]", elem)
+		g.printf("}\n")
+	case kindMap:
+		value := underlying.(*ast.MapType).Value
+		m, k, v := g.newVar("m"), g.newVar("k"), g.newVar("v")
+		g.printf("if %s != nil {\n", src)
+		g.printf("%s := make(%s, len(%s))\n", m, g.typeString(typeExpr), src)
+		g.printf("for %s, %s := range %s {\n", k, v, src)
+		if copied, ok := g.copiedExpr(v, value); ok {
+			g.printf("%s[%s] = %s\n", m, k, copied)
+		} else if g.needsCopy(value) {
+			c := g.newVar("c")
+			g.printf("%s := %s\n", c, v)
+			g.copyInto(c, v, value)
+			g.printf("%s[%s] = %s\n", m, k, c)
+		} else {
+			g.printf("%s[%s] = %s\n", m, k, v)
+		}
+		g.printf("}\n")
+		g.printf("%s = %s\n", dst, m)
+		g.printf("}\n")
+	}
+}
+
+//正在展开的命名类型再次遇到时按kindOther处理
+func (g *generator) expandedKind(typeExpr ast.Expr) (kind, ast.Expr) {
+	k, underlying := g.resolve(typeExpr)
+	if name, ok := g.namedNonStruct(typeExpr, k); ok && g.expanding[name] {
+		return kindOther, underlying
+	}
+	return k, underlying
+}
+
+//可以用一个表达式得到深拷贝的类型，返回这个表达式
+func (g *generator) copiedExpr(src string, typeExpr ast.Expr) (string, bool) {
+	k, underlying := g.expandedKind(typeExpr)
+	switch k {
+	case kindStruct:
+		return "*" + src + ".DeepCopy()", true
+	case kindPointer:
+		if elemKind, _ := g.resolve(underlying.(*ast.StarExpr).X); elemKind == kindStruct {
+			return src + ".DeepCopy()", true
+		}
+	case kindOther:
+		g.usesCopy = true
+		return "arpcopy.DeepCopyValue(" + src + ")", true
+	}
+	return "", false
+}
+
+//生成a和b不相等时return false的语句，a和b都是可寻址的表达式。和arpcopy.Equal的结果一致
+func (g *generator) compare(a, b string, typeExpr ast.Expr) {
+	k, underlying := g.expandedKind(typeExpr)
+	if name, ok := g.namedNonStruct(typeExpr, k); ok && k != kindOther {
+		g.expanding[name] = true
+		defer delete(g.expanding, name)
+	}
+	switch k {
+	case kindBasic, kindChan:
+		g.printf("if %s != %s {\nreturn false\n}\n", a, b)
+	case kindFunc:
+		g.printf("if %s != nil || %s != nil {\nreturn false\n}\n", a, b)
+	case kindStruct:
+		g.printf("if !%s.Equal(&%s) {\nreturn false\n}\n", a, b)
+	case kindPointer:
+		elem := underlying.(*ast.StarExpr).X
+		if elemKind, _ := g.resolve(elem); elemKind == kindStruct {
+			g.printf("if !%s.Equal(%s) {\nreturn false\n}\n", a, b)
+			break
+		}
+		g.printf("if (%s == nil) != (%s == nil) {\nreturn false\n}\n", a, b)
+		g.printf("if %s != nil && %s != %s {\n", a, a, b)
+		g.compare("(*"+a+")", "(*"+b+")", elem)
+		g.printf("}\n")
+	case kindSlice:
+		elem := underlying.(*ast.ArrayType).Elt
+		g.printf("if (%s == nil) != (%s == nil) || len(%s) != len(%s) {\nreturn false\n}\n", a, b, a, b)
+		i := g.newVar("i")
+		g.printf("for %s := range %s {\n", i, a)
+		g.compare(a+"["+i+"]", b+"["+i+"]", elem)
+		g.printf("}\n")
+	case kindArray:
+		elem := underlying.(*ast.ArrayType).Elt
+		i := g.newVar("i")
+		g.printf("for %s := range %s {\n", i, a)
+		g.compare(a+"["+i+"]", b+"["+i+"]", elem)
+		g.printf("}\n")
+	case kindMap:
+		value := underlying.(*ast.MapType).Value
+		k, av, bv, ok := g.newVar("k"), g.newVar("av"), g.newVar("bv"), g.newVar("ok")
+		g.printf("if (%s == nil) != (%s == nil) || len(%s) != len(%s) {\nreturn false\n}\n", a, b, a, b)
+		g.printf("for %s, %s := range %s {\n", k, av, a)
+		g.printf("%s, %s := %s[%s]\n", bv, ok, b, k)
+		g.printf("if !%s {\nreturn false\n}\n", ok)
+		g.compare(av, bv, value)
+		g.printf("}\n")
+	default:
+		g.usesCopy = true
+		g.printf("if !arpcopy.Equal(%s, %s) {\nreturn false\n}\n", a, b)
+	}
+}
+
+//字段arp标签里的"-"或者"shared"选项
+func fieldTagOption(field *ast.Field) string {
+	if field.Tag == nil {
+		return ""
+	}
+	tag, err := strconv.Unquote(field.Tag.Value)
+	if err != nil {
+		return ""
+	}
+	for _, option := range strings.Split(reflect.StructTag(tag).Get("arp"), ",") {
+		if option == "-" || option == "shared" {
+			return option
+		}
+	}
+	return ""
+}
+
+//类型的零值表达式，可以为nil的类型用nil
+func (g *generator) zeroValue(typeExpr ast.Expr) string {
+	k, underlying := g.resolve(typeExpr)
+	switch k {
+	case kindPointer, kindSlice, kindMap, kindFunc, kindChan:
+		return "nil"
+	case kindOther:
+		if _, ok := underlying.(*ast.InterfaceType); ok {
+			return "nil"
+		}
+		if ident, ok := underlying.(*ast.Ident); ok && (ident.Name == "any" || ident.Name == "error") {
+			return "nil"
+		}
+	}
+	return "*new(" + g.typeString(typeExpr) + ")"
+}
+
+//匿名字段的名字是类型名
+func fieldNames(field *ast.Field) []string {
+	if len(field.Names) > 0 {
+		names := make([]string, len(field.Names))
+		for i, name := range field.Names {
+			names[i] = name.Name
+		}
+		return names
+	}
+	expr := field.Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if sel, ok := expr.(*ast.SelectorExpr); ok {
+		return []string{sel.Sel.Name}
+	}
+	return []string{expr.(*ast.Ident).Name}
+}
+
+func (g *generator) output() ([]byte, error) {
+	var body bytes.Buffer
+	names := append([]string(nil), g.structs...)
+	sort.Strings(names)
+	for _, name := range names {
+		fields := g.types[name].Type.(*ast.StructType).Fields.List
+		g.buf.Reset()
+		g.varSeq = 0
+		g.printf("\n//DeepCopy返回一个深拷贝\n")
+		g.printf("func (x *%s) DeepCopy() *%s {\n", name, name)
+		g.printf("if x == nil {\nreturn nil\n}\n")
+		g.printf("c := new(%s)\n*c = *x\n", name)
+		for _, field := range fields {
+			option := fieldTagOption(field)
+			for _, fieldName := range fieldNames(field) {
+				if fieldName == "_" || option == "shared" {
+					continue
+				}
+				if option == "-" {
+					g.printf("c.%s = %s\n", fieldName, g.zeroValue(field.Type))
+					continue
+				}
+				g.copyInto("c."+fieldName, "x."+fieldName, field.Type)
+			}
+		}
+		g.printf("return c\n}\n")
+		g.printf("\n//Equal和arpcopy.Equal(x, o)的结果一致\n")
+		g.printf("func (x *%s) Equal(o *%s) bool {\n", name, name)
+		g.printf("if x == o {\nreturn true\n}\n")
+		g.printf("if x == nil || o == nil {\nreturn false\n}\n")
+		for _, field := range fields {
+			for _, fieldName := range fieldNames(field) {
+				if fieldName == "_" || fieldTagOption(field) == "-" {
+					continue
+				}
+				g.compare("x."+fieldName, "o."+fieldName, field.Type)
+			}
+		}
+		g.printf("return true\n}\n")
+		body.Write(g.buf.Bytes())
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by arpgen. DO NOT EDIT.\n\npackage %s\n", g.pkgName)
+	if g.usesCopy {
+		out.WriteString("\nimport arpcopy \"github.com/framework-arp/ARP4G/copy\"\n")
+	}
+	out.Write(body.Bytes())
+	return format.Source(out.Bytes())
+}
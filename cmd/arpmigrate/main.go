@@ -0,0 +1,49 @@
+//arpmigrate离线迁移FileStore中保存的实体，把全部实体的文档用注册的Upcaster升级到当前版本再写回去。
+//FileStore需要是schema.NewVersionedStore装饰的、用codec.JSONCodec保存文档的store，或者用schema.VersionedCodec和JSON文档编码的store。
+//
+//用法，迁移期间不能有其他进程使用这个目录：
+//
+//	arpmigrate -type github.com/example/shop.Order [-batch 100] dir
+//
+//Upcaster是在程序里注册的，所以要在upcasters.go中import注册Upcaster的包，再编译这个命令。
+//没有注册Upcaster的实体当前版本是1，迁移只会给没有版本信息的文档加上版本
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/framework-arp/ARP4G/codec"
+	"github.com/framework-arp/ARP4G/repoimpl"
+	"github.com/framework-arp/ARP4G/schema"
+)
+
+func main() {
+	entityType := flag.String("type", "", "full name of the entity type, <package path>.<type name>")
+	batchSize := flag.Int("batch", 100, "number of entities saved in one batch")
+	flag.Parse()
+	if *entityType == "" || flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: arpmigrate -type pkg.Type [-batch n] dir")
+		os.Exit(2)
+	}
+	migrated, err := migrate(*entityType, flag.Arg(0), *batchSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "arpmigrate:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("migrated %d entities of %s to version %d\n", migrated, *entityType, schema.CurrentVersionOf(*entityType))
+}
+
+func migrate(entityType string, dir string, batchSize int) (int, error) {
+	store, err := repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	if err != nil {
+		return 0, err
+	}
+	migrated, err := schema.MigrateDocuments(context.Background(), entityType, store, batchSize)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	return migrated, err
+}
@@ -0,0 +1,5 @@
+package main
+
+//在这里import注册Upcaster的包，比如：
+//
+//	import _ "github.com/example/shop/schema"
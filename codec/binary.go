@@ -0,0 +1,372 @@
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+var errBinaryTooShort = errors.New("codec: binary data too short")
+
+//紧凑的二进制编解码，按类型定义的字段顺序直接写值，不保存字段名，所以数据比json和gob小得多，
+//但增删字段或者调整字段顺序之后无法解码旧数据。和JSONCodec一样会保存未导出的字段。
+//整数用变长编码，slice、map和指针区分nil，map按key编码后的字节排序，相同的实体总是得到相同的字节。
+//只支持值为nil的interface字段，有环的对象图返回错误
+type BinaryCodec[T any] struct {
+}
+
+func (codec *BinaryCodec[T]) Encode(entity T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeBinary(&buf, reflect.ValueOf(&entity).Elem(), make(cycleGuard)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (codec *BinaryCodec[T]) Decode(data []byte) (entity T, err error) {
+	reader := bytes.NewReader(data)
+	if err = decodeBinary(reader, reflect.ValueOf(&entity).Elem()); err != nil {
+		return entity, err
+	}
+	if reader.Len() > 0 {
+		return entity, fmt.Errorf("codec: %d unexpected trailing bytes", reader.Len())
+	}
+	return entity, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, u uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], u)])
+}
+
+func writeVarint(buf *bytes.Buffer, i int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], i)])
+}
+
+func writeBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func encodeBinary(buf *bytes.Buffer, value reflect.Value, guard cycleGuard) error {
+	value = util.Accessible(value)
+	if text, ok, err := marshalText(value); ok {
+		if err != nil {
+			return err
+		}
+		writeUvarint(buf, uint64(len(text)))
+		buf.Write(text)
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		writeBool(buf, value.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeVarint(buf, value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUvarint(buf, value.Uint())
+	case reflect.Float32:
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(value.Float())))
+		buf.Write(b[:])
+	case reflect.Float64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value.Float()))
+		buf.Write(b[:])
+	case reflect.String:
+		writeUvarint(buf, uint64(value.Len()))
+		buf.WriteString(value.String())
+	case reflect.Slice:
+		//长度加1，0表示nil
+		if value.IsNil() {
+			writeUvarint(buf, 0)
+			return nil
+		}
+		writeUvarint(buf, uint64(value.Len())+1)
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(value.Bytes())
+			return nil
+		}
+		leave, err := guard.enter(value)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		for i := 0; i < value.Len(); i++ {
+			if err := encodeBinary(buf, value.Index(i), guard); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := encodeBinary(buf, value.Index(i), guard); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if value.IsNil() {
+			writeUvarint(buf, 0)
+			return nil
+		}
+		writeUvarint(buf, uint64(value.Len())+1)
+		leave, err := guard.enter(value)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		entries := make([][2][]byte, 0, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			var keyBuf, elementBuf bytes.Buffer
+			if err := encodeBinary(&keyBuf, addressableCopy(iter.Key()), guard); err != nil {
+				return err
+			}
+			if err := encodeBinary(&elementBuf, addressableCopy(iter.Value()), guard); err != nil {
+				return err
+			}
+			entries = append(entries, [2][]byte{keyBuf.Bytes(), elementBuf.Bytes()})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i][0], entries[j][0]) < 0
+		})
+		for _, entry := range entries {
+			buf.Write(entry[0])
+			buf.Write(entry[1])
+		}
+	case reflect.Pointer:
+		writeBool(buf, !value.IsNil())
+		if !value.IsNil() {
+			leave, err := guard.enter(value)
+			if err != nil {
+				return err
+			}
+			defer leave()
+			return encodeBinary(buf, value.Elem(), guard)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if err := encodeBinary(buf, value.Field(i), guard); err != nil {
+				return err
+			}
+		}
+	case reflect.Interface:
+		if !value.IsNil() {
+			return fmt.Errorf("codec: unsupported interface value of type %s", value.Elem().Type())
+		}
+		writeBool(buf, false)
+	default:
+		return fmt.Errorf("codec: unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+func addressableCopy(value reflect.Value) reflect.Value {
+	addressable := reflect.New(value.Type()).Elem()
+	addressable.Set(value)
+	return addressable
+}
+
+func readBytes(reader *bytes.Reader, n uint64) ([]byte, error) {
+	if n > uint64(reader.Len()) {
+		return nil, errBinaryTooShort
+	}
+	b := make([]byte, n)
+	io.ReadFull(reader, b)
+	return b, nil
+}
+
+func readBool(reader *bytes.Reader) (bool, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return false, errBinaryTooShort
+	}
+	return b != 0, nil
+}
+
+//读取长度，并检查剩余的数据是否足够，避免损坏的数据导致分配过大的内存或者循环过多次。
+//每个元素至少占一个字节，所以长度不超过剩余的字节数；大小为0的元素不占字节，长度不超过math.MaxInt32
+func readLength(reader *bytes.Reader, elementSize uintptr) (n int, isNil bool, err error) {
+	u, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, false, errBinaryTooShort
+	}
+	if u == 0 {
+		return 0, true, nil
+	}
+	u--
+	if elementSize > 0 && u > uint64(reader.Len()) {
+		return 0, false, errBinaryTooShort
+	}
+	if u > math.MaxInt32 {
+		return 0, false, fmt.Errorf("codec: length %d out of range", u)
+	}
+	n = int(u)
+	if n < 0 {
+		return 0, false, fmt.Errorf("codec: length %d out of range", u)
+	}
+	return n, false, nil
+}
+
+func decodeBinary(reader *bytes.Reader, value reflect.Value) error {
+	value = util.Accessible(value)
+	if value.Kind() != reflect.Pointer && value.Kind() != reflect.Interface && reflect.PointerTo(value.Type()).Implements(textUnmarshalerType) {
+		n, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errBinaryTooShort
+		}
+		text, err := readBytes(reader, n)
+		if err != nil {
+			return err
+		}
+		return value.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(text)
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		b, err := readBool(reader)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := binary.ReadVarint(reader)
+		if err != nil {
+			return errBinaryTooShort
+		}
+		if value.OverflowInt(i) {
+			return fmt.Errorf("codec: %d overflows %s", i, value.Type())
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errBinaryTooShort
+		}
+		if value.OverflowUint(u) {
+			return fmt.Errorf("codec: %d overflows %s", u, value.Type())
+		}
+		value.SetUint(u)
+	case reflect.Float32:
+		b, err := readBytes(reader, 4)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case reflect.Float64:
+		b, err := readBytes(reader, 8)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case reflect.String:
+		n, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errBinaryTooShort
+		}
+		b, err := readBytes(reader, n)
+		if err != nil {
+			return err
+		}
+		value.SetString(string(b))
+	case reflect.Slice:
+		n, isNil, err := readLength(reader, value.Type().Elem().Size())
+		if err != nil {
+			return err
+		}
+		if isNil {
+			value.Set(reflect.Zero(value.Type()))
+			return nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := readBytes(reader, uint64(n))
+			if err != nil {
+				return err
+			}
+			value.SetBytes(b)
+			return nil
+		}
+		slice := reflect.MakeSlice(value.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := decodeBinary(reader, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		value.Set(slice)
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := decodeBinary(reader, value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, isNil, err := readLength(reader, value.Type().Key().Size()+value.Type().Elem().Size())
+		if err != nil {
+			return err
+		}
+		if isNil {
+			value.Set(reflect.Zero(value.Type()))
+			return nil
+		}
+		//key和值的大小都为0时长度只按math.MaxInt32限制，预分配不超过剩余的字节数
+		m := reflect.MakeMapWithSize(value.Type(), min(n, reader.Len()))
+		for i := 0; i < n; i++ {
+			key := reflect.New(value.Type().Key()).Elem()
+			if err := decodeBinary(reader, key); err != nil {
+				return err
+			}
+			element := reflect.New(value.Type().Elem()).Elem()
+			if err := decodeBinary(reader, element); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, element)
+		}
+		value.Set(m)
+	case reflect.Pointer:
+		present, err := readBool(reader)
+		if err != nil {
+			return err
+		}
+		if !present {
+			value.Set(reflect.Zero(value.Type()))
+			return nil
+		}
+		ptr := reflect.New(value.Type().Elem())
+		if err := decodeBinary(reader, ptr.Elem()); err != nil {
+			return err
+		}
+		value.Set(ptr)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if err := decodeBinary(reader, value.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Interface:
+		present, err := readBool(reader)
+		if err != nil {
+			return err
+		}
+		if present {
+			return fmt.Errorf("codec: unsupported interface value in %s", value.Type())
+		}
+		value.Set(reflect.Zero(value.Type()))
+	default:
+		return fmt.Errorf("codec: unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+func NewBinaryCodec[T any]() *BinaryCodec[T] {
+	return &BinaryCodec[T]{}
+}
@@ -0,0 +1,448 @@
+package codec
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+//编码时正在访问的指针、map和slice，再次遇到说明对象图有环。
+//只记录当前路径上的，多处引用同一个值时按树编码
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+type cycleGuard map[visit]bool
+
+//进入value，value在当前路径上时返回错误。返回的leave在离开value时调用
+func (guard cycleGuard) enter(value reflect.Value) (leave func(), err error) {
+	key := visit{typ: value.Type()}
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.Type().Elem().Size() == 0 {
+			return func() {}, nil
+		}
+	case reflect.Slice:
+		if value.Len() == 0 {
+			return func() {}, nil
+		}
+		key.len = value.Len()
+	}
+	key.ptr = value.Pointer()
+	if guard[key] {
+		return nil, fmt.Errorf("codec: cycle detected at %s", value.Type())
+	}
+	guard[key] = true
+	return func() { delete(guard, key) }, nil
+}
+
+//把实体转成由map[string]any、[]any和基本类型组成的文档，和copy包一样包括未导出的字段。
+//struct转成以字段名为key的map，实现了encoding.TextMarshaler的类型（比如time.Time）转成字符串，
+//[]byte保持为[]byte，json.Number保持为数字，map的key只支持字符串、整数、浮点数和布尔类型。any类型的值按实际类型转换，解码时直接得到文档。
+//有环的对象图返回错误
+func ToDocument(entity any) (any, error) {
+	value := reflect.ValueOf(entity)
+	if !value.IsValid() {
+		return nil, nil
+	}
+	addressable := reflect.New(value.Type()).Elem()
+	addressable.Set(value)
+	return toDocument(addressable, make(cycleGuard))
+}
+
+//按指针判断是否实现了encoding.TextMarshaler，和解码时判断encoding.TextUnmarshaler一致，
+//这样指针接收者的MarshalText（比如big.Int）也会被使用
+func marshalText(value reflect.Value) (text []byte, ok bool, err error) {
+	if value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface || !reflect.PointerTo(value.Type()).Implements(textMarshalerType) {
+		return nil, false, nil
+	}
+	if !value.CanAddr() {
+		addressable := reflect.New(value.Type()).Elem()
+		addressable.Set(value)
+		value = addressable
+	}
+	text, err = value.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+	return text, true, err
+}
+
+func toDocument(value reflect.Value, guard cycleGuard) (any, error) {
+	value = util.Accessible(value)
+	//从json解码的文档中的数字，保持为数字，否则再编码成json时变成了字符串
+	if value.Type() == jsonNumberType {
+		return json.Number(value.String()), nil
+	}
+	if text, ok, err := marshalText(value); ok {
+		if err != nil {
+			return nil, err
+		}
+		return string(text), nil
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		return value.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	case reflect.String:
+		return value.String(), nil
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil, nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), value.Bytes()...), nil
+		}
+		leave, err := guard.enter(value)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		return sequenceToDocument(value, guard)
+	case reflect.Array:
+		return sequenceToDocument(value, guard)
+	case reflect.Map:
+		if value.IsNil() {
+			return nil, nil
+		}
+		leave, err := guard.enter(value)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		doc := make(map[string]any, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			key, err := mapKeyToString(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			elementValue := reflect.New(value.Type().Elem()).Elem()
+			elementValue.Set(iter.Value())
+			element, err := toDocument(elementValue, guard)
+			if err != nil {
+				return nil, err
+			}
+			doc[key] = element
+		}
+		return doc, nil
+	case reflect.Pointer:
+		if value.IsNil() {
+			return nil, nil
+		}
+		leave, err := guard.enter(value)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		return toDocument(value.Elem(), guard)
+	case reflect.Struct:
+		doc := make(map[string]any, value.NumField())
+		for i := 0; i < value.NumField(); i++ {
+			field, err := toDocument(value.Field(i), guard)
+			if err != nil {
+				return nil, err
+			}
+			doc[value.Type().Field(i).Name] = field
+		}
+		return doc, nil
+	case reflect.Interface:
+		if value.IsNil() {
+			return nil, nil
+		}
+		//any中的值按它实际的类型转换
+		if value.NumMethod() == 0 {
+			return toDocument(addressableCopy(value.Elem()), guard)
+		}
+		return nil, fmt.Errorf("codec: unsupported interface value of type %s", value.Elem().Type())
+	default:
+		return nil, fmt.Errorf("codec: unsupported type %s", value.Type())
+	}
+}
+
+func sequenceToDocument(value reflect.Value, guard cycleGuard) (any, error) {
+	doc := make([]any, value.Len())
+	for i := range doc {
+		element, err := toDocument(value.Index(i), guard)
+		if err != nil {
+			return nil, err
+		}
+		doc[i] = element
+	}
+	return doc, nil
+}
+
+func mapKeyToString(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(key.Float(), 'g', -1, 64), nil
+	case reflect.Bool:
+		return strconv.FormatBool(key.Bool()), nil
+	default:
+		return "", fmt.Errorf("codec: unsupported map key type %s", key.Type())
+	}
+}
+
+//把文档填到entityPtr指向的实体中，是ToDocument的逆操作。
+//数字可以是任意整数、浮点数类型或者json.Number，[]byte也可以是base64字符串，文档中没有的字段保持零值
+func FromDocument(doc any, entityPtr any) error {
+	ptrValue := reflect.ValueOf(entityPtr)
+	if ptrValue.Kind() != reflect.Pointer || ptrValue.IsNil() {
+		return errors.New("codec: FromDocument needs a non-nil pointer")
+	}
+	return fromDocument(doc, ptrValue.Elem())
+}
+
+func fromDocument(doc any, value reflect.Value) error {
+	value = util.Accessible(value)
+	if doc == nil {
+		value.Set(reflect.Zero(value.Type()))
+		return nil
+	}
+	if value.Kind() != reflect.Pointer && value.Kind() != reflect.Interface && reflect.PointerTo(value.Type()).Implements(textUnmarshalerType) {
+		text, ok := doc.(string)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		return value.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		b, ok := doc.(bool)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := docInt(doc)
+		if err != nil {
+			return err
+		}
+		if value.OverflowInt(i) {
+			return fmt.Errorf("codec: %d overflows %s", i, value.Type())
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := docUint(doc)
+		if err != nil {
+			return err
+		}
+		if value.OverflowUint(u) {
+			return fmt.Errorf("codec: %d overflows %s", u, value.Type())
+		}
+		value.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := docFloat(doc)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.String:
+		s, ok := doc.(string)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		value.SetString(s)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			if b, ok := doc.([]byte); ok {
+				value.SetBytes(append([]byte(nil), b...))
+				return nil
+			}
+			if s, ok := doc.(string); ok {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return err
+				}
+				value.SetBytes(b)
+				return nil
+			}
+		}
+		elements, ok := doc.([]any)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		slice := reflect.MakeSlice(value.Type(), len(elements), len(elements))
+		for i, element := range elements {
+			if err := fromDocument(element, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		value.Set(slice)
+	case reflect.Array:
+		elements, ok := doc.([]any)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		if len(elements) != value.Len() {
+			return fmt.Errorf("codec: %d elements can not fill %s", len(elements), value.Type())
+		}
+		for i, element := range elements {
+			if err := fromDocument(element, value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		entries, ok := doc.(map[string]any)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		m := reflect.MakeMapWithSize(value.Type(), len(entries))
+		for k, element := range entries {
+			key := reflect.New(value.Type().Key()).Elem()
+			if err := mapKeyFromString(k, key); err != nil {
+				return err
+			}
+			elementValue := reflect.New(value.Type().Elem()).Elem()
+			if err := fromDocument(element, elementValue); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elementValue)
+		}
+		value.Set(m)
+	case reflect.Pointer:
+		ptr := reflect.New(value.Type().Elem())
+		if err := fromDocument(doc, ptr.Elem()); err != nil {
+			return err
+		}
+		value.Set(ptr)
+	case reflect.Interface:
+		//any直接使用文档
+		if value.NumMethod() != 0 {
+			return fmt.Errorf("codec: unsupported type %s", value.Type())
+		}
+		value.Set(reflect.ValueOf(doc))
+	case reflect.Struct:
+		fields, ok := doc.(map[string]any)
+		if !ok {
+			return mismatch(doc, value)
+		}
+		for i := 0; i < value.NumField(); i++ {
+			field, ok := fields[value.Type().Field(i).Name]
+			if !ok {
+				continue
+			}
+			if err := fromDocument(field, value.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+func mapKeyFromString(s string, key reflect.Value) error {
+	switch key.Kind() {
+	case reflect.String:
+		key.SetString(s)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fromDocument(json.Number(s), key)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fromDocument(json.Number(s), key)
+	case reflect.Float32, reflect.Float64:
+		return fromDocument(json.Number(s), key)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		key.SetBool(b)
+		return nil
+	default:
+		return fmt.Errorf("codec: unsupported map key type %s", key.Type())
+	}
+}
+
+func docInt(doc any) (int64, error) {
+	switch n := doc.(type) {
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("codec: %d overflows int64", n)
+		}
+		return int64(n), nil
+	case float64:
+		if n != math.Trunc(n) {
+			return 0, fmt.Errorf("codec: %v is not an integer", n)
+		}
+		return int64(n), nil
+	case json.Number:
+		return strconv.ParseInt(string(n), 10, 64)
+	default:
+		return 0, fmt.Errorf("codec: %T is not a number", doc)
+	}
+}
+
+func docUint(doc any) (uint64, error) {
+	switch n := doc.(type) {
+	case uint64:
+		return n, nil
+	case int64:
+		if n < 0 {
+			return 0, fmt.Errorf("codec: %d overflows uint64", n)
+		}
+		return uint64(n), nil
+	case int:
+		if n < 0 {
+			return 0, fmt.Errorf("codec: %d overflows uint64", n)
+		}
+		return uint64(n), nil
+	case float64:
+		if n < 0 || n != math.Trunc(n) {
+			return 0, fmt.Errorf("codec: %v is not an unsigned integer", n)
+		}
+		return uint64(n), nil
+	case json.Number:
+		return strconv.ParseUint(string(n), 10, 64)
+	default:
+		return 0, fmt.Errorf("codec: %T is not a number", doc)
+	}
+}
+
+func docFloat(doc any) (float64, error) {
+	switch n := doc.(type) {
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	default:
+		return 0, fmt.Errorf("codec: %T is not a number", doc)
+	}
+}
+
+func mismatch(doc any, value reflect.Value) error {
+	return fmt.Errorf("codec: can not decode %T into %s", doc, value.Type())
+}
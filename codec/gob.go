@@ -0,0 +1,40 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+func init() {
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
+}
+
+//gob格式的编解码，和JSONCodec一样先转成文档，所以未导出的字段也会被保存
+type GobCodec[T any] struct {
+}
+
+func (codec *GobCodec[T]) Encode(entity T) ([]byte, error) {
+	doc, err := ToDocument(entity)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (codec *GobCodec[T]) Decode(data []byte) (entity T, err error) {
+	var doc any
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return entity, err
+	}
+	err = FromDocument(doc, &entity)
+	return entity, err
+}
+
+func NewGobCodec[T any]() *GobCodec[T] {
+	return &GobCodec[T]{}
+}
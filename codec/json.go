@@ -0,0 +1,39 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+//json格式的编解码，实体先转成文档，所以未导出的字段也会被保存，字段名就是go中的字段名
+type JSONCodec[T any] struct {
+}
+
+func (codec *JSONCodec[T]) Encode(entity T) ([]byte, error) {
+	doc, err := ToDocument(entity)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func (codec *JSONCodec[T]) Decode(data []byte) (entity T, err error) {
+	doc, err := decodeJSONDocument(data)
+	if err != nil {
+		return entity, err
+	}
+	err = FromDocument(doc, &entity)
+	return entity, err
+}
+
+//数字解码成json.Number，避免大整数丢失精度
+func decodeJSONDocument(data []byte) (doc any, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&doc)
+	return doc, err
+}
+
+func NewJSONCodec[T any]() *JSONCodec[T] {
+	return &JSONCodec[T]{}
+}
@@ -2,6 +2,10 @@ package copy
 
 import (
 	"reflect"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/util"
 )
 
 type EntityCopier struct {
@@ -9,295 +13,341 @@ type EntityCopier struct {
 }
 
 func (copier *EntityCopier) Copy(sourceEntityPtrAny, destEntityPtrAny any) {
-	sourceEntityValue := reflect.ValueOf(sourceEntityPtrAny).Elem()
-	destEntityValue := reflect.ValueOf(destEntityPtrAny).Elem()
-	destEntityValue.Set(sourceEntityValue)
-	copier.DeepCopyFields(sourceEntityValue, destEntityValue)
+	sourceEntityPtr := reflect.ValueOf(sourceEntityPtrAny)
+	destEntityPtr := reflect.ValueOf(destEntityPtrAny)
+	destEntityPtr.Elem().Set(sourceEntityPtr.Elem())
+	state := &copyState{make(map[copiedKey]reflect.Value)}
+	//实体内部指回实体自己的指针，指向复制出来的实体
+	state.copied[copiedKey{sourceEntityPtr.Pointer(), sourceEntityPtr.Type()}] = destEntityPtr
+	copier.deepCopyFields(sourceEntityPtr.Elem(), destEntityPtr.Elem(), state)
 }
 
 func (copier *EntityCopier) DeepCopyFields(sourceEntityValue, destEntityValue reflect.Value) {
+	copier.deepCopyFields(sourceEntityValue, destEntityValue, newCopyState())
+}
+
+func (copier *EntityCopier) deepCopyFields(sourceEntityValue, destEntityValue reflect.Value, state *copyState) {
 	for _, fieldDeepCopier := range copier.FieldDeepCopiers {
-		fieldDeepCopier.copyField(sourceEntityValue, destEntityValue)
+		fieldDeepCopier.copyField(sourceEntityValue, destEntityValue, state)
 	}
 }
 
-type FieldDeepCopier interface {
-	copyField(sourceEntityValue, destEntityValue reflect.Value)
+type copiedKey struct {
+	pointer uintptr
+	ptrType reflect.Type
 }
 
-type StructFieldDeepCopier struct {
-	FieldIndex        int
-	FieldEntityCopier *EntityCopier
+//一次复制的状态，记录已经复制过的指针，多处引用同一个值时复制出来的也是同一个，有环的对象图也不会无限递归
+type copyState struct {
+	copied map[copiedKey]reflect.Value
 }
 
-func (copier *StructFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	copier.FieldEntityCopier.DeepCopyFields(sourceEntityValue.Field(copier.FieldIndex), destEntityValue.Field(copier.FieldIndex))
+//copied在第一次复制指针时才创建
+func newCopyState() *copyState {
+	return &copyState{}
 }
 
-type StructPtrFieldDeepCopier struct {
-	FieldIndex        int
-	FieldEntityType   reflect.Type
-	FieldEntityCopier *EntityCopier
+//复制指针指向的值，nil复制为nil
+func (state *copyState) copyPtr(sourcePtr reflect.Value, elemCopier valueDeepCopier) reflect.Value {
+	if sourcePtr.IsNil() {
+		return reflect.Zero(sourcePtr.Type())
+	}
+	key := copiedKey{sourcePtr.Pointer(), sourcePtr.Type()}
+	if copied, ok := state.copied[key]; ok {
+		return copied
+	}
+	if state.copied == nil {
+		state.copied = make(map[copiedKey]reflect.Value)
+	}
+	newPtr := reflect.New(sourcePtr.Type().Elem())
+	state.copied[key] = newPtr
+	newPtr.Elem().Set(sourcePtr.Elem())
+	if elemCopier != nil {
+		elemCopier(sourcePtr.Elem(), newPtr.Elem(), state)
+	}
+	return newPtr
 }
 
-func (copier *StructPtrFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	newFieldEntityPtr := reflect.New(copier.FieldEntityType)
-	newFieldEntity := newFieldEntityPtr.Elem()
-	sourceFieldEntity := sourceEntityValue.Field(copier.FieldIndex).Elem()
-	destEntityValue.Field(copier.FieldIndex).Set(newFieldEntityPtr)
-	newFieldEntity.Set(sourceFieldEntity)
-	copier.FieldEntityCopier.DeepCopyFields(sourceFieldEntity, newFieldEntity)
+//取得字段，未导出的字段也可以读写
+func field(entityValue reflect.Value, fieldIndex int) reflect.Value {
+	return util.Accessible(entityValue.Field(fieldIndex))
 }
 
-type StructArrayFieldDeepCopier struct {
-	FieldIndex          int
-	ElementEntityCopier *EntityCopier
-}
+//把source深拷贝到dest，调用前dest已经是source的浅拷贝，所以source和dest可以是同一个值。
+//为nil表示这种类型浅拷贝就够了
+type valueDeepCopier func(source, dest reflect.Value, state *copyState)
 
-func (copier *StructArrayFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldArray := sourceEntityValue.Field(copier.FieldIndex)
-	destFieldArray := destEntityValue.Field(copier.FieldIndex)
-	len := sourceFieldArray.Len()
-	for i := 0; i < len; i++ {
-		copier.ElementEntityCopier.DeepCopyFields(sourceFieldArray.Index(i), destFieldArray.Index(i))
-	}
+type FieldDeepCopier interface {
+	copyField(sourceEntityValue, destEntityValue reflect.Value, state *copyState)
 }
 
-type StructPtrArrayFieldDeepCopier struct {
-	FieldIndex          int
-	ElementEntityType   reflect.Type
-	ElementEntityCopier *EntityCopier
+type ValueFieldDeepCopier struct {
+	FieldIndex int
+	FieldType  reflect.Type
+	copier     valueDeepCopier
 }
 
-func (copier *StructPtrArrayFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldArray := sourceEntityValue.Field(copier.FieldIndex)
-	destFieldArray := destEntityValue.Field(copier.FieldIndex)
-	len := sourceFieldArray.Len()
-	for i := 0; i < len; i++ {
-		newElementEntityPtr := reflect.New(copier.ElementEntityType)
-		destFieldArray.Index(i).Set(newElementEntityPtr)
-		copier.ElementEntityCopier.DeepCopyFields(sourceFieldArray.Index(i).Elem(), newElementEntityPtr.Elem())
-	}
+func (copier *ValueFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value, state *copyState) {
+	copier.copier(field(sourceEntityValue, copier.FieldIndex), field(destEntityValue, copier.FieldIndex), state)
 }
 
-type SimpleSliceFieldDeepCopier struct {
+//arp:"-"标签的字段不复制，复制出来的是零值
+type SkippedFieldDeepCopier struct {
 	FieldIndex int
-	SliceType  reflect.Type
+	FieldType  reflect.Type
 }
 
-func (copier *SimpleSliceFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldSlice := sourceEntityValue.Field(copier.FieldIndex)
-	len := sourceFieldSlice.Len()
-	newSlice := reflect.MakeSlice(copier.SliceType, len, sourceFieldSlice.Cap())
-	destEntityValue.Field(copier.FieldIndex).Set(newSlice)
-	for i := 0; i < len; i++ {
-		newSlice.Index(i).Set(sourceFieldSlice.Index(i))
-	}
+func (copier *SkippedFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value, state *copyState) {
+	field(destEntityValue, copier.FieldIndex).Set(reflect.Zero(copier.FieldType))
 }
 
-type StructSliceFieldDeepCopier struct {
-	FieldIndex          int
-	SliceType           reflect.Type
-	ElementEntityCopier *EntityCopier
+//字段的标签：arp:"-"的字段不复制，复制出来的是零值；arp:"shared"的字段是不可变的值，复制时共用同一个。
+//实现了DeepCopy方法的类型用它复制，见customCopier
+func GenerateEntityCopier(entityType reflect.Type, entityCopiers map[string]*EntityCopier) *EntityCopier {
+	return newCopierGenerator(entityCopiers).entityCopier(entityType)
 }
 
-func (copier *StructSliceFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldSlice := sourceEntityValue.Field(copier.FieldIndex)
-	len := sourceFieldSlice.Len()
-	newSlice := reflect.MakeSlice(copier.SliceType, len, sourceFieldSlice.Cap())
-	destEntityValue.Field(copier.FieldIndex).Set(newSlice)
-	for i := 0; i < len; i++ {
-		sourceEntityElement := sourceFieldSlice.Index(i)
-		newEntityElement := newSlice.Index(i)
-		newEntityElement.Set(sourceEntityElement)
-		copier.ElementEntityCopier.DeepCopyFields(sourceEntityElement, newEntityElement)
-	}
+type copierGenerator struct {
+	entityCopiers map[string]*EntityCopier
+	//正在生成的copier，它们的FieldDeepCopiers还不完整
+	inProgress map[*EntityCopier]bool
+	//正在生成的非struct类型，比如type Tree map[string]Tree，递归引用到自己时通过指针间接调用
+	pending map[reflect.Type]*valueDeepCopier
 }
 
-type StructPtrSliceFieldDeepCopier struct {
-	FieldIndex          int
-	SliceType           reflect.Type
-	ElementEntityCopier *EntityCopier
+func newCopierGenerator(entityCopiers map[string]*EntityCopier) *copierGenerator {
+	return &copierGenerator{entityCopiers, make(map[*EntityCopier]bool), make(map[reflect.Type]*valueDeepCopier)}
 }
 
-func (copier *StructPtrSliceFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldSlice := sourceEntityValue.Field(copier.FieldIndex)
-	len := sourceFieldSlice.Len()
-	newSlice := reflect.MakeSlice(copier.SliceType, len, sourceFieldSlice.Cap())
-	destEntityValue.Field(copier.FieldIndex).Set(newSlice)
-	elementEntityType := copier.SliceType.Elem().Elem()
-	for i := 0; i < len; i++ {
-		sourceEntityElement := sourceFieldSlice.Index(i).Elem()
-		newEntityPtrElement := reflect.New(elementEntityType)
-		newEntityElement := newEntityPtrElement.Elem()
-		newEntityElement.Set(sourceEntityElement)
-		copier.ElementEntityCopier.DeepCopyFields(sourceEntityElement, newEntityElement)
-		newSlice.Index(i).Set(newEntityPtrElement)
+func typeFullname(entityType reflect.Type) string {
+	if entityType.Name() == "" {
+		//匿名struct
+		return entityType.String()
 	}
+	return entityType.PkgPath() + "." + entityType.Name()
 }
 
-type SimpleMapFieldDeepCopier struct {
-	FieldIndex int
-	MapType    reflect.Type
+func (generator *copierGenerator) entityCopier(entityType reflect.Type) *EntityCopier {
+	typeFullname := typeFullname(entityType)
+	if generator.entityCopiers[typeFullname] != nil {
+		return generator.entityCopiers[typeFullname]
+	}
+	//先注册再生成字段的copier，递归的类型引用到自己时用的是同一个copier
+	entityCopier := &EntityCopier{}
+	generator.entityCopiers[typeFullname] = entityCopier
+	generator.inProgress[entityCopier] = true
+	numField := entityType.NumField()
+	fieldDeepCopiers := make([]FieldDeepCopier, 0, numField)
+	for i := 0; i < numField; i++ {
+		field := entityType.Field(i)
+		if util.HasArpTagOption(field, "-") {
+			fieldDeepCopiers = append(fieldDeepCopiers, &SkippedFieldDeepCopier{i, field.Type})
+			continue
+		}
+		if util.HasArpTagOption(field, "shared") {
+			continue
+		}
+		if copier := generator.valueCopier(field.Type); copier != nil {
+			fieldDeepCopiers = append(fieldDeepCopiers, &ValueFieldDeepCopier{i, field.Type, copier})
+		}
+	}
+	entityCopier.FieldDeepCopiers = fieldDeepCopiers
+	delete(generator.inProgress, entityCopier)
+	return entityCopier
 }
 
-func (copier *SimpleMapFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldMap := sourceEntityValue.Field(copier.FieldIndex)
-	if sourceFieldMap.IsNil() {
-		return
+func (generator *copierGenerator) valueCopier(valueType reflect.Type) valueDeepCopier {
+	if valueType == timeType {
+		//time.Time是不可变的值，Location本来就是共用的
+		return nil
+	}
+	if copier := customCopier(valueType); copier != nil {
+		return copier
 	}
-	newMap := reflect.MakeMap(copier.MapType)
-	destEntityValue.Field(copier.FieldIndex).Set(newMap)
-	keys := sourceFieldMap.MapKeys()
-	for _, k := range keys {
-		value := sourceFieldMap.MapIndex(k)
-		newMap.SetMapIndex(k, value)
+	switch valueType.Kind() {
+	case reflect.Struct:
+		entityCopier := generator.entityCopier(valueType)
+		//正在生成的copier按需要深拷贝处理
+		if len(entityCopier.FieldDeepCopiers) == 0 && !generator.inProgress[entityCopier] {
+			return nil
+		}
+		return func(source, dest reflect.Value, state *copyState) {
+			entityCopier.deepCopyFields(source, dest, state)
+		}
+	case reflect.Array:
+		elemCopier := generator.valueCopier(valueType.Elem())
+		if elemCopier == nil {
+			return nil
+		}
+		return func(source, dest reflect.Value, state *copyState) {
+			for i := 0; i < source.Len(); i++ {
+				elemCopier(source.Index(i), dest.Index(i), state)
+			}
+		}
+	case reflect.Pointer, reflect.Slice, reflect.Map:
+		if pending := generator.pending[valueType]; pending != nil {
+			return func(source, dest reflect.Value, state *copyState) {
+				(*pending)(source, dest, state)
+			}
+		}
+		pending := new(valueDeepCopier)
+		generator.pending[valueType] = pending
+		elemCopier := generator.valueCopier(valueType.Elem())
+		switch valueType.Kind() {
+		case reflect.Pointer:
+			*pending = pointerCopier(elemCopier)
+		case reflect.Slice:
+			*pending = sliceCopier(elemCopier)
+		default:
+			*pending = mapCopier(elemCopier)
+		}
+		delete(generator.pending, valueType)
+		return *pending
+	case reflect.Interface:
+		return interfaceCopier
+	default:
+		//基本类型浅拷贝就是深拷贝，func、chan和unsafe.Pointer无法复制，共用同一个
+		return nil
 	}
 }
 
-type StructMapFieldDeepCopier struct {
-	FieldIndex          int
-	MapType             reflect.Type
-	ElementEntityCopier *EntityCopier
-}
+var timeType = reflect.TypeOf(time.Time{})
 
-func (copier *StructMapFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldMap := sourceEntityValue.Field(copier.FieldIndex)
-	if sourceFieldMap.IsNil() {
-		return
+//类型自己的DeepCopy方法，可以是值接收者的DeepCopy() T或者指针接收者的DeepCopy() *T。
+//DeepCopy方法里不能再用反射的方式复制同一个类型，否则会无限递归
+func customCopier(valueType reflect.Type) valueDeepCopier {
+	if valueType.Kind() == reflect.Interface {
+		return nil
 	}
-	newMap := reflect.MakeMap(copier.MapType)
-	destEntityValue.Field(copier.FieldIndex).Set(newMap)
-	keys := sourceFieldMap.MapKeys()
-	elementType := copier.MapType.Elem()
-	for _, k := range keys {
-		value := sourceFieldMap.MapIndex(k)
-		newValue := reflect.New(elementType).Elem()
-		newValue.Set(value)
-		copier.ElementEntityCopier.DeepCopyFields(value, newValue)
-		newMap.SetMapIndex(k, newValue)
+	if method, ok := valueType.MethodByName("DeepCopy"); ok && isDeepCopyMethod(method.Type, valueType) {
+		if valueType.Kind() != reflect.Pointer {
+			return func(source, dest reflect.Value, state *copyState) {
+				dest.Set(source.Method(method.Index).Call(nil)[0])
+			}
+		}
+		//指针类型也要保持共用的引用
+		return func(source, dest reflect.Value, state *copyState) {
+			if source.IsNil() {
+				return
+			}
+			key := copiedKey{source.Pointer(), source.Type()}
+			if copied, ok := state.copied[key]; ok {
+				dest.Set(copied)
+				return
+			}
+			copied := source.Method(method.Index).Call(nil)[0]
+			if state.copied == nil {
+				state.copied = make(map[copiedKey]reflect.Value)
+			}
+			state.copied[key] = copied
+			dest.Set(copied)
+		}
+	}
+	if valueType.Kind() == reflect.Pointer {
+		return nil
 	}
+	ptrType := reflect.PointerTo(valueType)
+	if method, ok := ptrType.MethodByName("DeepCopy"); ok && isDeepCopyMethod(method.Type, ptrType) {
+		return func(source, dest reflect.Value, state *copyState) {
+			if copied := source.Addr().Method(method.Index).Call(nil)[0]; !copied.IsNil() {
+				dest.Set(copied.Elem())
+			}
+		}
+	}
+	return nil
 }
 
-type StructPtrMapFieldDeepCopier struct {
-	FieldIndex          int
-	MapType             reflect.Type
-	ElementEntityCopier *EntityCopier
+//方法类型的第一个参数是接收者
+func isDeepCopyMethod(methodType reflect.Type, t reflect.Type) bool {
+	return methodType.NumIn() == 1 && methodType.NumOut() == 1 && methodType.Out(0) == t
 }
 
-func (copier *StructPtrMapFieldDeepCopier) copyField(sourceEntityValue, destEntityValue reflect.Value) {
-	sourceFieldMap := sourceEntityValue.Field(copier.FieldIndex)
-	if sourceFieldMap.IsNil() {
-		return
-	}
-	newMap := reflect.MakeMap(copier.MapType)
-	destEntityValue.Field(copier.FieldIndex).Set(newMap)
-	keys := sourceFieldMap.MapKeys()
-	elementType := copier.MapType.Elem().Elem()
-	for _, k := range keys {
-		entity := sourceFieldMap.MapIndex(k).Elem()
-		newEntityPtr := reflect.New(elementType)
-		newEntity := newEntityPtr.Elem()
-		newEntity.Set(entity)
-		copier.ElementEntityCopier.DeepCopyFields(entity, newEntity)
-		newMap.SetMapIndex(k, newEntityPtr)
+func pointerCopier(elemCopier valueDeepCopier) valueDeepCopier {
+	return func(source, dest reflect.Value, state *copyState) {
+		dest.Set(state.copyPtr(source, elemCopier))
 	}
 }
 
-func GenerateEntityCopier(entityType reflect.Type, entityCopiers map[string]*EntityCopier) *EntityCopier {
-	typeFullname := entityType.PkgPath() + "." + entityType.Name()
-	if entityCopiers[typeFullname] != nil {
-		return entityCopiers[typeFullname]
-	}
-	numField := entityType.NumField()
-	fieldDeepCopiers := make([]FieldDeepCopier, 0, numField)
-	for i := 0; i < numField; i++ {
-		field := entityType.Field(i)
-		fieldDeepCopier := generateFieldDeepCopier(i, field.Type, entityCopiers)
-		if fieldDeepCopier != nil {
-			fieldDeepCopiers = append(fieldDeepCopiers, fieldDeepCopier)
+//nil复制为nil，保持len和cap
+func sliceCopier(elemCopier valueDeepCopier) valueDeepCopier {
+	return func(source, dest reflect.Value, state *copyState) {
+		if source.IsNil() {
+			return
 		}
+		newSlice := reflect.MakeSlice(source.Type(), source.Len(), source.Cap())
+		reflect.Copy(newSlice, source)
+		if elemCopier != nil {
+			for i := 0; i < source.Len(); i++ {
+				elemCopier(source.Index(i), newSlice.Index(i), state)
+			}
+		}
+		dest.Set(newSlice)
 	}
-	entityCopier := EntityCopier{fieldDeepCopiers}
-	entityCopierPtr := &entityCopier
-	entityCopiers[typeFullname] = entityCopierPtr
-	return entityCopierPtr
 }
 
-func generateFieldDeepCopier(fieldIndex int, fieldType reflect.Type, entityCopiers map[string]*EntityCopier) FieldDeepCopier {
-	fieldTypeKind := fieldType.Kind()
-	if fieldTypeKind == reflect.Map {
-		elementTypeKind := fieldType.Elem().Kind()
-		if elementTypeKind == reflect.Struct {
-			entityCopier := GenerateEntityCopier(fieldType.Elem(), entityCopiers)
-			if len(entityCopier.FieldDeepCopiers) == 0 {
-				return &SimpleMapFieldDeepCopier{fieldIndex, fieldType}
-			}
-			return &StructMapFieldDeepCopier{fieldIndex, fieldType, entityCopier}
-		} else if elementTypeKind == reflect.Pointer {
-			pointToType := fieldType.Elem().Elem()
-			if pointToType.Kind() == reflect.Struct {
-				entityCopier := GenerateEntityCopier(pointToType, entityCopiers)
-				return &StructPtrMapFieldDeepCopier{fieldIndex, fieldType, entityCopier}
-			} else {
-				return &SimpleMapFieldDeepCopier{fieldIndex, fieldType}
-			}
-		} else {
-			return &SimpleMapFieldDeepCopier{fieldIndex, fieldType}
-		}
-	} else if fieldTypeKind == reflect.Struct {
-		entityCopier := GenerateEntityCopier(fieldType, entityCopiers)
-		if len(entityCopier.FieldDeepCopiers) == 0 {
-			return nil
-		}
-		return &StructFieldDeepCopier{fieldIndex, entityCopier}
-	} else if fieldTypeKind == reflect.Array {
-		elementTypeKind := fieldType.Elem().Kind()
-		if elementTypeKind == reflect.Struct {
-			entityCopier := GenerateEntityCopier(fieldType.Elem(), entityCopiers)
-			if len(entityCopier.FieldDeepCopiers) == 0 {
-				return nil
-			}
-			return &StructArrayFieldDeepCopier{fieldIndex, entityCopier}
-		} else if elementTypeKind == reflect.Pointer {
-			pointToTypeKind := fieldType.Elem().Elem().Kind()
-			if pointToTypeKind == reflect.Struct {
-				entityCopier := GenerateEntityCopier(fieldType.Elem().Elem(), entityCopiers)
-				return &StructPtrArrayFieldDeepCopier{fieldIndex, fieldType.Elem(), entityCopier}
-			} else {
-				return nil
-			}
-		} else {
-			return nil
+//key是可比较的值，直接使用，指针类型的key仍然指向原来的值
+func mapCopier(elemCopier valueDeepCopier) valueDeepCopier {
+	return func(source, dest reflect.Value, state *copyState) {
+		if source.IsNil() {
+			return
 		}
-	} else if fieldTypeKind == reflect.Slice {
-		elementTypeKind := fieldType.Elem().Kind()
-		if elementTypeKind == reflect.Struct {
-			entityCopier := GenerateEntityCopier(fieldType.Elem(), entityCopiers)
-			if len(entityCopier.FieldDeepCopiers) == 0 {
-				return &SimpleSliceFieldDeepCopier{fieldIndex, fieldType}
-			}
-			return &StructSliceFieldDeepCopier{fieldIndex, fieldType, entityCopier}
-		} else if elementTypeKind == reflect.Pointer {
-			pointToType := fieldType.Elem().Elem()
-			if pointToType.Kind() == reflect.Struct {
-				entityCopier := GenerateEntityCopier(pointToType, entityCopiers)
-				return &StructPtrSliceFieldDeepCopier{fieldIndex, fieldType, entityCopier}
-			} else {
-				return &SimpleSliceFieldDeepCopier{fieldIndex, fieldType}
+		newMap := reflect.MakeMapWithSize(source.Type(), source.Len())
+		elemType := source.Type().Elem()
+		iter := source.MapRange()
+		for iter.Next() {
+			value := iter.Value()
+			if elemCopier != nil {
+				newValue := reflect.New(elemType).Elem()
+				newValue.Set(value)
+				//map的值不可寻址，用可寻址的浅拷贝作为source
+				elemCopier(newValue, newValue, state)
+				value = newValue
 			}
-		} else {
-			return &SimpleSliceFieldDeepCopier{fieldIndex, fieldType}
+			newMap.SetMapIndex(iter.Key(), value)
 		}
-	} else if fieldTypeKind == reflect.Pointer {
-		pointToTypeKind := fieldType.Elem().Kind()
-		if pointToTypeKind == reflect.Struct {
-			entityCopier := GenerateEntityCopier(fieldType.Elem(), entityCopiers)
-			return &StructPtrFieldDeepCopier{fieldIndex, fieldType.Elem(), entityCopier}
-		} else {
-			return nil
-		}
-	} else {
-		return nil
+		dest.Set(newMap)
+	}
+}
+
+//按动态类型复制
+func interfaceCopier(source, dest reflect.Value, state *copyState) {
+	if source.IsNil() {
+		return
+	}
+	value := source.Elem()
+	elemCopier := dynamicValueCopier(value.Type())
+	if elemCopier == nil {
+		return
+	}
+	newValue := reflect.New(value.Type()).Elem()
+	newValue.Set(value)
+	elemCopier(newValue, newValue, state)
+	dest.Set(newValue)
+}
+
+//接口的动态类型在复制时才知道，它们的copier单独生成和缓存，可以被并发地使用
+var dynamicCopiers = struct {
+	mutex         sync.Mutex
+	entityCopiers map[string]*EntityCopier
+	copiers       map[reflect.Type]valueDeepCopier
+}{entityCopiers: make(map[string]*EntityCopier), copiers: make(map[reflect.Type]valueDeepCopier)}
+
+func dynamicValueCopier(valueType reflect.Type) valueDeepCopier {
+	dynamicCopiers.mutex.Lock()
+	defer dynamicCopiers.mutex.Unlock()
+	if copier, ok := dynamicCopiers.copiers[valueType]; ok {
+		return copier
+	}
+	copier := newCopierGenerator(dynamicCopiers.entityCopiers).valueCopier(valueType)
+	dynamicCopiers.copiers[valueType] = copier
+	return copier
+}
+
+//深拷贝任意类型的值，给arpgen生成的代码复制它不了解的类型（比如接口和其他包的类型）用
+func DeepCopyValue[T any](value T) T {
+	v := reflect.ValueOf(&value).Elem()
+	if copier := dynamicValueCopier(v.Type()); copier != nil {
+		copier(v, v, newCopyState())
 	}
+	return value
 }
@@ -0,0 +1,188 @@
+package copy
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//和reflect.DeepEqual一样比较两个值，但是实现了Equal方法的类型（比如time.Time）用Equal比较，
+//arp:"-"标签的字段不比较。Equal方法的参数是类型自己，可以是值接收者的Equal(T) bool或者指针接收者的Equal(*T) bool
+func Equal(a, b any) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	v1, v2 := reflect.ValueOf(a), reflect.ValueOf(b)
+	if v1.Type() != v2.Type() {
+		return false
+	}
+	return deepEqual(addressable(v1), addressable(v2), make(map[visit]bool))
+}
+
+type visit struct {
+	a1, a2 uintptr
+	typ    reflect.Type
+}
+
+//返回可寻址的值，未导出的字段才可以通过util.Accessible读取
+func addressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	return c
+}
+
+func deepEqual(v1, v2 reflect.Value, visited map[visit]bool) bool {
+	if method, pointerReceiver := equalMethod(v1.Type()); method != nil {
+		if pointerReceiver {
+			return v1.Addr().Method(method.Index).Call([]reflect.Value{v2.Addr()})[0].Bool()
+		}
+		if v1.Kind() == reflect.Pointer && (v1.IsNil() || v2.IsNil()) {
+			return v1.IsNil() && v2.IsNil()
+		}
+		return v1.Method(method.Index).Call([]reflect.Value{v2})[0].Bool()
+	}
+	switch v1.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if v1.IsNil() != v2.IsNil() {
+			return false
+		}
+		if v1.Kind() != reflect.Pointer && v1.Len() != v2.Len() {
+			return false
+		}
+		if v1.UnsafePointer() == v2.UnsafePointer() {
+			return true
+		}
+		//有环的时候，已经在比较的一对值按相等处理
+		key := visit{uintptr(v1.UnsafePointer()), uintptr(v2.UnsafePointer()), v1.Type()}
+		if visited[key] {
+			return true
+		}
+		visited[key] = true
+	}
+	switch v1.Kind() {
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v1.Len(); i++ {
+			if !deepEqual(v1.Index(i), v2.Index(i), visited) {
+				return false
+			}
+		}
+		return true
+	case reflect.Pointer:
+		return deepEqual(v1.Elem(), v2.Elem(), visited)
+	case reflect.Interface:
+		if v1.IsNil() || v2.IsNil() {
+			return v1.IsNil() == v2.IsNil()
+		}
+		if v1.Elem().Type() != v2.Elem().Type() {
+			return false
+		}
+		return deepEqual(addressable(v1.Elem()), addressable(v2.Elem()), visited)
+	case reflect.Struct:
+		for i, skipped := range skippedFields(v1.Type()) {
+			if skipped {
+				continue
+			}
+			if !deepEqual(util.Accessible(v1.Field(i)), util.Accessible(v2.Field(i)), visited) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		iter := v1.MapRange()
+		for iter.Next() {
+			value2 := v2.MapIndex(iter.Key())
+			if !value2.IsValid() || !deepEqual(addressable(iter.Value()), addressable(value2), visited) {
+				return false
+			}
+		}
+		return true
+	case reflect.Func:
+		return v1.IsNil() && v2.IsNil()
+	case reflect.Bool:
+		return v1.Bool() == v2.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v1.Int() == v2.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v1.Uint() == v2.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v1.Float() == v2.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return v1.Complex() == v2.Complex()
+	case reflect.String:
+		return v1.String() == v2.String()
+	case reflect.Chan, reflect.UnsafePointer:
+		return v1.Pointer() == v2.Pointer()
+	}
+	return false
+}
+
+//类型的Equal方法，pointerReceiver表示是*T的Equal(*T) bool
+func equalMethod(t reflect.Type) (method *reflect.Method, pointerReceiver bool) {
+	if t.Kind() == reflect.Interface {
+		return nil, false
+	}
+	if m, ok := t.MethodByName("Equal"); ok && isEqualMethod(m.Type, t) {
+		return &m, false
+	}
+	if t.Kind() != reflect.Pointer {
+		ptrType := reflect.PointerTo(t)
+		if m, ok := ptrType.MethodByName("Equal"); ok && isEqualMethod(m.Type, ptrType) {
+			return &m, true
+		}
+	}
+	return nil, false
+}
+
+//方法类型的第一个参数是接收者
+func isEqualMethod(methodType reflect.Type, t reflect.Type) bool {
+	return methodType.NumIn() == 2 && methodType.In(1) == t && methodType.NumOut() == 1 && methodType.Out(0).Kind() == reflect.Bool
+}
+
+var skippedFieldsCache sync.Map
+
+//struct的每个字段是否有arp:"-"标签
+func skippedFields(t reflect.Type) []bool {
+	if skipped, ok := skippedFieldsCache.Load(t); ok {
+		return skipped.([]bool)
+	}
+	skipped := make([]bool, t.NumField())
+	for i := range skipped {
+		skipped[i] = util.HasArpTagOption(t.Field(i), "-")
+	}
+	skippedFieldsCache.Store(t, skipped)
+	return skipped
+}
+
+//类型的值用Equal比较和用reflect.DeepEqual比较的结果是否可能不同。
+//不包括类型自己的Equal方法，包含接口的类型因为无法事先知道实际的类型，也返回true
+func HasCustomEqual(t reflect.Type) bool {
+	return hasCustomEqual(t, true, make(map[reflect.Type]bool))
+}
+
+func hasCustomEqual(t reflect.Type, root bool, visiting map[reflect.Type]bool) bool {
+	if method, _ := equalMethod(t); method != nil && !root {
+		return true
+	}
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return hasCustomEqual(t.Elem(), false, visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if util.HasArpTagOption(field, "-") || hasCustomEqual(field.Type, false, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package faultinject
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//注入的默认错误
+var ErrInjected = errors.New("injected fault")
+
+//注入的加锁超时
+var ErrLockTimeout = errors.New("injected lock timeout")
+
+//匹配所有加锁的方法：Lock、NewAndLock、TryLock、LockAll、LockLease、NewAndLockLease和TryLockLease
+const AnyLock = "AnyLock"
+
+//一条注入规则，匹配的调用按规则注入延迟、错误或者panic
+type Rule struct {
+	//实体类型，可以是类型全名或者类型名，为空时匹配所有类型
+	EntityType string
+	//方法名，比如SaveAll、RemoveAll、Lock或者AnyLock，为空时匹配所有方法
+	Method string
+	//调用涉及的id中有一个按util.Strval相等就匹配，为nil时匹配所有调用
+	Id any
+	//第Nth次匹配的调用触发，从1开始。为0时每次匹配都按Probability触发
+	Nth int
+	//触发的概率，为0时表示总是触发。随机数来自Injector的seed，相同的调用顺序得到相同的结果
+	Probability float64
+	//触发时先等待Latency，ctx结束时提前返回ctx的错误
+	Latency time.Duration
+	//触发时panic的值，不为nil时不再返回Err
+	Panic any
+	//触发时返回的错误，为nil时只注入延迟
+	Err error
+	//RemoveAll触发时先删除前Partial个id，再返回Err，模拟部分失败
+	Partial int
+}
+
+type rule struct {
+	Rule
+	matched int
+	//按实际调用的方法计数，Method为空或者AnyLock的规则会在多个方法上触发
+	triggered map[string]int
+}
+
+func (r *rule) match(entityType string, method string, ids []any) bool {
+	if r.EntityType != "" && r.EntityType != entityType && !strings.HasSuffix(entityType, "."+r.EntityType) {
+		return false
+	}
+	if r.Method == AnyLock {
+		if method == "UnlockAll" || !strings.Contains(method, "Lock") {
+			return false
+		}
+	} else if r.Method != "" && r.Method != method {
+		return false
+	}
+	if r.Id == nil {
+		return true
+	}
+	ruleId := util.Strval(r.Id)
+	for _, id := range ids {
+		if util.Strval(id) == ruleId {
+			return true
+		}
+	}
+	return false
+}
+
+//按规则决定每一次调用是否注入故障，可以被多个store和mutexes共用
+type Injector struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+	rules []*rule
+}
+
+func (injector *Injector) Add(rules ...Rule) *Injector {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	for _, r := range rules {
+		injector.rules = append(injector.rules, &rule{Rule: r, triggered: make(map[string]int)})
+	}
+	return injector
+}
+
+//清除所有规则
+func (injector *Injector) Reset() {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	injector.rules = nil
+}
+
+//某个方法上已经触发的次数，method是实际调用的方法名，比如SaveAll或者Lock
+func (injector *Injector) Triggered(method string) int {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	triggered := 0
+	for _, r := range injector.rules {
+		triggered += r.triggered[method]
+	}
+	return triggered
+}
+
+//第一条触发的规则，所有匹配的规则都会计数
+func (injector *Injector) decide(entityType string, method string, ids []any) *Rule {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	var fired *Rule
+	for _, r := range injector.rules {
+		if !r.match(entityType, method, ids) {
+			continue
+		}
+		r.matched++
+		trigger := false
+		if r.Nth > 0 {
+			trigger = r.matched == r.Nth
+		} else {
+			trigger = r.Probability == 0 || injector.rand.Float64() < r.Probability
+		}
+		if trigger && fired == nil {
+			r.triggered[method]++
+			fired = &r.Rule
+		}
+	}
+	return fired
+}
+
+//执行触发的规则，返回的partial表示RemoveAll需要先删除的id数
+func (injector *Injector) inject(ctx context.Context, entityType string, method string, ids []any) (fired bool, partial int, err error) {
+	r := injector.decide(entityType, method, ids)
+	if r == nil {
+		return false, 0, nil
+	}
+	if r.Latency > 0 {
+		timer := time.NewTimer(r.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return true, 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if r.Panic != nil {
+		panic(r.Panic)
+	}
+	return r.Err != nil, r.Partial, r.Err
+}
+
+func (injector *Injector) interceptor(entityType string) arp.Interceptor {
+	return func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		fired, _, err := injector.inject(ctx, entityType, method, ids)
+		//UnlockAll的错误无法返回，注入延迟之后仍然释放锁
+		if fired && method != "UnlockAll" {
+			return err
+		}
+		return call(ctx)
+	}
+}
+
+func NewInjector(seed int64) *Injector {
+	return &Injector{rand: rand.New(rand.NewSource(seed))}
+}
+
+func typeFullname[T any]() string {
+	entityType := reflect.TypeOf((*T)(nil)).Elem()
+	if entityType.Kind() == reflect.Pointer {
+		entityType = entityType.Elem()
+	}
+	return entityType.PkgPath() + "." + entityType.Name()
+}
+
+//按injector的规则注入故障的store，如果store实现了QueryStore，返回的Store也实现QueryStore
+func Store[T any](store arp.Store[T], injector *Injector) arp.Store[T] {
+	entityType := typeFullname[T]()
+	//RemoveAll需要部分执行，其余的方法都可以用拦截的方式注入
+	partialStore := &partialRemoveStore[T]{store, injector, entityType}
+	intercepted := arp.InterceptStore[T](partialStore, func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		if method == "RemoveAll" {
+			return call(ctx)
+		}
+		return injector.interceptor(entityType)(ctx, method, ids, call)
+	})
+	if queryStore, ok := store.(arp.QueryStore[T]); ok {
+		return &faultyQueryStore[T]{intercepted, arp.InterceptStore[T](queryStore, injector.interceptor(entityType)).(arp.QueryStore[T])}
+	}
+	return intercepted
+}
+
+type partialRemoveStore[T any] struct {
+	arp.Store[T]
+	injector   *Injector
+	entityType string
+}
+
+func (store *partialRemoveStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	fired, partial, err := store.injector.inject(ctx, store.entityType, "RemoveAll", ids)
+	if !fired {
+		return store.Store.RemoveAll(ctx, ids)
+	}
+	if partial > len(ids) {
+		partial = len(ids)
+	}
+	if partial > 0 {
+		if removeErr := store.Store.RemoveAll(ctx, ids[:partial]); removeErr != nil {
+			return removeErr
+		}
+	}
+	return err
+}
+
+//读写走注入了部分删除的store，查询走拦截的QueryStore
+type faultyQueryStore[T any] struct {
+	arp.Store[T]
+	queryStore arp.QueryStore[T]
+}
+
+func (store *faultyQueryStore[T]) QueryAllIds(ctx context.Context) ([]any, error) {
+	return store.queryStore.QueryAllIds(ctx)
+}
+
+func (store *faultyQueryStore[T]) Count(ctx context.Context) (uint64, error) {
+	return store.queryStore.Count(ctx)
+}
+
+func (store *faultyQueryStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	return store.queryStore.QueryAllByField(ctx, fieldName, fieldValue)
+}
+
+func (store *faultyQueryStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error) {
+	return store.queryStore.QueryIdsByField(ctx, fieldName, fieldValue)
+}
+
+//按injector的规则注入故障的mutexes，T是使用这个mutexes的仓库的实体类型。
+//返回的Mutexes实现mutexes所实现的TryMutexes、LeasedMutexes、TryLeasedMutexes和OrderedMutexes，UnlockAll注入的错误会被忽略
+func Mutexes[T any](mutexes arp.Mutexes, injector *Injector) arp.Mutexes {
+	return arp.InterceptMutexes(mutexes, injector.interceptor(typeFullname[T]()))
+}
@@ -1,3 +1,3 @@
 module github.com/framework-arp/ARP4G
 
-go 1.18
+go 1.21
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//用slog记录每一次调用的方法、id、耗时和错误，成功的调用记为Debug，失败的记为Error
+func Logging(logger *slog.Logger) arp.Interceptor {
+	return func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		duration := time.Since(start)
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "arp call failed",
+				slog.String("method", method), slog.Any("ids", ids), slog.Duration("duration", duration), slog.Any("error", err))
+		} else {
+			logger.LogAttrs(ctx, slog.LevelDebug, "arp call",
+				slog.String("method", method), slog.Any("ids", ids), slog.Duration("duration", duration))
+		}
+		return err
+	}
+}
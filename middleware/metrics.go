@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//某个方法的调用统计
+type CallStats struct {
+	Count        uint64
+	Errors       uint64
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+//平均耗时
+func (stats CallStats) AvgLatency() time.Duration {
+	if stats.Count == 0 {
+		return 0
+	}
+	return stats.TotalLatency / time.Duration(stats.Count)
+}
+
+//按方法名统计调用次数、错误次数和耗时
+type CallMetrics struct {
+	mutex sync.Mutex
+	stats map[string]*CallStats
+}
+
+func (metrics *CallMetrics) observe(method string, latency time.Duration, err error) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	stats := metrics.stats[method]
+	if stats == nil {
+		stats = &CallStats{}
+		metrics.stats[method] = stats
+	}
+	stats.Count++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+}
+
+func (metrics *CallMetrics) Stats(method string) CallStats {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if stats := metrics.stats[method]; stats != nil {
+		return *stats
+	}
+	return CallStats{}
+}
+
+func (metrics *CallMetrics) Snapshot() map[string]CallStats {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	snapshot := make(map[string]CallStats, len(metrics.stats))
+	for method, stats := range metrics.stats {
+		snapshot[method] = *stats
+	}
+	return snapshot
+}
+
+func NewCallMetrics() *CallMetrics {
+	return &CallMetrics{stats: make(map[string]*CallStats)}
+}
+
+//把调用统计到metrics中，一个CallMetrics可以给多个store或mutexes共用，也可以每个一个
+func Measure(metrics *CallMetrics) arp.Interceptor {
+	return func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		metrics.observe(method, time.Since(start), err)
+		return err
+	}
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//把Interceptor用作Store的中间件
+func ForStore[T any](interceptor arp.Interceptor) arp.StoreMiddleware[T] {
+	return func(next arp.Store[T]) arp.Store[T] {
+		return arp.InterceptStore(next, interceptor)
+	}
+}
+
+//把Interceptor用作Mutexes的中间件
+func ForMutexes(interceptor arp.Interceptor) arp.MutexesMiddleware {
+	return func(next arp.Mutexes) arp.Mutexes {
+		return arp.InterceptMutexes(next, interceptor)
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//store或者mutexes的实现可以用它包装暂时性的错误，这样的错误会被Retry重试
+var ErrTransient = errors.New("transient error")
+
+//默认的暂时性错误：包装了ErrTransient的错误，以及超时或者Temporary()为true的网络错误
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrTransient) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+type retryOptions struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	isTransient    func(err error) bool
+}
+
+type RetryOption func(options *retryOptions)
+
+//最多调用的次数，包括第一次，默认3
+func WithMaxAttempts(maxAttempts int) RetryOption {
+	return func(options *retryOptions) {
+		options.maxAttempts = maxAttempts
+	}
+}
+
+//第一次重试前等待initial，之后每次翻倍，最多等待max，默认10ms和1s
+func WithBackoff(initial, max time.Duration) RetryOption {
+	return func(options *retryOptions) {
+		options.initialBackoff = initial
+		options.maxBackoff = max
+	}
+}
+
+//判断错误是否需要重试，默认IsTransient
+func WithTransient(isTransient func(err error) bool) RetryOption {
+	return func(options *retryOptions) {
+		options.isTransient = isTransient
+	}
+}
+
+//遇到暂时性错误时退避重试，ctx结束时不再重试。
+//注意重试的是整个调用，SaveAll、RemoveAll要能安全地重试，比如失败时什么都没有写入
+func Retry(opts ...RetryOption) arp.Interceptor {
+	options := retryOptions{maxAttempts: 3, initialBackoff: 10 * time.Millisecond, maxBackoff: time.Second, isTransient: IsTransient}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		backoff := options.initialBackoff
+		for attempt := 1; ; attempt++ {
+			err := call(ctx)
+			if err == nil || attempt >= options.maxAttempts || !options.isTransient(err) {
+				return err
+			}
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+			backoff *= 2
+			if backoff > options.maxBackoff {
+				backoff = options.maxBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//每一次调用最多执行timeout，超时时ctx被取消，只对会检查ctx的实现有效。
+//UnlockAll不加超时，避免锁因为超时而没有被释放。和Retry一起使用时把Timeout放在Retry里面，每次重试单独计时
+func Timeout(timeout time.Duration) arp.Interceptor {
+	return func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		if method == "UnlockAll" {
+			return call(ctx)
+		}
+		timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return call(timeoutCtx)
+	}
+}
@@ -0,0 +1,261 @@
+package repoext
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/framework-arp/ARP4G/repoimpl"
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//缓存满时淘汰哪个条目
+type EvictionPolicy int
+
+const (
+	//淘汰最久没有被访问的
+	EvictLRU EvictionPolicy = iota
+	//淘汰访问次数最少的，次数相同时淘汰最久没有被访问的。
+	//按LFU-DA老化：比较的是访问次数加上最近一次访问时缓存的年龄，年龄是最近被淘汰的条目的值，
+	//新条目从当前年龄开始计数，以前访问很多但是已经不再访问的条目最终也会被淘汰
+	EvictLFU
+)
+
+//缓存的统计数据
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Size        int
+}
+
+type cacheOptions struct {
+	maxEntries  int
+	policy      EvictionPolicy
+	ttl         time.Duration
+	negativeTTL time.Duration
+	clock       repoimpl.Clock
+	bus         InvalidationBus
+}
+
+type CacheOption func(options *cacheOptions)
+
+//最多缓存的条目数，包括不存在的id，默认10000，0表示不限制
+func WithMaxEntries(maxEntries int) CacheOption {
+	return func(options *cacheOptions) {
+		options.maxEntries = maxEntries
+	}
+}
+
+func WithEvictionPolicy(policy EvictionPolicy) CacheOption {
+	return func(options *cacheOptions) {
+		options.policy = policy
+	}
+}
+
+//实体在缓存中的存活时间，默认0表示不过期
+func WithTTL(ttl time.Duration) CacheOption {
+	return func(options *cacheOptions) {
+		options.ttl = ttl
+	}
+}
+
+//不存在的id在缓存中的存活时间，默认30秒，0表示不过期
+func WithNegativeTTL(ttl time.Duration) CacheOption {
+	return func(options *cacheOptions) {
+		options.negativeTTL = ttl
+	}
+}
+
+//计算过期用的时钟，默认是系统时钟
+func WithCacheClock(clock repoimpl.Clock) CacheOption {
+	return func(options *cacheOptions) {
+		options.clock = clock
+	}
+}
+
+//通过bus和其他实例上的缓存互相通知失效
+func WithInvalidationBus(bus InvalidationBus) CacheOption {
+	return func(options *cacheOptions) {
+		options.bus = bus
+	}
+}
+
+type cacheEntry struct {
+	id        any
+	value     any
+	expiresAt time.Time
+	//使用次数，放入缓存算一次
+	hits uint64
+	//LFU淘汰时比较的值，访问时更新为hits加上缓存的年龄
+	priority uint64
+	//最近一次访问的序号
+	accessed uint64
+	index    int
+}
+
+//有容量限制的缓存，条目按淘汰的优先级放在堆里，堆顶是下一个被淘汰的。不是并发安全的，由使用者加锁
+type entityCache struct {
+	options cacheOptions
+	entries map[any]*cacheEntry
+	//key是id按util.Strval转换的字符串，用于处理来自其他实例的失效通知。
+	//1和"1"这样的id转换后相同，失效通知会让它们都失效
+	entriesByKey map[string]map[any]*cacheEntry
+	queue        cacheQueue
+	seq          uint64
+	//LFU的年龄，最近被淘汰的条目的priority
+	age   uint64
+	stats CacheStats
+}
+
+func (cache *entityCache) get(id any) (value any, ok bool) {
+	entry := cache.entries[id]
+	if entry == nil {
+		cache.stats.Misses++
+		return nil, false
+	}
+	if !entry.expiresAt.IsZero() && !cache.options.clock.Now().Before(entry.expiresAt) {
+		cache.remove(entry)
+		cache.stats.Expirations++
+		cache.stats.Misses++
+		return nil, false
+	}
+	cache.stats.Hits++
+	entry.hits++
+	entry.priority = cache.age + entry.hits
+	cache.touch(entry)
+	return entry.value, true
+}
+
+//查看缓存的值，不计入统计，也不算一次访问
+func (cache *entityCache) peek(id any) (value any, ok bool) {
+	entry := cache.entries[id]
+	if entry == nil {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (cache *entityCache) set(id any, value any, negative bool) {
+	ttl := cache.options.ttl
+	if negative {
+		ttl = cache.options.negativeTTL
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = cache.options.clock.Now().Add(ttl)
+	}
+	if entry := cache.entries[id]; entry != nil {
+		entry.value = value
+		entry.expiresAt = expiresAt
+		cache.touch(entry)
+		return
+	}
+	//先淘汰再放入，新条目按淘汰之后的年龄计数
+	for cache.options.maxEntries > 0 && len(cache.entries) >= cache.options.maxEntries {
+		victim := cache.queue.entries[0]
+		cache.age = victim.priority
+		cache.remove(victim)
+		cache.stats.Evictions++
+	}
+	cache.seq++
+	entry := &cacheEntry{id: id, value: value, expiresAt: expiresAt, hits: 1, priority: cache.age + 1, accessed: cache.seq}
+	cache.entries[id] = entry
+	key := util.Strval(id)
+	if cache.entriesByKey[key] == nil {
+		cache.entriesByKey[key] = make(map[any]*cacheEntry)
+	}
+	cache.entriesByKey[key][id] = entry
+	heap.Push(&cache.queue, entry)
+}
+
+func (cache *entityCache) delete(id any) {
+	if entry := cache.entries[id]; entry != nil {
+		cache.remove(entry)
+	}
+}
+
+//删除id按util.Strval转换后是key的所有条目
+func (cache *entityCache) deleteByKey(key string) {
+	for _, entry := range cache.entriesByKey[key] {
+		cache.remove(entry)
+	}
+}
+
+func (cache *entityCache) touch(entry *cacheEntry) {
+	cache.seq++
+	entry.accessed = cache.seq
+	heap.Fix(&cache.queue, entry.index)
+}
+
+func (cache *entityCache) remove(entry *cacheEntry) {
+	heap.Remove(&cache.queue, entry.index)
+	delete(cache.entries, entry.id)
+	key := util.Strval(entry.id)
+	delete(cache.entriesByKey[key], entry.id)
+	if len(cache.entriesByKey[key]) == 0 {
+		delete(cache.entriesByKey, key)
+	}
+}
+
+func (cache *entityCache) getStats() CacheStats {
+	stats := cache.stats
+	stats.Size = len(cache.entries)
+	return stats
+}
+
+func newEntityCache(opts []CacheOption) *entityCache {
+	options := cacheOptions{maxEntries: 10000, policy: EvictLRU, negativeTTL: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.clock == nil {
+		options.clock = systemClock{}
+	}
+	return &entityCache{options: options, entries: make(map[any]*cacheEntry), entriesByKey: make(map[string]map[any]*cacheEntry), queue: cacheQueue{policy: options.policy}}
+}
+
+type systemClock struct {
+}
+
+func (clock systemClock) Now() time.Time {
+	return time.Now()
+}
+
+//实现heap.Interface
+type cacheQueue struct {
+	policy  EvictionPolicy
+	entries []*cacheEntry
+}
+
+func (queue *cacheQueue) Len() int {
+	return len(queue.entries)
+}
+
+func (queue *cacheQueue) Less(i, j int) bool {
+	a, b := queue.entries[i], queue.entries[j]
+	if queue.policy == EvictLFU && a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	return a.accessed < b.accessed
+}
+
+func (queue *cacheQueue) Swap(i, j int) {
+	queue.entries[i], queue.entries[j] = queue.entries[j], queue.entries[i]
+	queue.entries[i].index = i
+	queue.entries[j].index = j
+}
+
+func (queue *cacheQueue) Push(x any) {
+	entry := x.(*cacheEntry)
+	entry.index = len(queue.entries)
+	queue.entries = append(queue.entries, entry)
+}
+
+func (queue *cacheQueue) Pop() any {
+	n := len(queue.entries)
+	entry := queue.entries[n-1]
+	queue.entries[n-1] = nil
+	queue.entries = queue.entries[:n-1]
+	return entry
+}
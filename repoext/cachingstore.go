@@ -0,0 +1,549 @@
+package repoext
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//CachingStore关闭之后不能再写入
+var ErrStoreClosed = errors.New("caching store is closed")
+
+//CachingStore的写入方式
+type WriteMode int
+
+const (
+	//先写入被缓存的store，成功之后再更新缓存
+	WriteThrough WriteMode = iota
+	//先更新缓存，由后台批量写入被缓存的store
+	WriteBehind
+)
+
+type cachingStoreOptions struct {
+	writeMode     WriteMode
+	queueSize     int
+	batchSize     int
+	flushInterval time.Duration
+	durability    func(ids []any, err error)
+	cacheOpts     []CacheOption
+}
+
+type CachingStoreOption func(options *cachingStoreOptions)
+
+func WithWriteMode(mode WriteMode) CachingStoreOption {
+	return func(options *cachingStoreOptions) {
+		options.writeMode = mode
+	}
+}
+
+//WriteBehind时最多等待写入的id数，默认1000，满了之后写入会等待后台写入腾出空间。
+//一个过程的修改不会拆开，超过queueSize的一批修改在队列为空时放入
+func WithWriteQueueSize(queueSize int) CachingStoreOption {
+	return func(options *cachingStoreOptions) {
+		options.queueSize = queueSize
+	}
+}
+
+//WriteBehind时等待写入的id达到batchSize就立即写入，默认100
+func WithWriteBatchSize(batchSize int) CachingStoreOption {
+	return func(options *cachingStoreOptions) {
+		options.batchSize = batchSize
+	}
+}
+
+//WriteBehind时后台写入的间隔，默认100毫秒
+func WithFlushInterval(interval time.Duration) CachingStoreOption {
+	return func(options *cachingStoreOptions) {
+		options.flushInterval = interval
+	}
+}
+
+//WriteBehind时每批写入完成之后调用，err为nil表示ids已经持久化。
+//一批里面是不相关的过程的修改，整批写入失败时逐个id重新写入，成功的和失败的id分别通知，失败的每个id通知一次。
+//仍然失败的修改不会再重试，缓存中对应的条目会被清除，之后对这个id的修改按被缓存的store中的状态写入。
+//需要重试的话给被缓存的store加上middleware.Retry
+func WithDurabilityCallback(callback func(ids []any, err error)) CachingStoreOption {
+	return func(options *cachingStoreOptions) {
+		options.durability = callback
+	}
+}
+
+//缓存的大小、淘汰策略和过期时间
+func WithStoreCacheOptions(opts ...CacheOption) CachingStoreOption {
+	return func(options *cachingStoreOptions) {
+		options.cacheOpts = append(options.cacheOpts, opts...)
+	}
+}
+
+//等待写入的修改，同一个id的多次修改合并成一个
+type pendingWrite struct {
+	//新增的实体，或者修改后的实体，删除时为nil
+	inserted any
+	updated  *arp.ProcessEntity
+	removed  bool
+}
+
+//给较慢的store加上缓存，Load先读缓存，没有的话从store读取并放入缓存（包括不存在的id）。
+//写入方式见WriteMode，WriteBehind时过程提交成功只代表修改进入了缓存，持久化的结果通过WithDurabilityCallback通知，
+//后台写入不带过程的ctx，所以也不带fencing token。
+//缓存只对经过CachingStore的修改有效，有其他地方直接修改被缓存的store时需要配合WithTTL使用
+type CachingStore[T any] struct {
+	store        arp.Store[T]
+	typeFullname string
+	options      cachingStoreOptions
+	mutex        sync.Mutex
+	//值是实体的副本，或者表示不存在的*NullEntity
+	cache      *entityCache
+	generation uint64
+	//等待写入的修改，和正在写入的修改，读取时优先于缓存
+	pending  map[any]*pendingWrite
+	flushing map[any]*pendingWrite
+	//每次后台写入结束时关闭并替换，用于等待队列腾出空间
+	flushed chan struct{}
+	//后台写入一次只有一个
+	flushMutex sync.Mutex
+	trigger    chan struct{}
+	closed     bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func (store *CachingStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	store.mutex.Lock()
+	value, ok := store.lookup(id)
+	generation := store.generation
+	store.mutex.Unlock()
+	if ok {
+		if value == nil {
+			return entity, false, nil
+		}
+		return arp.CopyEntity(store.typeFullname, value).(T), true, nil
+	}
+	entity, found, err = store.store.Load(ctx, id)
+	if err != nil {
+		return entity, false, err
+	}
+	store.mutex.Lock()
+	if store.generation == generation {
+		if found {
+			store.cache.set(id, arp.CopyEntity(store.typeFullname, entity), false)
+		} else {
+			store.cache.set(id, &NullEntity{}, true)
+		}
+	}
+	store.mutex.Unlock()
+	return entity, found, nil
+}
+
+//按等待写入、正在写入、缓存的顺序查找，value为nil表示不存在
+func (store *CachingStore[T]) lookup(id any) (value any, ok bool) {
+	for _, writes := range []map[any]*pendingWrite{store.pending, store.flushing} {
+		if write := writes[id]; write != nil {
+			return write.entity(), true
+		}
+	}
+	value, ok = store.cache.get(id)
+	if _, null := value.(*NullEntity); null {
+		return nil, ok
+	}
+	return value, ok
+}
+
+func (write *pendingWrite) entity() any {
+	if write.inserted != nil {
+		return write.inserted
+	}
+	if write.updated != nil {
+		return write.updated.Entity()
+	}
+	return nil
+}
+
+func (store *CachingStore[T]) Save(ctx context.Context, id any, entity T) error {
+	if store.options.writeMode == WriteThrough {
+		if err := store.store.Save(ctx, id, entity); err != nil {
+			store.invalidate([]any{id})
+			return err
+		}
+		store.mutex.Lock()
+		store.generation++
+		store.cache.set(id, arp.CopyEntity(store.typeFullname, entity), false)
+		store.mutex.Unlock()
+		return nil
+	}
+	return store.enqueue(ctx, map[any]any{id: entity}, nil, nil)
+}
+
+func (store *CachingStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	if store.options.writeMode == WriteThrough {
+		if err := store.store.SaveAll(ctx, entitiesToInsert, entitiesToUpdate); err != nil {
+			ids := make([]any, 0, len(entitiesToInsert)+len(entitiesToUpdate))
+			for id := range entitiesToInsert {
+				ids = append(ids, id)
+			}
+			for id := range entitiesToUpdate {
+				ids = append(ids, id)
+			}
+			//可能有一部分已经保存了
+			store.invalidate(ids)
+			return err
+		}
+		store.mutex.Lock()
+		store.generation++
+		for id, entity := range entitiesToInsert {
+			store.cache.set(id, arp.CopyEntity(store.typeFullname, entity), false)
+		}
+		for id, pe := range entitiesToUpdate {
+			store.cache.set(id, arp.CopyEntity(store.typeFullname, pe.Entity()), false)
+		}
+		store.mutex.Unlock()
+		return nil
+	}
+	return store.enqueue(ctx, entitiesToInsert, entitiesToUpdate, nil)
+}
+
+func (store *CachingStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	if store.options.writeMode == WriteThrough {
+		err := store.store.RemoveAll(ctx, ids)
+		if err != nil {
+			store.invalidate(ids)
+			return err
+		}
+		store.mutex.Lock()
+		store.generation++
+		for _, id := range ids {
+			store.cache.set(id, &NullEntity{}, true)
+		}
+		store.mutex.Unlock()
+		return nil
+	}
+	return store.enqueue(ctx, nil, nil, ids)
+}
+
+func (store *CachingStore[T]) invalidate(ids []any) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.generation++
+	for _, id := range ids {
+		store.cache.delete(id)
+	}
+}
+
+//把修改放入等待写入的队列，队列满时等待后台写入
+func (store *CachingStore[T]) enqueue(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity, idsToRemove []any) error {
+	n := len(entitiesToInsert) + len(entitiesToUpdate) + len(idsToRemove)
+	//缓存中没有的id要从被缓存的store读取，才能知道是否已经存在
+	for id := range entitiesToInsert {
+		_, found, err := store.Load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if found {
+			return errors.New("can not 'Save' since entity already exists")
+		}
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for {
+		if store.closed {
+			return ErrStoreClosed
+		}
+		if len(store.pending) == 0 || len(store.pending)+n <= store.options.queueSize {
+			break
+		}
+		flushed := store.flushed
+		store.kick()
+		store.mutex.Unlock()
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			store.mutex.Lock()
+			return ctx.Err()
+		}
+		store.mutex.Lock()
+	}
+	for id := range entitiesToInsert {
+		if value, ok := store.lookup(id); ok && value != nil {
+			return errors.New("can not 'Save' since entity already exists")
+		}
+	}
+	store.generation++
+	for id, entity := range entitiesToInsert {
+		copied := arp.CopyEntity(store.typeFullname, entity)
+		if write := store.pending[id]; write != nil && write.removed {
+			//删除之后又新增，对被缓存的store来说是修改
+			store.pending[id] = &pendingWrite{updated: arp.NewTakenProcessEntity(nil, copied)}
+		} else {
+			store.pending[id] = &pendingWrite{inserted: copied}
+		}
+		store.cache.delete(id)
+	}
+	for id, pe := range entitiesToUpdate {
+		copied := arp.CopyEntity(store.typeFullname, pe.Entity())
+		switch write := store.pending[id]; {
+		case write == nil:
+			store.pending[id] = &pendingWrite{updated: pe.WithEntity(copied)}
+		case write.inserted != nil:
+			write.inserted = copied
+		case write.updated != nil:
+			//保留最早的快照
+			write.updated = write.updated.WithEntity(copied)
+		default:
+			store.pending[id] = &pendingWrite{updated: arp.NewTakenProcessEntity(nil, copied)}
+		}
+		store.cache.delete(id)
+	}
+	for _, id := range idsToRemove {
+		write := store.pending[id]
+		if write != nil && write.inserted != nil && store.flushing[id] == nil {
+			//新增还没有写入，直接取消
+			delete(store.pending, id)
+			store.cache.set(id, &NullEntity{}, true)
+			continue
+		}
+		store.pending[id] = &pendingWrite{removed: true}
+		store.cache.delete(id)
+	}
+	if len(store.pending) >= store.options.batchSize {
+		store.kick()
+	}
+	return nil
+}
+
+//通知后台写入，不等待
+func (store *CachingStore[T]) kick() {
+	select {
+	case store.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (store *CachingStore[T]) run() {
+	defer close(store.done)
+	ticker := time.NewTicker(store.options.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.trigger:
+		case <-store.stop:
+			return
+		}
+		store.flush(context.Background())
+	}
+}
+
+//把当前等待写入的修改写入被缓存的store
+func (store *CachingStore[T]) flush(ctx context.Context) error {
+	store.flushMutex.Lock()
+	defer store.flushMutex.Unlock()
+	store.mutex.Lock()
+	writes := store.pending
+	if len(writes) == 0 {
+		store.mutex.Unlock()
+		return nil
+	}
+	store.pending = make(map[any]*pendingWrite)
+	store.flushing = writes
+	store.mutex.Unlock()
+
+	failed := make(map[any]error)
+	err := store.write(ctx, writes)
+	if err != nil && len(writes) == 1 {
+		for id := range writes {
+			failed[id] = err
+		}
+	} else if err != nil {
+		//一批里面是不相关的过程的修改，逐个重新写入，一个id失败不影响其他id
+		for id, write := range writes {
+			//整批写入可能已经新增了一部分
+			if write.inserted != nil {
+				if _, found, loadErr := store.store.Load(ctx, id); loadErr == nil && found {
+					continue
+				}
+			}
+			if writeErr := store.write(ctx, map[any]*pendingWrite{id: write}); writeErr != nil {
+				failed[id] = writeErr
+			}
+		}
+	}
+
+	store.mutex.Lock()
+	store.flushing = nil
+	store.generation++
+	succeeded := make([]any, 0, len(writes))
+	for id, write := range writes {
+		_, fail := failed[id]
+		if !fail {
+			succeeded = append(succeeded, id)
+		}
+		if newer := store.pending[id]; newer != nil {
+			if fail {
+				//之后的修改是在没有写入的修改上做的，改成基于被缓存的store中的状态
+				if rebased := rebase(write, newer); rebased != nil {
+					store.pending[id] = rebased
+				} else {
+					delete(store.pending, id)
+					store.cache.set(id, &NullEntity{}, true)
+				}
+			}
+			continue
+		}
+		//写入失败时不知道被缓存的store的状态，下次从store读取
+		if fail {
+			store.cache.delete(id)
+		} else if entity := write.entity(); entity != nil {
+			store.cache.set(id, entity, false)
+		} else {
+			store.cache.set(id, &NullEntity{}, true)
+		}
+	}
+	close(store.flushed)
+	store.flushed = make(chan struct{})
+	store.mutex.Unlock()
+	if store.options.durability != nil {
+		if len(succeeded) > 0 {
+			store.options.durability(succeeded, nil)
+		}
+		for id, failErr := range failed {
+			store.options.durability([]any{id}, failErr)
+		}
+	}
+	if len(failed) > 0 {
+		return err
+	}
+	return nil
+}
+
+//把一批修改写入被缓存的store
+func (store *CachingStore[T]) write(ctx context.Context, writes map[any]*pendingWrite) error {
+	entitiesToInsert := make(map[any]any)
+	entitiesToUpdate := make(map[any]*arp.ProcessEntity)
+	var idsToRemove []any
+	for id, write := range writes {
+		switch {
+		case write.inserted != nil:
+			entitiesToInsert[id] = write.inserted
+		case write.updated != nil:
+			entitiesToUpdate[id] = write.updated
+		default:
+			idsToRemove = append(idsToRemove, id)
+		}
+	}
+	if len(entitiesToInsert) > 0 || len(entitiesToUpdate) > 0 {
+		if err := store.store.SaveAll(ctx, entitiesToInsert, entitiesToUpdate); err != nil {
+			return err
+		}
+	}
+	if len(idsToRemove) > 0 {
+		return store.store.RemoveAll(ctx, idsToRemove)
+	}
+	return nil
+}
+
+//failed没有写入被缓存的store，把之后的修改newer改成基于被缓存的store中的状态，返回nil表示不需要再写入
+func rebase(failed *pendingWrite, newer *pendingWrite) *pendingWrite {
+	switch {
+	case failed.inserted != nil && newer.removed:
+		//新增没有写入，删除也不需要了
+		return nil
+	case failed.inserted != nil:
+		return &pendingWrite{inserted: newer.entity()}
+	case failed.updated != nil && newer.updated != nil:
+		//保留被缓存的store中的快照
+		return &pendingWrite{updated: failed.updated.WithEntity(newer.updated.Entity())}
+	case failed.removed && newer.inserted != nil:
+		//删除没有写入，之后的新增对被缓存的store来说是修改
+		return &pendingWrite{updated: arp.NewTakenProcessEntity(nil, newer.inserted)}
+	default:
+		return newer
+	}
+}
+
+//立即写入所有等待写入的修改，WriteThrough时什么也不做
+func (store *CachingStore[T]) Flush(ctx context.Context) error {
+	return store.flush(ctx)
+}
+
+//停止后台写入，并写入剩下的修改。之后的写入返回ErrStoreClosed
+func (store *CachingStore[T]) Close() error {
+	store.mutex.Lock()
+	if store.closed {
+		store.mutex.Unlock()
+		return nil
+	}
+	store.closed = true
+	store.mutex.Unlock()
+	if store.options.writeMode == WriteBehind {
+		close(store.stop)
+		<-store.done
+	}
+	return store.flush(context.Background())
+}
+
+func (store *CachingStore[T]) Stats() CacheStats {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.cache.getStats()
+}
+
+//查询前先写入等待写入的修改，保证查询结果包括它们
+func (store *CachingStore[T]) QueryAllIds(ctx context.Context) ([]any, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	if err := store.flush(ctx); err != nil {
+		return nil, err
+	}
+	return queryStore.QueryAllIds(ctx)
+}
+
+func (store *CachingStore[T]) Count(ctx context.Context) (uint64, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return 0, arp.ErrQueryUnsupported
+	}
+	if err := store.flush(ctx); err != nil {
+		return 0, err
+	}
+	return queryStore.Count(ctx)
+}
+
+func (store *CachingStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	if err := store.flush(ctx); err != nil {
+		return nil, err
+	}
+	return queryStore.QueryAllByField(ctx, fieldName, fieldValue)
+}
+
+func (store *CachingStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	if err := store.flush(ctx); err != nil {
+		return nil, err
+	}
+	return queryStore.QueryIdsByField(ctx, fieldName, fieldValue)
+}
+
+func NewCachingStore[T any](store arp.Store[T], opts ...CachingStoreOption) *CachingStore[T] {
+	options := cachingStoreOptions{writeMode: WriteThrough, queueSize: 1000, batchSize: 100, flushInterval: 100 * time.Millisecond}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	cachingStore := &CachingStore[T]{store: store, typeFullname: arp.TypeFullname[T](), options: options, cache: newEntityCache(options.cacheOpts),
+		pending: make(map[any]*pendingWrite), flushed: make(chan struct{}), trigger: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	if options.writeMode == WriteBehind {
+		go cachingStore.run()
+	}
+	return cachingStore
+}
@@ -0,0 +1,393 @@
+package repoext
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//加密后的字符串字段的前缀，带有格式版本。没有这个前缀的值当作明文，这样可以在已有数据上逐步启用加密
+const encryptedStringPrefix = "arpenc:v1:"
+
+//加密后的[]byte字段的开头，最后一个字节是格式版本
+var encryptedBytesMagic = []byte{0xa7, 0x9e, 0x4e, 0x43, 0x01}
+
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+//加密用的key，支持轮换：新数据总是用当前的key加密，旧数据按加密时记录的key id解密
+type KeyProvider interface {
+	CurrentKey() (keyId string, key []byte, err error)
+	Key(keyId string) ([]byte, error)
+}
+
+//内存中的一组key，Rotate之后新的key成为当前的key，旧的key仍然可以用来解密
+type KeyRing struct {
+	mutex     sync.RWMutex
+	currentId string
+	keys      map[string][]byte
+}
+
+func (keyRing *KeyRing) CurrentKey() (keyId string, key []byte, err error) {
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+	return keyRing.currentId, keyRing.keys[keyRing.currentId], nil
+}
+
+func (keyRing *KeyRing) Key(keyId string) ([]byte, error) {
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+	key, ok := keyRing.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyId)
+	}
+	return key, nil
+}
+
+//key的长度是16、24或32字节，分别对应AES-128、AES-192和AES-256
+func (keyRing *KeyRing) Rotate(keyId string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	if len(keyId) == 0 || len(keyId) > 255 {
+		return errors.New("key id length must be between 1 and 255")
+	}
+	keyRing.mutex.Lock()
+	defer keyRing.mutex.Unlock()
+	keyRing.keys[keyId] = append([]byte(nil), key...)
+	keyRing.currentId = keyId
+	return nil
+}
+
+func NewKeyRing(keyId string, key []byte) (*KeyRing, error) {
+	keyRing := &KeyRing{keys: make(map[string][]byte)}
+	if err := keyRing.Rotate(keyId, key); err != nil {
+		return nil, err
+	}
+	return keyRing, nil
+}
+
+//加密带有`arp:"encrypt"`标签的字段的store装饰器，字段只能是string或者[]byte，可以在嵌套的实体中。
+//保存时加密实体的一个副本，加载时解密，所以仓库的Find、Take等看到的都是明文。
+//使用AES-GCM，附加数据是字段所在的类型、字段名和实体的id（按util.Strval比较），密文不能被挪到别的字段或者别的实体上使用。
+//带有加密前缀但不是合法密文格式的值当作明文，所以以"arpenc:"开头的旧明文可以正常读取；格式合法但校验失败的值返回错误。
+//空值不加密。加密的字段每次加密的结果都不同，所以不能用来做QueryAllByField之类的查询
+type EncryptedStore[T any] struct {
+	store        arp.Store[T]
+	keys         KeyProvider
+	typeFullname string
+}
+
+func (store *EncryptedStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	entity, found, err = store.store.Load(ctx, id)
+	if err != nil || !found {
+		return
+	}
+	if err = store.decrypt(id, entity); err != nil {
+		return entity, false, err
+	}
+	return entity, true, nil
+}
+
+func (store *EncryptedStore[T]) Save(ctx context.Context, id any, entity T) error {
+	encrypted, err := store.encryptedCopy(id, entity)
+	if err != nil {
+		return err
+	}
+	return store.store.Save(ctx, id, encrypted.(T))
+}
+
+func (store *EncryptedStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	encryptedToInsert := make(map[any]any, len(entitiesToInsert))
+	for id, entity := range entitiesToInsert {
+		encrypted, err := store.encryptedCopy(id, entity)
+		if err != nil {
+			return err
+		}
+		encryptedToInsert[id] = encrypted
+	}
+	encryptedToUpdate := make(map[any]*arp.ProcessEntity, len(entitiesToUpdate))
+	for id, pe := range entitiesToUpdate {
+		encrypted, err := store.encryptedCopy(id, pe.Entity())
+		if err != nil {
+			return err
+		}
+		encryptedToUpdate[id] = pe.WithEntity(encrypted)
+	}
+	return store.store.SaveAll(ctx, encryptedToInsert, encryptedToUpdate)
+}
+
+func (store *EncryptedStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	return store.store.RemoveAll(ctx, ids)
+}
+
+func (store *EncryptedStore[T]) QueryAllIds(ctx context.Context) ([]any, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	return queryStore.QueryAllIds(ctx)
+}
+
+func (store *EncryptedStore[T]) Count(ctx context.Context) (uint64, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return 0, arp.ErrQueryUnsupported
+	}
+	return queryStore.Count(ctx)
+}
+
+//解密需要实体的id，所以先查询id再逐个加载，查询之后被删除的实体不在结果中
+func (store *EncryptedStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	ids, err := queryStore.QueryIdsByField(ctx, fieldName, fieldValue)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]T, 0, len(ids))
+	for _, id := range ids {
+		entity, found, err := store.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
+func (store *EncryptedStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error) {
+	queryStore, ok := store.store.(arp.QueryStore[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	return queryStore.QueryIdsByField(ctx, fieldName, fieldValue)
+}
+
+//过程中的实体不能被修改，所以加密的是它的副本
+func (store *EncryptedStore[T]) encryptedCopy(id any, entity any) (any, error) {
+	encrypted, err := arp.CopyRegisteredEntity(store.typeFullname, entity)
+	if err != nil {
+		return nil, err
+	}
+	keyId, key, err := store.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	err = walkEncryptedFields(reflect.ValueOf(encrypted), id, func(field reflect.Value, aad []byte) error {
+		if field.Kind() == reflect.String {
+			if field.Len() == 0 {
+				return nil
+			}
+			sealed, err := seal(aead, keyId, []byte(field.String()), aad)
+			if err != nil {
+				return err
+			}
+			field.SetString(encryptedStringPrefix + base64.StdEncoding.EncodeToString(sealed))
+			return nil
+		}
+		if field.Len() == 0 {
+			return nil
+		}
+		sealed, err := seal(aead, keyId, field.Bytes(), aad)
+		if err != nil {
+			return err
+		}
+		field.SetBytes(append(append([]byte(nil), encryptedBytesMagic...), sealed...))
+		return nil
+	})
+	return encrypted, err
+}
+
+func (store *EncryptedStore[T]) decrypt(id any, entity any) error {
+	return walkEncryptedFields(reflect.ValueOf(entity), id, func(field reflect.Value, aad []byte) error {
+		if field.Kind() == reflect.String {
+			s := field.String()
+			if !strings.HasPrefix(s, encryptedStringPrefix) {
+				return nil
+			}
+			sealed, err := base64.StdEncoding.DecodeString(s[len(encryptedStringPrefix):])
+			if err != nil {
+				//不是合法的密文，当作明文
+				return nil
+			}
+			plain, ok, err := store.open(sealed, aad)
+			if err != nil {
+				return err
+			}
+			if ok {
+				field.SetString(string(plain))
+			}
+			return nil
+		}
+		b := field.Bytes()
+		if !bytes.HasPrefix(b, encryptedBytesMagic) {
+			return nil
+		}
+		plain, ok, err := store.open(b[len(encryptedBytesMagic):], aad)
+		if err != nil {
+			return err
+		}
+		if ok {
+			field.SetBytes(plain)
+		}
+		return nil
+	})
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//[key id长度][key id][nonce][密文]
+func seal(aead cipher.AEAD, keyId string, plain []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, 1+len(keyId)+len(nonce)+len(plain)+aead.Overhead())
+	sealed = append(sealed, byte(len(keyId)))
+	sealed = append(sealed, keyId...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plain, aad), nil
+}
+
+//ok为false表示不是合法的密文格式，调用者把它当作明文
+func (store *EncryptedStore[T]) open(sealed []byte, aad []byte) (plain []byte, ok bool, err error) {
+	if len(sealed) < 1 || sealed[0] == 0 || len(sealed) < 1+int(sealed[0]) {
+		return nil, false, nil
+	}
+	keyId := string(sealed[1 : 1+int(sealed[0])])
+	sealed = sealed[1+int(sealed[0]):]
+	key, err := store.keys.Key(keyId)
+	if err != nil {
+		return nil, false, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, false, nil
+	}
+	plain, err = aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, false, err
+	}
+	return plain, true, nil
+}
+
+//类型中是否有需要加密的字段，结果按类型缓存
+var encryptedTypes sync.Map
+
+func hasEncryptedFields(t reflect.Type) bool {
+	if has, ok := encryptedTypes.Load(t); ok {
+		return has.(bool)
+	}
+	has := checkEncryptedFields(t, make(map[reflect.Type]bool))
+	encryptedTypes.Store(t, has)
+	return has
+}
+
+func checkEncryptedFields(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return checkEncryptedFields(t.Elem(), visiting)
+	case reflect.Map:
+		return checkEncryptedFields(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if util.HasArpTagOption(field, "encrypt") || checkEncryptedFields(field.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//找到所有带encrypt标签的字段，value必须是可以修改的，比如实体的指针
+func walkEncryptedFields(value reflect.Value, id any, f func(field reflect.Value, aad []byte) error) error {
+	if !value.IsValid() || !hasEncryptedFields(value.Type()) {
+		return nil
+	}
+	value = util.Accessible(value)
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.IsNil() {
+			return nil
+		}
+		return walkEncryptedFields(value.Elem(), id, f)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := walkEncryptedFields(value.Index(i), id, f); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			//map的元素不能直接修改，复制出来处理完再放回去
+			element := reflect.New(value.Type().Elem()).Elem()
+			element.Set(iter.Value())
+			if err := walkEncryptedFields(element, id, f); err != nil {
+				return err
+			}
+			value.SetMapIndex(iter.Key(), element)
+		}
+	case reflect.Struct:
+		t := value.Type()
+		for i := 0; i < t.NumField(); i++ {
+			structField := t.Field(i)
+			field := util.Accessible(value.Field(i))
+			if !util.HasArpTagOption(structField, "encrypt") {
+				if err := walkEncryptedFields(field, id, f); err != nil {
+					return err
+				}
+				continue
+			}
+			if field.Kind() != reflect.String && !(field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8) {
+				return fmt.Errorf("field %s.%s tagged encrypt must be string or []byte", t.Name(), structField.Name)
+			}
+			if err := f(field, []byte(t.PkgPath()+"."+t.Name()+"."+structField.Name+"#"+util.Strval(id))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func NewEncryptedStore[T any](store arp.Store[T], keys KeyProvider) *EncryptedStore[T] {
+	entityType := reflect.TypeOf((*T)(nil)).Elem()
+	if entityType.Kind() == reflect.Pointer {
+		entityType = entityType.Elem()
+	}
+	return &EncryptedStore[T]{store, keys, entityType.PkgPath() + "." + entityType.Name()}
+}
@@ -0,0 +1,242 @@
+package repoext
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//一条失效通知，Sender是发出通知的缓存实例，Ids是按util.Strval转换过的id
+type InvalidationMessage struct {
+	Sender     string
+	EntityType string
+	Ids        []string
+}
+
+//在多个实例的缓存之间传递失效通知。
+//一个实例的过程提交之后，其他实例上的缓存收到通知，清除涉及的id，下次Find从store重新加载
+type InvalidationBus interface {
+	//通知所有订阅者，包括发出通知的实例自己，订阅者按Sender忽略自己发出的通知
+	Publish(ctx context.Context, message InvalidationMessage) error
+	//返回的函数用于取消订阅
+	Subscribe(handler func(message InvalidationMessage)) (unsubscribe func())
+}
+
+type subscribers struct {
+	mutex    sync.RWMutex
+	handlers map[uint64]func(message InvalidationMessage)
+	nextId   uint64
+}
+
+func (s *subscribers) subscribe(handler func(message InvalidationMessage)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.handlers == nil {
+		s.handlers = make(map[uint64]func(message InvalidationMessage))
+	}
+	s.nextId++
+	id := s.nextId
+	s.handlers[id] = handler
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.handlers, id)
+	}
+}
+
+func (s *subscribers) dispatch(message InvalidationMessage) {
+	s.mutex.RLock()
+	handlers := make([]func(message InvalidationMessage), 0, len(s.handlers))
+	for _, handler := range s.handlers {
+		handlers = append(handlers, handler)
+	}
+	s.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+//进程内的InvalidationBus，Publish时同步调用所有订阅者。用于同一进程内的多个缓存实例或者测试
+type MemInvalidationBus struct {
+	subscribers subscribers
+}
+
+func (bus *MemInvalidationBus) Publish(ctx context.Context, message InvalidationMessage) error {
+	bus.subscribers.dispatch(message)
+	return nil
+}
+
+func (bus *MemInvalidationBus) Subscribe(handler func(message InvalidationMessage)) (unsubscribe func()) {
+	return bus.subscribers.subscribe(handler)
+}
+
+func NewMemInvalidationBus() *MemInvalidationBus {
+	return &MemInvalidationBus{}
+}
+
+//一个UDP报文的最大长度（编码之后），超过时分成多个报文。UDP报文最长65507字节，接收的缓冲区是64KB
+const maxUDPPacketSize = 60 * 1024
+
+//基于UDP的InvalidationBus，每个实例监听一个地址，Publish时把通知发给所有peer。
+//UDP不保证送达，丢失的通知只能靠缓存的TTL兜底，所以和它一起使用的缓存应该设置WithTTL
+type UDPInvalidationBus struct {
+	conn        *net.UDPConn
+	peersMutex  sync.RWMutex
+	peers       []*net.UDPAddr
+	subscribers subscribers
+	done        chan struct{}
+}
+
+func (bus *UDPInvalidationBus) Publish(ctx context.Context, message InvalidationMessage) error {
+	bus.peersMutex.RLock()
+	peers := bus.peers
+	bus.peersMutex.RUnlock()
+	packets, err := splitMessage(message)
+	if err != nil {
+		return err
+	}
+	for _, data := range packets {
+		for _, peer := range peers {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, err := bus.conn.WriteToUDP(data, peer); err != nil {
+				return err
+			}
+		}
+	}
+	//发给自己的订阅者不经过网络
+	bus.subscribers.dispatch(message)
+	return nil
+}
+
+func splitMessage(message InvalidationMessage) ([][]byte, error) {
+	//JSON转义会让id变长（比如"<"编码成"\u003c"），所以按编码之后的长度来分
+	empty, err := json.Marshal(InvalidationMessage{Sender: message.Sender, EntityType: message.EntityType, Ids: []string{}})
+	if err != nil {
+		return nil, err
+	}
+	var packets [][]byte
+	var ids []string
+	size := len(empty)
+	for _, id := range message.Ids {
+		encodedId, err := json.Marshal(id)
+		if err != nil {
+			return nil, err
+		}
+		idSize := len(encodedId)
+		if len(ids) > 0 {
+			//分隔的逗号
+			idSize++
+		}
+		if len(ids) > 0 && size+idSize > maxUDPPacketSize {
+			packet, err := json.Marshal(InvalidationMessage{Sender: message.Sender, EntityType: message.EntityType, Ids: ids})
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, packet)
+			ids = nil
+			size = len(empty)
+			idSize = len(encodedId)
+		}
+		if size+idSize > maxUDPPacketSize {
+			return nil, fmt.Errorf("invalidation id too large for a UDP packet: %d bytes encoded", len(encodedId))
+		}
+		ids = append(ids, id)
+		size += idSize
+	}
+	packet, err := json.Marshal(InvalidationMessage{Sender: message.Sender, EntityType: message.EntityType, Ids: ids})
+	if err != nil {
+		return nil, err
+	}
+	return append(packets, packet), nil
+}
+
+func (bus *UDPInvalidationBus) Subscribe(handler func(message InvalidationMessage)) (unsubscribe func()) {
+	return bus.subscribers.subscribe(handler)
+}
+
+//增加一个接收通知的实例
+func (bus *UDPInvalidationBus) AddPeer(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	bus.peersMutex.Lock()
+	defer bus.peersMutex.Unlock()
+	peers := make([]*net.UDPAddr, len(bus.peers), len(bus.peers)+1)
+	copy(peers, bus.peers)
+	bus.peers = append(peers, udpAddr)
+	return nil
+}
+
+//实际监听的地址，监听端口为0时用来取得分配的端口
+func (bus *UDPInvalidationBus) LocalAddr() string {
+	return bus.conn.LocalAddr().String()
+}
+
+func (bus *UDPInvalidationBus) Close() error {
+	err := bus.conn.Close()
+	<-bus.done
+	return err
+}
+
+func (bus *UDPInvalidationBus) receive() {
+	defer close(bus.done)
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := bus.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		var message InvalidationMessage
+		if err := json.Unmarshal(buf[:n], &message); err != nil {
+			continue
+		}
+		bus.subscribers.dispatch(message)
+	}
+}
+
+//监听listenAddr，比如"127.0.0.1:0"，并把通知发给peers
+func NewUDPInvalidationBus(listenAddr string, peers ...string) (*UDPInvalidationBus, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	bus := &UDPInvalidationBus{conn: conn, done: make(chan struct{})}
+	for _, peer := range peers {
+		if err := bus.AddPeer(peer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go bus.receive()
+	return bus, nil
+}
+
+func newSenderId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func invalidationIds(ids []any) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = util.Strval(id)
+	}
+	return keys
+}
@@ -3,84 +3,328 @@ package repoext
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/framework-arp/ARP4G/arp"
 )
 
-//用于只读查询类场景加速
+//用于只读查询类场景加速。
+//缓存只在过程提交成功之后按提交的变化更新，放弃的过程涉及的id从缓存中清除，所以Find看不到别的过程未提交的修改。
+//过程内的Find优先返回本过程中的实体。缓存的大小、淘汰策略和过期时间见CacheOption。
+//可以装饰任何arp.Repository的实现，缓存的更新来自过程的提交和放弃通知。
+//查询、TakeAny、TryTake和TakeAll转给被装饰的仓库，它实现了arp.QueryRepository时装饰后的仓库也可以当作arp.QueryRepository使用
 type ViewCachedRepository[T any] struct {
-	*arp.RepositoryImpl[T]
-	cache sync.Map
-	count uint64
-	mutex sync.Mutex
+	repository arp.Repository[T]
+	entityType string
+	//值是实体的副本，或者表示不存在的*NullEntity
+	cache *entityCache
+	//每次提交或放弃都会增加，从store加载期间有变化的话，加载的结果不放入缓存，避免覆盖更新的数据
+	generation uint64
+	//已提交的实体数量，countLoaded为false时需要从仓库重新取得
+	count       uint64
+	countLoaded bool
+	mutex       sync.Mutex
+	//配置了InvalidationBus时，用sender区分自己发出的通知
+	sender      string
+	unsubscribe func()
 }
 
 type NullEntity struct {
 }
 
 func (vcr *ViewCachedRepository[T]) UpdateCacheForEntity(id any, entity any) {
+	vcr.mutex.Lock()
+	defer vcr.mutex.Unlock()
+	vcr.generation++
+	vcr.updateCache(id, entity)
+}
+
+func (vcr *ViewCachedRepository[T]) updateCache(id any, entity any) {
 	if entity == nil {
-		vcr.cache.Store(id, &NullEntity{})
+		vcr.cache.set(id, &NullEntity{}, true)
 	} else {
-		vcr.cache.Store(id, entity)
+		vcr.cache.set(id, arp.CopyEntity(vcr.entityType, entity), false)
 	}
 }
 
 func (vcr *ViewCachedRepository[T]) Find(ctx context.Context, id any) (entity T, found bool) {
-	entityLoad, ok := vcr.cache.Load(id)
-	if ok {
-		if _, ok := entityLoad.(*NullEntity); ok {
+	if inProcess, entityInProcess := arp.FindEntityInProcess(ctx, vcr.entityType, id); inProcess {
+		if entityInProcess == nil {
 			return entity, false
 		}
-		return entityLoad.(T), true
+		return entityInProcess.(T), true
+	}
+	vcr.mutex.Lock()
+	entityLoad, ok := vcr.cache.get(id)
+	generation := vcr.generation
+	vcr.mutex.Unlock()
+	if !ok {
+		var entityFromStore T
+		entityFromStore, found = vcr.repository.Find(ctx, id)
+		vcr.mutex.Lock()
+		if vcr.generation == generation {
+			if found {
+				vcr.updateCache(id, entityFromStore)
+			} else {
+				vcr.updateCache(id, nil)
+			}
+		}
+		vcr.mutex.Unlock()
+		return entityFromStore, found
 	}
-	entityFromStore, found := vcr.RepositoryImpl.Find(ctx, id)
-	vcr.UpdateCacheForEntity(id, entityFromStore)
-	entityLoad, _ = vcr.cache.Load(id)
 	if _, ok := entityLoad.(*NullEntity); ok {
 		return entity, false
 	}
 	//实际上ViewCachedRepository的目的是只读的，所以查出来需要复制一份，保护一下
-	return arp.CopyEntity(vcr.RepositoryImpl.EntityType(), entityLoad).(T), true
+	return arp.CopyEntity(vcr.entityType, entityLoad).(T), true
 }
 
 func (vcr *ViewCachedRepository[T]) Take(ctx context.Context, id any) (entity T, found bool) {
-	entity, found = vcr.RepositoryImpl.Take(ctx, id)
-	vcr.UpdateCacheForEntity(id, entity)
-	return
+	return vcr.repository.Take(ctx, id)
+}
+
+//被装饰的仓库需要实现arp.TryRepository
+func (vcr *ViewCachedRepository[T]) TryTake(ctx context.Context, id any) (entity T, found bool, occupied bool) {
+	return vcr.tryRepository("TryTake").TryTake(ctx, id)
+}
+
+func (vcr *ViewCachedRepository[T]) TakeWithin(ctx context.Context, id any, d time.Duration) (entity T, found bool, occupied bool) {
+	return vcr.tryRepository("TakeWithin").TakeWithin(ctx, id, d)
+}
+
+func (vcr *ViewCachedRepository[T]) tryRepository(op string) arp.TryRepository[T] {
+	tryRepository, ok := vcr.repository.(arp.TryRepository[T])
+	if !ok {
+		panic(op + " error: " + arp.ErrTryTakeUnsupported.Error())
+	}
+	return tryRepository
+}
+
+//被装饰的仓库实现了arp.TakeAllRepository时由它按顺序加锁，否则按ids的顺序逐个取得
+func (vcr *ViewCachedRepository[T]) TakeAll(ctx context.Context, ids []any) map[any]T {
+	if takeAllRepository, ok := vcr.repository.(arp.TakeAllRepository[T]); ok {
+		return takeAllRepository.TakeAll(ctx, ids)
+	}
+	entities := make(map[any]T, len(ids))
+	for _, id := range ids {
+		if entity, found := vcr.repository.Take(ctx, id); found {
+			entities[id] = entity
+		}
+	}
+	return entities
+}
+
+//查询不经过缓存，被装饰的仓库需要实现arp.QueryRepository，否则返回arp.ErrQueryUnsupported
+func (vcr *ViewCachedRepository[T]) QueryAllIds(ctx context.Context) ([]any, error) {
+	queryRepository, ok := vcr.repository.(arp.QueryRepository[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	return queryRepository.QueryAllIds(ctx)
+}
+
+func (vcr *ViewCachedRepository[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	queryRepository, ok := vcr.repository.(arp.QueryRepository[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	return queryRepository.QueryAllByField(ctx, fieldName, fieldValue)
+}
+
+func (vcr *ViewCachedRepository[T]) TakeAny(ctx context.Context, filter arp.QueryFilter, n int) ([]T, error) {
+	queryRepository, ok := vcr.repository.(arp.QueryRepository[T])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	return queryRepository.TakeAny(ctx, filter, n)
 }
 
 func (vcr *ViewCachedRepository[T]) Put(ctx context.Context, id any, entity T) {
-	vcr.RepositoryImpl.Put(ctx, id, entity)
-	vcr.UpdateCacheForEntity(id, entity)
+	vcr.repository.Put(ctx, id, entity)
 }
 
 func (vcr *ViewCachedRepository[T]) PutIfAbsent(ctx context.Context, id any, entity T) (actual T, absent bool) {
-	actual, absent = vcr.RepositoryImpl.PutIfAbsent(ctx, id, entity)
-	vcr.UpdateCacheForEntity(id, actual)
-	return
+	return vcr.repository.PutIfAbsent(ctx, id, entity)
 }
 
 func (vcr *ViewCachedRepository[T]) Remove(ctx context.Context, id any) (removed T, exists bool) {
-	removed, exists = vcr.RepositoryImpl.Remove(ctx, id)
-	if exists {
-		vcr.UpdateCacheForEntity(id, nil)
-	}
-	return
+	return vcr.repository.Remove(ctx, id)
 }
 
 func (vcr *ViewCachedRepository[T]) TakeOrPutIfAbsent(ctx context.Context, id any, newEntity T) T {
-	entity := vcr.RepositoryImpl.TakeOrPutIfAbsent(ctx, id, newEntity)
-	vcr.UpdateCacheForEntity(id, entity)
-	return entity
+	return vcr.repository.TakeOrPutIfAbsent(ctx, id, newEntity)
+}
+
+func (vcr *ViewCachedRepository[T]) Committed(ctx context.Context, changes *arp.ChangeSet) {
+	vcr.updateCommitted(changes)
+	ids := make([]any, 0, len(changes.Inserted)+len(changes.Updated)+len(changes.Removed))
+	for id := range changes.Inserted {
+		ids = append(ids, id)
+	}
+	for id := range changes.Updated {
+		ids = append(ids, id)
+	}
+	ids = append(ids, changes.Removed...)
+	vcr.publish(ctx, ids)
+}
+
+func (vcr *ViewCachedRepository[T]) updateCommitted(changes *arp.ChangeSet) {
+	vcr.mutex.Lock()
+	defer vcr.mutex.Unlock()
+	vcr.generation++
+	for id, entity := range changes.Inserted {
+		vcr.updateCache(id, entity)
+	}
+	if vcr.countLoaded {
+		vcr.count += uint64(len(changes.Inserted))
+		if uint64(len(changes.Removed)) > vcr.count {
+			vcr.countLoaded = false
+		} else {
+			vcr.count -= uint64(len(changes.Removed))
+		}
+	}
+	for id, entity := range changes.Updated {
+		vcr.updateCache(id, entity)
+	}
+	for _, id := range changes.Removed {
+		vcr.updateCache(id, nil)
+	}
+	//没有修改的实体不用更新缓存，但缓存记为不存在的说明实体是在缓存之后才创建的
+	for id, entity := range changes.Unchanged {
+		if value, ok := vcr.cache.peek(id); ok {
+			if _, null := value.(*NullEntity); null {
+				vcr.updateCache(id, entity)
+			}
+		}
+	}
+}
+
+func (vcr *ViewCachedRepository[T]) Aborted(ctx context.Context, entityType string, ids []any) {
+	vcr.mutex.Lock()
+	vcr.generation++
+	for _, id := range ids {
+		vcr.cache.delete(id)
+	}
+	//可能有一部分已经保存了
+	vcr.countLoaded = false
+	vcr.mutex.Unlock()
+	vcr.publish(ctx, ids)
+}
+
+//通知其他实例，发送失败不影响已经完成的过程，其他实例的缓存只能等过期
+func (vcr *ViewCachedRepository[T]) publish(ctx context.Context, ids []any) {
+	bus := vcr.cache.options.bus
+	if bus == nil || len(ids) == 0 {
+		return
+	}
+	bus.Publish(ctx, InvalidationMessage{Sender: vcr.sender, EntityType: vcr.entityType, Ids: invalidationIds(ids)})
+}
+
+//处理其他实例发出的失效通知
+func (vcr *ViewCachedRepository[T]) invalidate(message InvalidationMessage) {
+	if message.Sender == vcr.sender || message.EntityType != vcr.entityType {
+		return
+	}
+	vcr.mutex.Lock()
+	defer vcr.mutex.Unlock()
+	vcr.generation++
+	for _, key := range message.Ids {
+		vcr.cache.deleteByKey(key)
+	}
+	//不知道其他实例是新增、修改还是删除
+	vcr.countLoaded = false
+}
+
+//不再接收过程和InvalidationBus的通知，之后缓存不会再更新，不再使用时调用
+func (vcr *ViewCachedRepository[T]) Close() {
+	arp.RemoveProcessListener(vcr.entityType, vcr)
+	if vcr.unsubscribe != nil {
+		vcr.unsubscribe()
+	}
+}
+
+func (vcr *ViewCachedRepository[T]) Stats() CacheStats {
+	vcr.mutex.Lock()
+	defer vcr.mutex.Unlock()
+	return vcr.cache.getStats()
+}
+
+//已提交的实体数量，第一次调用时从仓库取得，之后按提交的新增和删除维护。
+//被装饰的仓库需要有Count方法（比如arp.QueryRepository），否则返回arp.ErrQueryUnsupported
+func (vcr *ViewCachedRepository[T]) Count(ctx context.Context) (uint64, error) {
+	vcr.mutex.Lock()
+	if vcr.countLoaded {
+		defer vcr.mutex.Unlock()
+		return vcr.count, nil
+	}
+	generation := vcr.generation
+	vcr.mutex.Unlock()
+	counter, ok := vcr.repository.(interface {
+		Count(ctx context.Context) (uint64, error)
+	})
+	if !ok {
+		return 0, arp.ErrQueryUnsupported
+	}
+	count, err := counter.Count(ctx)
+	if err != nil {
+		return 0, err
+	}
+	vcr.updateCount(count, generation)
+	return count, nil
+}
+
+//取得数量期间没有提交的话才记录
+func (vcr *ViewCachedRepository[T]) updateCount(count uint64, generation uint64) {
+	vcr.mutex.Lock()
+	if vcr.generation == generation {
+		vcr.count = count
+		vcr.countLoaded = true
+	}
+	vcr.mutex.Unlock()
 }
 
-func (vcr *ViewCachedRepository[T]) updateCount(count uint64) {
+//通过QueryAllIds把全部实体加载到缓存中，并记录数量，适合在启动时调用。
+//缓存有容量限制时只保留最后加载的那些。被装饰的仓库需要有QueryAllIds方法，否则返回arp.ErrQueryUnsupported
+func (vcr *ViewCachedRepository[T]) WarmUp(ctx context.Context) error {
+	querier, ok := vcr.repository.(interface {
+		QueryAllIds(ctx context.Context) ([]any, error)
+	})
+	if !ok {
+		return arp.ErrQueryUnsupported
+	}
 	vcr.mutex.Lock()
-	vcr.count = count
+	startGeneration := vcr.generation
 	vcr.mutex.Unlock()
+	ids, err := querier.QueryAllIds(ctx)
+	if err != nil {
+		return err
+	}
+	var count uint64
+	for _, id := range ids {
+		vcr.mutex.Lock()
+		generation := vcr.generation
+		vcr.mutex.Unlock()
+		entity, found := vcr.repository.Find(ctx, id)
+		if !found {
+			continue
+		}
+		count++
+		vcr.mutex.Lock()
+		if vcr.generation == generation {
+			vcr.updateCache(id, entity)
+		}
+		vcr.mutex.Unlock()
+	}
+	vcr.updateCount(count, startGeneration)
+	return nil
 }
 
-func NewViewCachedRepository[T any](repository arp.Repository[T]) arp.Repository[T] {
-	return &ViewCachedRepository[T]{RepositoryImpl: repository.(*arp.RepositoryImpl[T])}
+func NewViewCachedRepository[T any](repository arp.Repository[T], opts ...CacheOption) arp.Repository[T] {
+	vcr := &ViewCachedRepository[T]{repository: repository, entityType: arp.TypeFullname[T](), cache: newEntityCache(opts)}
+	arp.AddProcessListener(vcr.entityType, vcr)
+	if bus := vcr.cache.options.bus; bus != nil {
+		vcr.sender = newSenderId()
+		vcr.unsubscribe = bus.Subscribe(vcr.invalidate)
+	}
+	return vcr
 }
@@ -0,0 +1,244 @@
+package repoimpl
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type lockPriorityKey int
+
+var lockPriorityCtxKey lockPriorityKey
+
+//设置在FairMutexes上排队的优先级，数值大的优先，默认是0
+func WithLockPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, lockPriorityCtxKey, priority)
+}
+
+func lockPriority(ctx context.Context) int {
+	priority, _ := ctx.Value(lockPriorityCtxKey).(int)
+	return priority
+}
+
+//公平的锁，每个id一个等待队列，同优先级的按先来后到获得锁，释放时直接交给队首，不会被后来者插队。
+//没有持有者也没有等待者的锁会被删除，等待时间的统计只保留最近获得锁的maxTrackedWaitTimes个id
+type FairMutexes struct {
+	mutex     sync.Mutex
+	entries   map[any]*fairEntry
+	waitTimes *waitTimesById
+}
+
+//有持有者的锁，释放时没有等待者就删除
+type fairEntry struct {
+	waiters []*fairWaiter
+}
+
+const maxTrackedWaitTimes = 1024
+
+//有容量限制的每个id的等待时间统计，超过容量时淘汰最久没有获得锁的id
+type waitTimesById struct {
+	bounds     []time.Duration
+	histograms map[any]*list.Element
+	//元素是*idWaitTimes，最近获得锁的在前面
+	recent *list.List
+}
+
+type idWaitTimes struct {
+	id        any
+	histogram *WaitHistogram
+}
+
+func (waitTimes *waitTimesById) observe(id any, d time.Duration) {
+	element := waitTimes.histograms[id]
+	if element == nil {
+		if waitTimes.recent.Len() >= maxTrackedWaitTimes {
+			oldest := waitTimes.recent.Back()
+			waitTimes.recent.Remove(oldest)
+			delete(waitTimes.histograms, oldest.Value.(*idWaitTimes).id)
+		}
+		element = waitTimes.recent.PushFront(&idWaitTimes{id, newWaitHistogram(waitTimes.bounds)})
+		waitTimes.histograms[id] = element
+	} else {
+		waitTimes.recent.MoveToFront(element)
+	}
+	element.Value.(*idWaitTimes).histogram.observe(d)
+}
+
+func (waitTimes *waitTimesById) get(id any) WaitHistogram {
+	element := waitTimes.histograms[id]
+	if element == nil {
+		return newWaitHistogram(waitTimes.bounds).copy()
+	}
+	return element.Value.(*idWaitTimes).histogram.copy()
+}
+
+type fairWaiter struct {
+	priority   int
+	enqueuedAt time.Time
+	ready      chan struct{}
+}
+
+//等待时间的直方图，Counts[i]是等待时间落在(Bounds[i-1], Bounds[i]]的次数，最后一个是超过所有上界的次数
+type WaitHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+func newWaitHistogram(bounds []time.Duration) *WaitHistogram {
+	return &WaitHistogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+func (histogram *WaitHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogram.Bounds) && d > histogram.Bounds[i] {
+		i++
+	}
+	histogram.Counts[i]++
+	histogram.Count++
+	histogram.Sum += d
+}
+
+func (histogram *WaitHistogram) copy() WaitHistogram {
+	counts := make([]uint64, len(histogram.Counts))
+	copy(counts, histogram.Counts)
+	return WaitHistogram{histogram.Bounds, counts, histogram.Count, histogram.Sum}
+}
+
+var DefaultWaitTimeBounds = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+func (fairMutexes *FairMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	fairMutexes.mutex.Lock()
+	entry := fairMutexes.entries[id]
+	if entry == nil {
+		fairMutexes.mutex.Unlock()
+		return false, true, nil
+	}
+	waiter := &fairWaiter{lockPriority(ctx), time.Now(), make(chan struct{})}
+	entry.enqueue(waiter)
+	fairMutexes.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true, false, nil
+	case <-ctx.Done():
+		fairMutexes.mutex.Lock()
+		defer fairMutexes.mutex.Unlock()
+		if entry.dequeue(waiter) {
+			return false, false, ctx.Err()
+		}
+		//已经被交到手上了，交给下一个
+		fairMutexes.handOff(id, entry)
+		return false, false, ctx.Err()
+	}
+}
+
+func (fairMutexes *FairMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	if wait > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		defer cancel()
+		ok, absent, err = fairMutexes.Lock(waitCtx, id)
+		if err != nil && ctx.Err() == nil {
+			return false, false, nil
+		}
+		return ok, absent, err
+	}
+	//锁存在就是有人持有
+	fairMutexes.mutex.Lock()
+	defer fairMutexes.mutex.Unlock()
+	_, held := fairMutexes.entries[id]
+	return false, !held, nil
+}
+
+func (fairMutexes *FairMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	fairMutexes.mutex.Lock()
+	defer fairMutexes.mutex.Unlock()
+	if fairMutexes.entries[id] != nil {
+		return false, nil
+	}
+	fairMutexes.entries[id] = &fairEntry{}
+	fairMutexes.waitTimes.observe(id, 0)
+	return true, nil
+}
+
+func (fairMutexes *FairMutexes) UnlockAll(ctx context.Context, ids []any) {
+	fairMutexes.mutex.Lock()
+	defer fairMutexes.mutex.Unlock()
+	for _, id := range ids {
+		entry := fairMutexes.entries[id]
+		if entry != nil {
+			fairMutexes.handOff(id, entry)
+		}
+	}
+}
+
+//把锁交给队首的等待者，没有等待者就删除锁
+func (fairMutexes *FairMutexes) handOff(id any, entry *fairEntry) {
+	if len(entry.waiters) == 0 {
+		delete(fairMutexes.entries, id)
+		return
+	}
+	next := entry.waiters[0]
+	entry.waiters = entry.waiters[1:]
+	fairMutexes.waitTimes.observe(id, time.Since(next.enqueuedAt))
+	close(next.ready)
+}
+
+//锁的数量，也就是有持有者的id的数量
+func (fairMutexes *FairMutexes) Len() int {
+	fairMutexes.mutex.Lock()
+	defer fairMutexes.mutex.Unlock()
+	return len(fairMutexes.entries)
+}
+
+//id上排队等待的数量
+func (fairMutexes *FairMutexes) QueueLen(id any) int {
+	fairMutexes.mutex.Lock()
+	defer fairMutexes.mutex.Unlock()
+	entry := fairMutexes.entries[id]
+	if entry == nil {
+		return 0
+	}
+	return len(entry.waiters)
+}
+
+//id上获得锁的等待时间统计，只保留最近获得锁的maxTrackedWaitTimes个id的统计
+func (fairMutexes *FairMutexes) WaitTimes(id any) WaitHistogram {
+	fairMutexes.mutex.Lock()
+	defer fairMutexes.mutex.Unlock()
+	return fairMutexes.waitTimes.get(id)
+}
+
+//按优先级从高到低插入，同优先级排在最后
+func (entry *fairEntry) enqueue(waiter *fairWaiter) {
+	i := len(entry.waiters)
+	for i > 0 && entry.waiters[i-1].priority < waiter.priority {
+		i--
+	}
+	entry.waiters = append(entry.waiters, nil)
+	copy(entry.waiters[i+1:], entry.waiters[i:])
+	entry.waiters[i] = waiter
+}
+
+func (entry *fairEntry) dequeue(waiter *fairWaiter) bool {
+	for i, w := range entry.waiters {
+		if w == waiter {
+			entry.waiters = append(entry.waiters[:i], entry.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func NewFairMutexes(waitTimeBounds ...time.Duration) *FairMutexes {
+	if len(waitTimeBounds) == 0 {
+		waitTimeBounds = DefaultWaitTimeBounds
+	}
+	return &FairMutexes{entries: make(map[any]*fairEntry),
+		waitTimes: &waitTimesById{bounds: waitTimeBounds, histograms: make(map[any]*list.Element), recent: list.New()}}
+}
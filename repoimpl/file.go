@@ -0,0 +1,76 @@
+package repoimpl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//把独立实体保存在一个文件中，适合系统配置、计数器之类的数据。
+//实体用指定的codec编码
+type FileSingletonStore[T any] struct {
+	path  string
+	codec arp.Codec[*T]
+	mutex sync.Mutex
+}
+
+func (store *FileSingletonStore[T]) Load(ctx context.Context) (entity *T, found bool, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if entity, err = store.codec.Decode(data); err != nil {
+		return nil, false, err
+	}
+	return entity, true, nil
+}
+
+func (store *FileSingletonStore[T]) Save(ctx context.Context, entity *T) error {
+	data, err := store.codec.Encode(entity)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return writeFileAtomic(store.path, data)
+}
+
+//先写临时文件再改名，保证文件中要么是旧内容要么是新内容
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+func NewFileSingletonStore[T any](path string, codec arp.Codec[*T]) *FileSingletonStore[T] {
+	return &FileSingletonStore[T]{path: path, codec: codec}
+}
+
+func NewFileSingletonRepository[T any](path string, codec arp.Codec[*T], newZeroEntity arp.NewZeroEntity[*T], opts ...arp.RepositoryOption) arp.SingletonRepository[T] {
+	return arp.NewStoredSingletonRepository[T](NewFileSingletonStore[T](path, codec), newZeroEntity, opts...)
+}
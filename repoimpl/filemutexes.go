@@ -0,0 +1,157 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package repoimpl
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//基于文件锁(flock)的锁，用于同一台机器上的多个进程之间加锁。每个id对应锁目录下的一个文件，文件存在表示锁已创建。
+//释放锁时在持有flock的情况下删除文件，锁目录不会一直增长，之后Lock返回absent，由仓库检查entity是否存在再补锁。
+//等待者flock成功之后要检查路径上还是同一个文件，文件已经被删除或者重新创建的话这个flock无效。
+//flock在进程退出时由内核释放，所以持有锁的进程死掉之后锁会自动恢复可用，不会留下死锁。
+//文件中记录了持有锁的进程号，方便排查
+type FileMutexes struct {
+	dir   string
+	mutex sync.Mutex
+	held  map[any]*os.File
+}
+
+func (fileMutexes *FileMutexes) lockFilePath(id any) string {
+	return filepath.Join(fileMutexes.dir, url.PathEscape(util.Strval(id))+".lock")
+}
+
+func (fileMutexes *FileMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	return fileMutexes.lock(ctx, id, time.Time{})
+}
+
+func (fileMutexes *FileMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	return fileMutexes.lock(ctx, id, time.Now().Add(wait))
+}
+
+func (fileMutexes *FileMutexes) lock(ctx context.Context, id any, deadline time.Time) (ok bool, absent bool, err error) {
+	for {
+		file, err := os.OpenFile(fileMutexes.lockFilePath(id), os.O_RDWR, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, true, nil
+			}
+			return false, false, err
+		}
+		ok, removed, err := fileMutexes.acquire(ctx, id, file, deadline)
+		//等待的时候文件被释放锁的人删除了，重新打开
+		if !removed {
+			return ok, false, err
+		}
+	}
+}
+
+func (fileMutexes *FileMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	file, err := os.OpenFile(fileMutexes.lockFilePath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	//创建和flock之间文件可能被别人锁住、释放并删除，这时当作已经被别人创建
+	ok, _, err = fileMutexes.acquire(ctx, id, file, time.Time{})
+	return ok, err
+}
+
+//非阻塞地尝试flock，直到成功、ctx结束或者到了deadline，deadline为零值表示一直等。
+//flock成功但是路径上已经不是这个文件时removed为true
+func (fileMutexes *FileMutexes) acquire(ctx context.Context, id any, file *os.File, deadline time.Time) (ok bool, removed bool, err error) {
+	wait := time.Millisecond
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			file.Close()
+			return false, false, err
+		}
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				file.Close()
+				return false, false, nil
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return false, false, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait < 50*time.Millisecond {
+			wait *= 2
+		}
+	}
+	same, err := sameFile(file, fileMutexes.lockFilePath(id))
+	if err != nil || !same {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+		return false, err == nil, err
+	}
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	fileMutexes.mutex.Lock()
+	fileMutexes.held[id] = file
+	fileMutexes.mutex.Unlock()
+	return true, false, nil
+}
+
+//路径上是否还是打开的这个文件，文件被删除时返回false
+func sameFile(file *os.File, path string) (bool, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(fileInfo, pathInfo), nil
+}
+
+func (fileMutexes *FileMutexes) UnlockAll(ctx context.Context, ids []any) {
+	fileMutexes.mutex.Lock()
+	defer fileMutexes.mutex.Unlock()
+	for _, id := range ids {
+		file := fileMutexes.held[id]
+		if file == nil {
+			continue
+		}
+		delete(fileMutexes.held, id)
+		//持有flock时删除，等待者flock成功之后会发现文件已经不在了
+		os.Remove(fileMutexes.lockFilePath(id))
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+func NewFileMutexes(dir string) (*FileMutexes, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileMutexes{dir: dir, held: make(map[any]*os.File)}, nil
+}
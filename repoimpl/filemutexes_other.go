@@ -0,0 +1,34 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package repoimpl
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errFileMutexesUnsupported = errors.New("file mutexes are not supported on this platform")
+
+//当前平台不支持flock
+type FileMutexes struct {
+}
+
+func (fileMutexes *FileMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	return false, false, errFileMutexesUnsupported
+}
+
+func (fileMutexes *FileMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	return false, false, errFileMutexesUnsupported
+}
+
+func (fileMutexes *FileMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	return false, errFileMutexesUnsupported
+}
+
+func (fileMutexes *FileMutexes) UnlockAll(ctx context.Context, ids []any) {
+}
+
+func NewFileMutexes(dir string) (*FileMutexes, error) {
+	return nil, errFileMutexesUnsupported
+}
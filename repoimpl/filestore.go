@@ -0,0 +1,478 @@
+package repoimpl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//写预写日志(WAL)之后何时fsync
+type FsyncPolicy int
+
+const (
+	//每一批写入之后都fsync，最安全也最慢
+	FsyncAlways FsyncPolicy = iota
+	//定时fsync，崩溃时可能丢失最后一个间隔内的写入
+	FsyncInterval
+	//不主动fsync，交给操作系统
+	FsyncNever
+)
+
+//WAL中间的记录损坏，打开FileStore时返回，需要人工处理
+var ErrCorruptedWal = errors.New("corrupted record in the middle of WAL")
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+	//4字节长度、4字节长度的校验和、4字节内容的校验和
+	walHeaderSize = 12
+)
+
+type fileStoreOptions struct {
+	fsyncPolicy      FsyncPolicy
+	fsyncInterval    time.Duration
+	compactThreshold int
+}
+
+type FileStoreOption func(options *fileStoreOptions)
+
+func WithFsyncPolicy(policy FsyncPolicy) FileStoreOption {
+	return func(options *fileStoreOptions) {
+		options.fsyncPolicy = policy
+	}
+}
+
+//FsyncInterval策略下fsync的间隔
+func WithFsyncInterval(interval time.Duration) FileStoreOption {
+	return func(options *fileStoreOptions) {
+		options.fsyncInterval = interval
+	}
+}
+
+//WAL中的记录数达到threshold时把全部数据压缩成快照，并清空WAL
+func WithCompactThreshold(threshold int) FileStoreOption {
+	return func(options *fileStoreOptions) {
+		options.compactThreshold = threshold
+	}
+}
+
+//基于文件的持久化store。每次SaveAll、RemoveAll作为一批追加到带校验和的WAL中，打开时用快照加WAL重建数据，
+//WAL记录数达到阈值时压缩成快照。实体用打开时指定的codec编码。
+//id按util.Strval转成字符串作为key，所以1和"1"是同一个实体，id的类型应该保持一致。
+//从文件恢复的id中整数解码为int，其余按json默认的方式解码
+type FileStore[T any] struct {
+	dir        string
+	codec      arp.Codec[T]
+	options    fileStoreOptions
+	mutex      sync.RWMutex
+	data       map[string][]byte
+	ids        map[string]any
+	wal        *os.File
+	walRecords int
+	dirty      bool
+	stopSync   chan struct{}
+	closed     bool
+}
+
+//WAL中的一批写入
+type walBatch struct {
+	Puts    []walPut          `json:"puts,omitempty"`
+	Removes []json.RawMessage `json:"removes,omitempty"`
+}
+
+type walPut struct {
+	Id     json.RawMessage `json:"id"`
+	Entity []byte          `json:"entity"`
+	//写入时的原始id，从文件恢复时为nil
+	id any
+}
+
+type fileSnapshot struct {
+	Entities []walPut `json:"entities"`
+}
+
+func (store *FileStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	store.mutex.RLock()
+	data, found := store.data[util.Strval(id)]
+	store.mutex.RUnlock()
+	if !found {
+		return entity, false, nil
+	}
+	if entity, err = store.codec.Decode(data); err != nil {
+		return entity, false, err
+	}
+	return entity, true, nil
+}
+
+func (store *FileStore[T]) Save(ctx context.Context, id any, entity T) error {
+	return store.SaveAll(ctx, map[any]any{id: entity}, nil)
+}
+
+func (store *FileStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	if len(entitiesToInsert) == 0 && len(entitiesToUpdate) == 0 {
+		return nil
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	batch := &walBatch{}
+	for k, v := range entitiesToInsert {
+		if _, ok := store.data[util.Strval(k)]; ok {
+			return errors.New("can not 'Save' since entity already exists")
+		}
+		put, err := store.newWalPut(k, v.(T))
+		if err != nil {
+			return err
+		}
+		batch.Puts = append(batch.Puts, put)
+	}
+	for k, v := range entitiesToUpdate {
+		put, err := store.newWalPut(k, v.Entity().(T))
+		if err != nil {
+			return err
+		}
+		batch.Puts = append(batch.Puts, put)
+	}
+	return store.write(batch)
+}
+
+func (store *FileStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	batch := &walBatch{}
+	for _, id := range ids {
+		idJson, err := json.Marshal(id)
+		if err != nil {
+			return err
+		}
+		batch.Removes = append(batch.Removes, idJson)
+	}
+	return store.write(batch)
+}
+
+func (store *FileStore[T]) newWalPut(id any, entity T) (walPut, error) {
+	idJson, err := json.Marshal(id)
+	if err != nil {
+		return walPut{}, err
+	}
+	data, err := store.codec.Encode(entity)
+	if err != nil {
+		return walPut{}, err
+	}
+	return walPut{idJson, data, id}, nil
+}
+
+//先写WAL再改内存，写WAL失败时内存中的数据不变
+func (store *FileStore[T]) write(batch *walBatch) error {
+	if store.closed {
+		return errors.New("file store closed")
+	}
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[0:4]))
+	binary.LittleEndian.PutUint32(record[8:12], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+	offset, err := store.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = store.wal.Write(record); err != nil {
+		//去掉写了一半的记录
+		store.truncateWal(offset)
+		return err
+	}
+	if store.options.fsyncPolicy == FsyncAlways {
+		if err = store.wal.Sync(); err != nil {
+			//过程会被放弃，记录不能留在WAL中，否则重启之后就变成已提交了
+			store.truncateWal(offset)
+			return err
+		}
+	} else {
+		store.dirty = true
+	}
+	store.apply(batch)
+	store.walRecords++
+	//这一批已经写入WAL，压缩失败不影响它，记录日志，下一次写入时再压缩
+	if store.options.compactThreshold > 0 && store.walRecords >= store.options.compactThreshold {
+		if err = store.compact(); err != nil {
+			slog.Error("file store compaction failed", "dir", store.dir, "error", err)
+		}
+	}
+	return nil
+}
+
+func (store *FileStore[T]) truncateWal(offset int64) {
+	store.wal.Truncate(offset)
+	store.wal.Seek(offset, io.SeekStart)
+}
+
+func (store *FileStore[T]) apply(batch *walBatch) {
+	for _, put := range batch.Puts {
+		id := put.id
+		if id == nil {
+			id = decodeId(put.Id)
+		}
+		key := util.Strval(id)
+		store.data[key] = put.Entity
+		store.ids[key] = id
+	}
+	for _, idJson := range batch.Removes {
+		key := util.Strval(decodeId(idJson))
+		delete(store.data, key)
+		delete(store.ids, key)
+	}
+}
+
+//整数的id解码成int，其余的按json默认的方式解码
+func decodeId(idJson json.RawMessage) any {
+	decoder := json.NewDecoder(bytes.NewReader(idJson))
+	decoder.UseNumber()
+	var id any
+	decoder.Decode(&id)
+	if number, ok := id.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := number.Float64()
+		return f
+	}
+	return id
+}
+
+//把全部数据写成快照，然后清空WAL。快照写成功之后、清空WAL之前崩溃也没关系，重放WAL的结果是一样的
+func (store *FileStore[T]) Compact() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.compact()
+}
+
+func (store *FileStore[T]) compact() error {
+	snapshot := fileSnapshot{Entities: make([]walPut, 0, len(store.data))}
+	for key, data := range store.data {
+		idJson, err := json.Marshal(store.ids[key])
+		if err != nil {
+			return err
+		}
+		snapshot.Entities = append(snapshot.Entities, walPut{idJson, data, nil})
+	}
+	snapshotJson, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(store.dir, snapshotFileName), snapshotJson); err != nil {
+		return err
+	}
+	if err = store.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = store.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	store.walRecords = 0
+	return nil
+}
+
+func (store *FileStore[T]) recover() error {
+	snapshotJson, err := os.ReadFile(filepath.Join(store.dir, snapshotFileName))
+	if err == nil {
+		snapshot := fileSnapshot{}
+		if err = json.Unmarshal(snapshotJson, &snapshot); err != nil {
+			return err
+		}
+		store.apply(&walBatch{Puts: snapshot.Entities})
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	walInfo, err := store.wal.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(store.wal)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(header[0:4]) != binary.LittleEndian.Uint32(header[4:8]) {
+			//长度损坏时无法知道记录的边界。崩溃时文件末尾可能是填充的0，其余情况不能丢弃后面的记录
+			zero, err := store.zeroFrom(offset, walInfo.Size())
+			if err != nil {
+				return err
+			}
+			if !zero {
+				return fmt.Errorf("%w at offset %d", ErrCorruptedWal, offset)
+			}
+			break
+		}
+		payloadSize := int64(binary.LittleEndian.Uint32(header[0:4]))
+		end := offset + walHeaderSize + payloadSize
+		//长度是正确的，内容不完整只可能是最后一条记录写到一半
+		if end > walInfo.Size() {
+			break
+		}
+		payload := make([]byte, payloadSize)
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return err
+		}
+		batch := &walBatch{}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[8:12]) || json.Unmarshal(payload, batch) != nil {
+			//只有最后一条记录可能是写到一半崩溃的，中间的记录损坏时不能丢弃后面已提交的记录
+			if end < walInfo.Size() {
+				return fmt.Errorf("%w at offset %d", ErrCorruptedWal, offset)
+			}
+			break
+		}
+		store.apply(batch)
+		store.walRecords++
+		offset = end
+	}
+	//最后一条记录不完整或者损坏，说明是写到一半崩溃了，丢弃它
+	if err = store.wal.Truncate(offset); err != nil {
+		return err
+	}
+	_, err = store.wal.Seek(offset, io.SeekStart)
+	return err
+}
+
+//WAL从offset到size是否都是0
+func (store *FileStore[T]) zeroFrom(offset int64, size int64) (bool, error) {
+	rest := make([]byte, size-offset)
+	if _, err := store.wal.ReadAt(rest, offset); err != nil {
+		return false, err
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (store *FileStore[T]) syncPeriodically() {
+	ticker := time.NewTicker(store.options.fsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.stopSync:
+			return
+		case <-ticker.C:
+			store.mutex.Lock()
+			if store.dirty && !store.closed {
+				store.wal.Sync()
+				store.dirty = false
+			}
+			store.mutex.Unlock()
+		}
+	}
+}
+
+func (store *FileStore[T]) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		return nil
+	}
+	store.closed = true
+	if store.stopSync != nil {
+		close(store.stopSync)
+	}
+	if err := store.wal.Sync(); err != nil {
+		store.wal.Close()
+		return err
+	}
+	return store.wal.Close()
+}
+
+func (store *FileStore[T]) QueryAllIds(ctx context.Context) (ids []any, err error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	ids = make([]any, 0, len(store.ids))
+	for _, id := range store.ids {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (store *FileStore[T]) Count(ctx context.Context) (uint64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return uint64(len(store.data)), nil
+}
+
+func (store *FileStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var entities []T
+	for _, data := range store.data {
+		entity, err := store.codec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		if fieldEquals(entity, fieldName, fieldValue) {
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
+func (store *FileStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var ids []any
+	for key, data := range store.data {
+		entity, err := store.codec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		if fieldEquals(entity, fieldName, fieldValue) {
+			ids = append(ids, store.ids[key])
+		}
+	}
+	return ids, nil
+}
+
+func OpenFileStore[T any](dir string, codec arp.Codec[T], opts ...FileStoreOption) (*FileStore[T], error) {
+	options := fileStoreOptions{fsyncPolicy: FsyncAlways, fsyncInterval: time.Second, compactThreshold: 1000}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileStore[T]{dir: dir, codec: codec, options: options, data: make(map[string][]byte), ids: make(map[string]any), wal: wal}
+	if err = store.recover(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	if options.fsyncPolicy == FsyncInterval {
+		store.stopSync = make(chan struct{})
+		go store.syncPeriodically()
+	}
+	return store, nil
+}
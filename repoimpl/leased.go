@@ -0,0 +1,151 @@
+package repoimpl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//时间来源，测试时可以用假的时钟控制租约过期
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct {
+}
+
+func (clock systemClock) Now() time.Time {
+	return time.Now()
+}
+
+//arp.LeasedMutexes的内存实现。只记录正被持有的租约，释放后即删除，
+//和StripedMutexes一样不记录id是否存在，Lock不会返回absent
+type MemLeasedMutexes struct {
+	ttl       time.Duration
+	clock     Clock
+	mutex     sync.Mutex
+	leases    map[any]*lease
+	lastToken uint64
+}
+
+type lease struct {
+	token    uint64
+	expireAt time.Time
+	//租约结束（释放或被别人取代）时关闭
+	released chan struct{}
+}
+
+//等待者检查租约是否到期的间隔
+const leaseCheckInterval = 10 * time.Millisecond
+
+func (leasedMutexes *MemLeasedMutexes) LockLease(ctx context.Context, id any) (token uint64, ok bool, absent bool, err error) {
+	return leasedMutexes.lockLease(ctx, id, time.Time{})
+}
+
+func (leasedMutexes *MemLeasedMutexes) TryLockLease(ctx context.Context, id any, wait time.Duration) (token uint64, ok bool, absent bool, err error) {
+	return leasedMutexes.lockLease(ctx, id, time.Now().Add(wait))
+}
+
+func (leasedMutexes *MemLeasedMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	_, ok, absent, err = leasedMutexes.TryLockLease(ctx, id, wait)
+	return
+}
+
+//deadline为零值表示一直等
+func (leasedMutexes *MemLeasedMutexes) lockLease(ctx context.Context, id any, deadline time.Time) (token uint64, ok bool, absent bool, err error) {
+	for {
+		leasedMutexes.mutex.Lock()
+		now := leasedMutexes.clock.Now()
+		current := leasedMutexes.leases[id]
+		if current == nil || !now.Before(current.expireAt) {
+			if current != nil {
+				close(current.released)
+			}
+			leasedMutexes.lastToken++
+			token = leasedMutexes.lastToken
+			leasedMutexes.leases[id] = &lease{token, now.Add(leasedMutexes.ttl), make(chan struct{})}
+			leasedMutexes.mutex.Unlock()
+			return token, true, false, nil
+		}
+		released := current.released
+		leasedMutexes.mutex.Unlock()
+		wait := leaseCheckInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return 0, false, false, nil
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0, false, false, ctx.Err()
+		case <-released:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (leasedMutexes *MemLeasedMutexes) NewAndLockLease(ctx context.Context, id any) (token uint64, ok bool, err error) {
+	token, ok, _, err = leasedMutexes.LockLease(ctx, id)
+	return
+}
+
+func (leasedMutexes *MemLeasedMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	_, ok, absent, err = leasedMutexes.LockLease(ctx, id)
+	return
+}
+
+func (leasedMutexes *MemLeasedMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	_, ok, err = leasedMutexes.NewAndLockLease(ctx, id)
+	return
+}
+
+func (leasedMutexes *MemLeasedMutexes) Renew(ctx context.Context, ids []any) error {
+	leasedMutexes.mutex.Lock()
+	defer leasedMutexes.mutex.Unlock()
+	now := leasedMutexes.clock.Now()
+	var err error
+	for _, id := range ids {
+		token, _ := arp.FencingToken(ctx, id)
+		current := leasedMutexes.leases[id]
+		if current == nil || current.token != token || !now.Before(current.expireAt) {
+			err = arp.ErrLeaseExpired
+			continue
+		}
+		current.expireAt = now.Add(leasedMutexes.ttl)
+	}
+	return err
+}
+
+//ctx中带有token时，只释放token相符的租约，不会误释放租约过期后别人获得的锁
+func (leasedMutexes *MemLeasedMutexes) UnlockAll(ctx context.Context, ids []any) {
+	leasedMutexes.mutex.Lock()
+	defer leasedMutexes.mutex.Unlock()
+	for _, id := range ids {
+		current := leasedMutexes.leases[id]
+		if current == nil {
+			continue
+		}
+		if token, ok := arp.FencingToken(ctx, id); ok && token != current.token {
+			continue
+		}
+		delete(leasedMutexes.leases, id)
+		close(current.released)
+	}
+}
+
+func (leasedMutexes *MemLeasedMutexes) LeaseTTL() time.Duration {
+	return leasedMutexes.ttl
+}
+
+func NewMemLeasedMutexes(ttl time.Duration, clock Clock) *MemLeasedMutexes {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &MemLeasedMutexes{ttl: ttl, clock: clock, leases: make(map[any]*lease)}
+}
@@ -5,13 +5,40 @@ import (
 	"errors"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/util"
 )
 
 type MemStore[T any] struct {
 	data         sync.Map
 	typeFullname string
+	//每个id见过的最大fencing token，用来拒绝租约已过期的持有者的写入
+	fencingMutex  sync.Mutex
+	fencingTokens map[any]uint64
+}
+
+//检查ctx中的fencing token，全部通过后才记录，保证一批写入要么全部被拒绝要么全部通过
+func (store *MemStore[T]) checkFencingTokens(ctx context.Context, ids []any) error {
+	tokens := make(map[any]uint64)
+	for _, id := range ids {
+		token, ok := arp.FencingToken(ctx, id)
+		if !ok {
+			continue
+		}
+		if token < store.fencingTokens[id] {
+			return arp.ErrStaleFencingToken
+		}
+		tokens[id] = token
+	}
+	if len(tokens) > 0 && store.fencingTokens == nil {
+		store.fencingTokens = make(map[any]uint64)
+	}
+	for id, token := range tokens {
+		store.fencingTokens[id] = token
+	}
+	return nil
 }
 
 func (store *MemStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
@@ -23,6 +50,11 @@ func (store *MemStore[T]) Load(ctx context.Context, id any) (entity T, found boo
 }
 
 func (store *MemStore[T]) Save(ctx context.Context, id any, entity T) error {
+	store.fencingMutex.Lock()
+	defer store.fencingMutex.Unlock()
+	if err := store.checkFencingTokens(ctx, []any{id}); err != nil {
+		return err
+	}
 	if _, ok := store.data.Load(id); ok {
 		return errors.New("can not 'Save' since entity already exists")
 	}
@@ -31,6 +63,18 @@ func (store *MemStore[T]) Save(ctx context.Context, id any, entity T) error {
 }
 
 func (store *MemStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	store.fencingMutex.Lock()
+	defer store.fencingMutex.Unlock()
+	ids := make([]any, 0, len(entitiesToInsert)+len(entitiesToUpdate))
+	for k := range entitiesToInsert {
+		ids = append(ids, k)
+	}
+	for k := range entitiesToUpdate {
+		ids = append(ids, k)
+	}
+	if err := store.checkFencingTokens(ctx, ids); err != nil {
+		return err
+	}
 	for k, v := range entitiesToInsert {
 		if _, ok := store.data.Load(k); ok {
 			return errors.New("can not 'Save' since entity already exists")
@@ -44,49 +88,159 @@ func (store *MemStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]
 }
 
 func (store *MemStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	store.fencingMutex.Lock()
+	defer store.fencingMutex.Unlock()
+	if err := store.checkFencingTokens(ctx, ids); err != nil {
+		return err
+	}
 	for _, id := range ids {
 		store.data.Delete(id)
 	}
 	return nil
 }
 
+func (store *MemStore[T]) QueryAllIds(ctx context.Context) (ids []any, err error) {
+	store.data.Range(func(key, value any) bool {
+		ids = append(ids, key)
+		return true
+	})
+	return ids, nil
+}
+
+func (store *MemStore[T]) Count(ctx context.Context) (uint64, error) {
+	var count uint64
+	store.data.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+func (store *MemStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	var entities []T
+	store.data.Range(func(key, value any) bool {
+		if fieldEquals(value, fieldName, fieldValue) {
+			entities = append(entities, arp.CopyEntity(store.typeFullname, value).(T))
+		}
+		return true
+	})
+	return entities, nil
+}
+
+func (store *MemStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error) {
+	var ids []any
+	store.data.Range(func(key, value any) bool {
+		if fieldEquals(value, fieldName, fieldValue) {
+			ids = append(ids, key)
+		}
+		return true
+	})
+	return ids, nil
+}
+
+func fieldEquals(entity any, fieldName string, fieldValue any) bool {
+	value, ok := util.FieldValue(entity, fieldName)
+	return ok && reflect.DeepEqual(value, fieldValue)
+}
+
+//每个id一把锁，锁的引用计数（持有者加等待者）归零时删除，这样不再使用的锁不会一直占用内存
 type MemMutexes struct {
-	mutexes sync.Map
+	mutex   sync.Mutex
+	mutexes map[any]*refCountedMutex
+}
+
+type refCountedMutex struct {
+	sync.Mutex
+	refs int
 }
 
 func (memMutexes *MemMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
-	mutex, loadOk := memMutexes.mutexes.Load(id)
-	if !loadOk {
+	memMutexes.mutex.Lock()
+	mutex := memMutexes.mutexes[id]
+	if mutex == nil {
+		memMutexes.mutex.Unlock()
 		return false, true, nil
 	}
-	//将来要支持try次数后失败
-	mutex.(*sync.Mutex).Lock()
+	mutex.refs++
+	memMutexes.mutex.Unlock()
+	mutex.Lock()
 	return true, false, nil
 }
 
+func (memMutexes *MemMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	memMutexes.mutex.Lock()
+	mutex := memMutexes.mutexes[id]
+	if mutex == nil {
+		memMutexes.mutex.Unlock()
+		return false, true, nil
+	}
+	mutex.refs++
+	memMutexes.mutex.Unlock()
+	ok, err = tryUntil(ctx, wait, mutex.TryLock)
+	if !ok {
+		memMutexes.mutex.Lock()
+		mutex.refs--
+		if mutex.refs == 0 {
+			delete(memMutexes.mutexes, id)
+		}
+		memMutexes.mutex.Unlock()
+	}
+	return ok, false, err
+}
+
 func (memMutexes *MemMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
-	mutex, loaded := memMutexes.mutexes.LoadOrStore(id, &sync.Mutex{})
-	if loaded {
+	memMutexes.mutex.Lock()
+	defer memMutexes.mutex.Unlock()
+	if memMutexes.mutexes[id] != nil {
 		return false, nil
 	}
-	(mutex.(*sync.Mutex)).Lock()
+	if memMutexes.mutexes == nil {
+		memMutexes.mutexes = make(map[any]*refCountedMutex)
+	}
+	mutex := &refCountedMutex{refs: 1}
+	mutex.Lock()
+	memMutexes.mutexes[id] = mutex
 	return true, nil
 }
 
 func (memMutexes *MemMutexes) UnlockAll(ctx context.Context, ids []any) {
+	memMutexes.mutex.Lock()
+	defer memMutexes.mutex.Unlock()
 	for _, id := range ids {
-		mutex, ok := memMutexes.mutexes.Load(id)
-		if ok {
-			mutex.(*sync.Mutex).Unlock()
+		mutex := memMutexes.mutexes[id]
+		if mutex == nil {
+			continue
+		}
+		mutex.Unlock()
+		mutex.refs--
+		if mutex.refs == 0 {
+			delete(memMutexes.mutexes, id)
 		}
 	}
 }
 
-func NewMemRepository[T any](newZeroEntity arp.NewZeroEntity[T]) arp.Repository[T] {
+//当前还存在的锁的数量
+func (memMutexes *MemMutexes) Len() int {
+	memMutexes.mutex.Lock()
+	defer memMutexes.mutex.Unlock()
+	return len(memMutexes.mutexes)
+}
+
+func NewMemMutexes() *MemMutexes {
+	return &MemMutexes{mutexes: make(map[any]*refCountedMutex)}
+}
+
+func NewMemStore[T any](newZeroEntity arp.NewZeroEntity[T]) *MemStore[T] {
 	zeroEntity := newZeroEntity()
 	entityType := reflect.TypeOf(zeroEntity).Elem()
 	typeFullname := entityType.PkgPath() + "." + entityType.Name()
-	store := &MemStore[T]{typeFullname: typeFullname}
-	mutexes := &MemMutexes{}
-	return arp.NewRepository[T](store, mutexes, newZeroEntity)
+	return &MemStore[T]{typeFullname: typeFullname}
+}
+
+func NewMemRepository[T any](newZeroEntity arp.NewZeroEntity[T], opts ...arp.RepositoryOption) arp.Repository[T] {
+	return arp.NewRepository[T](NewMemStore(newZeroEntity), NewMemMutexes(), newZeroEntity, opts...)
+}
+
+func NewMemQueryRepository[T any](newZeroEntity arp.NewZeroEntity[T], opts ...arp.RepositoryOption) arp.QueryRepository[T] {
+	return arp.NewQueryRepository[T](NewMemStore(newZeroEntity), NewMemMutexes(), newZeroEntity, opts...)
 }
@@ -0,0 +1,139 @@
+package repoimpl
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//固定数量的分段，id按hash分到某一段，每一段用一个互斥量保护本段中被持有的id，内存占用只和段数以及同时被持有的id数有关。
+//段的互斥量只在检查和修改持有记录时短暂持有，等待的时候不持有，所以一个过程锁住同一段里的多个id也不会死锁，
+//等待者也只在自己等待的id被释放时才被唤醒。
+//一个过程需要多个实体时用仓库的TakeAll，LockAll按段的序号加锁，不同过程锁有交集的多组id不会互相死锁；
+//逐个Take时和MemMutexes一样，需要由业务按固定的顺序取出实体。
+//StripedMutexes不记录id是否存在，Lock不会返回absent，由仓库加锁后检查entity是否存在
+type StripedMutexes struct {
+	stripes []*mutexStripe
+}
+
+type mutexStripe struct {
+	mutex sync.Mutex
+	//被持有的id，释放时关闭对应的channel，唤醒等待这个id的过程
+	held map[any]chan struct{}
+}
+
+func (stripedMutexes *StripedMutexes) stripeIndex(id any) int {
+	h := fnv.New32a()
+	h.Write([]byte(util.Strval(id)))
+	return int(h.Sum32() % uint32(len(stripedMutexes.stripes)))
+}
+
+func (stripedMutexes *StripedMutexes) stripe(id any) *mutexStripe {
+	return stripedMutexes.stripes[stripedMutexes.stripeIndex(id)]
+}
+
+//获得id的锁，stop关闭时放弃等待并返回false
+func (stripedMutexes *StripedMutexes) lock(id any, stop <-chan struct{}) bool {
+	stripe := stripedMutexes.stripe(id)
+	for {
+		stripe.mutex.Lock()
+		released, held := stripe.held[id]
+		if !held {
+			stripe.held[id] = make(chan struct{})
+			stripe.mutex.Unlock()
+			return true
+		}
+		stripe.mutex.Unlock()
+		select {
+		case <-released:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func (stripedMutexes *StripedMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	if !stripedMutexes.lock(id, ctx.Done()) {
+		return false, false, ctx.Err()
+	}
+	return true, false, nil
+}
+
+func (stripedMutexes *StripedMutexes) TryLock(ctx context.Context, id any, wait time.Duration) (ok bool, absent bool, err error) {
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	if stripedMutexes.lock(id, waitCtx.Done()) {
+		return true, false, nil
+	}
+	return false, false, ctx.Err()
+}
+
+func (stripedMutexes *StripedMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	if !stripedMutexes.lock(id, ctx.Done()) {
+		return false, ctx.Err()
+	}
+	return true, nil
+}
+
+//按段的序号加锁，同一段里按id的类型和字符串排序，所有过程都按同一个顺序，所以不会互相死锁。
+//ctx结束时释放已经得到的锁，返回ctx的错误
+func (stripedMutexes *StripedMutexes) LockAll(ctx context.Context, ids []any) error {
+	type orderedId struct {
+		id    any
+		index int
+		key   string
+	}
+	ordered := make([]orderedId, 0, len(ids))
+	seen := make(map[any]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			ordered = append(ordered, orderedId{id, stripedMutexes.stripeIndex(id), fmt.Sprintf("%T:%s", id, util.Strval(id))})
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].index != ordered[j].index {
+			return ordered[i].index < ordered[j].index
+		}
+		return ordered[i].key < ordered[j].key
+	})
+	for i, oid := range ordered {
+		if !stripedMutexes.lock(oid.id, ctx.Done()) {
+			locked := make([]any, i)
+			for j := range locked {
+				locked[j] = ordered[j].id
+			}
+			stripedMutexes.UnlockAll(ctx, locked)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (stripedMutexes *StripedMutexes) UnlockAll(ctx context.Context, ids []any) {
+	for _, id := range ids {
+		stripe := stripedMutexes.stripe(id)
+		stripe.mutex.Lock()
+		if released, held := stripe.held[id]; held {
+			delete(stripe.held, id)
+			close(released)
+		}
+		stripe.mutex.Unlock()
+	}
+}
+
+func NewStripedMutexes(stripeCount int) *StripedMutexes {
+	if stripeCount <= 0 {
+		stripeCount = 1
+	}
+	stripes := make([]*mutexStripe, stripeCount)
+	for i := range stripes {
+		stripes[i] = &mutexStripe{held: make(map[any]chan struct{})}
+	}
+	return &StripedMutexes{stripes}
+}
@@ -0,0 +1,32 @@
+package repoimpl
+
+import (
+	"context"
+	"time"
+)
+
+//在wait时间内反复调用try，直到成功、超时或者ctx结束
+func tryUntil(ctx context.Context, wait time.Duration, try func() bool) (bool, error) {
+	deadline := time.Now().Add(wait)
+	interval := time.Millisecond
+	for {
+		if try() {
+			return true, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval < 10*time.Millisecond {
+			interval *= 2
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/codec"
+)
+
+//数据的版本比当前注册的版本还新，通常是用旧版本的程序读取了新版本写入的数据
+var ErrUnknownVersion = errors.New("schema: unknown schema version")
+
+//以$开头，不会和codec.ToDocument生成的字段名冲突（Go的字段名不能包含$），所以没有版本信息的文档不会被当作带版本的
+const (
+	versionKey = "$schemaVersion"
+	entityKey  = "$entity"
+)
+
+//把某个版本的实体文档升级到下一个版本。文档的格式见codec.ToDocument，其中的数字可能是任意整数、浮点数类型或者json.Number，
+//可以直接修改传入的文档并返回
+type Upcaster func(doc map[string]any) (map[string]any, error)
+
+//key是实体的类型全名，value是从某个版本升级到下一个版本的Upcaster
+var upcasters map[string]map[int]Upcaster = make(map[string]map[int]Upcaster)
+
+func typeFullname[T any]() string {
+	entityType := reflect.TypeOf((*T)(nil)).Elem()
+	if entityType.Kind() == reflect.Pointer {
+		entityType = entityType.Elem()
+	}
+	return entityType.PkgPath() + "." + entityType.Name()
+}
+
+//注册实体T从fromVersion升级到fromVersion+1的Upcaster，版本从1开始，需要在程序启动时注册。
+//实体的当前版本是从1开始连续注册的最后一个版本加1，没有注册过的实体版本是1
+func RegisterUpcaster[T any](fromVersion int, upcaster Upcaster) {
+	if fromVersion < 1 {
+		panic(fmt.Sprintf("schema: invalid version %d", fromVersion))
+	}
+	entityType := typeFullname[T]()
+	if upcasters[entityType] == nil {
+		upcasters[entityType] = make(map[int]Upcaster)
+	}
+	upcasters[entityType][fromVersion] = upcaster
+}
+
+//实体T的当前版本
+func CurrentVersion[T any]() int {
+	return currentVersion(typeFullname[T]())
+}
+
+//按类型全名取得实体的当前版本
+func CurrentVersionOf(entityType string) int {
+	return currentVersion(entityType)
+}
+
+func currentVersion(entityType string) int {
+	version := 1
+	for upcasters[entityType][version] != nil {
+		version++
+	}
+	return version
+}
+
+//把实体T的文档从version升级到当前版本
+func Upcast[T any](version int, doc map[string]any) (map[string]any, error) {
+	return upcast(typeFullname[T](), version, doc)
+}
+
+func upcast(entityType string, version int, doc map[string]any) (map[string]any, error) {
+	current := currentVersion(entityType)
+	if version < 1 || version > current {
+		return nil, fmt.Errorf("%w %d of %s", ErrUnknownVersion, version, entityType)
+	}
+	for ; version < current; version++ {
+		var err error
+		if doc, err = upcasters[entityType][version](doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+//带版本的编解码，保存时把实体文档和当前版本一起编码，加载时先用注册的Upcaster把文档升级到当前版本再解码成实体。
+//没有版本信息的数据（比如直接用codec.JSONCodec保存的）当作版本1。docCodec决定最终的字节格式
+type VersionedCodec[T any] struct {
+	docCodec arp.Codec[map[string]any]
+}
+
+func (versionedCodec *VersionedCodec[T]) Encode(entity T) ([]byte, error) {
+	envelope, err := wrap[T](entity)
+	if err != nil {
+		return nil, err
+	}
+	return versionedCodec.docCodec.Encode(envelope)
+}
+
+func (versionedCodec *VersionedCodec[T]) Decode(data []byte) (entity T, err error) {
+	envelope, err := versionedCodec.docCodec.Decode(data)
+	if err != nil {
+		return entity, err
+	}
+	return unwrapEntity[T](envelope)
+}
+
+//实体文档和当前版本放在一起
+func wrap[T any](entity T) (map[string]any, error) {
+	doc, err := codec.ToDocument(entity)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{versionKey: CurrentVersion[T](), entityKey: doc}, nil
+}
+
+//升级到当前版本再转换成实体
+func unwrapEntity[T any](envelope map[string]any) (entity T, err error) {
+	version, doc, err := unwrap(envelope)
+	if err != nil {
+		return entity, err
+	}
+	if doc, err = Upcast[T](version, doc); err != nil {
+		return entity, err
+	}
+	err = codec.FromDocument(doc, &entity)
+	return entity, err
+}
+
+func unwrap(envelope map[string]any) (version int, doc map[string]any, err error) {
+	versionDoc, hasVersion := envelope[versionKey]
+	if !hasVersion {
+		return 1, envelope, nil
+	}
+	entityDoc := envelope[entityKey]
+	if err = codec.FromDocument(versionDoc, &version); err != nil {
+		return 0, nil, err
+	}
+	if entityDoc == nil {
+		return version, nil, nil
+	}
+	doc, ok := entityDoc.(map[string]any)
+	if !ok {
+		return 0, nil, fmt.Errorf("schema: unexpected entity document %T", entityDoc)
+	}
+	return version, doc, nil
+}
+
+func NewVersionedCodec[T any](docCodec arp.Codec[map[string]any]) *VersionedCodec[T] {
+	return &VersionedCodec[T]{docCodec}
+}
+
+//离线迁移，把store中的全部实体改写成当前版本。store需要使用VersionedCodec或者是VersionedStore，这样加载的时候实体已经被升级，
+//再保存回去就以当前版本保存了。每batchSize个实体一批保存，迁移期间不能有其他进程写这个store
+func Migrate[T any](ctx context.Context, store arp.QueryStore[T], batchSize int) (migrated int, err error) {
+	ids, err := store.QueryAllIds(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return inBatches(ids, batchSize, func(ids []any) (int, error) {
+		entitiesToUpdate := make(map[any]*arp.ProcessEntity, len(ids))
+		for _, id := range ids {
+			entity, found, err := store.Load(ctx, id)
+			if err != nil {
+				return 0, err
+			}
+			if found {
+				entitiesToUpdate[id] = arp.NewTakenProcessEntity(nil, entity)
+			}
+		}
+		return len(entitiesToUpdate), store.SaveAll(ctx, nil, entitiesToUpdate)
+	})
+}
+
+//离线迁移保存文档的store（比如VersionedStore装饰的store），把entityType的全部文档升级到当前版本再保存回去，
+//不需要实体的类型，供cmd/arpmigrate使用。和Migrate一样每batchSize个一批保存，迁移期间不能有其他进程写这个store
+func MigrateDocuments(ctx context.Context, entityType string, docStore arp.QueryStore[map[string]any], batchSize int) (migrated int, err error) {
+	current := currentVersion(entityType)
+	ids, err := docStore.QueryAllIds(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return inBatches(ids, batchSize, func(ids []any) (int, error) {
+		docsToUpdate := make(map[any]*arp.ProcessEntity, len(ids))
+		for _, id := range ids {
+			envelope, found, err := docStore.Load(ctx, id)
+			if err != nil {
+				return 0, err
+			}
+			if !found {
+				continue
+			}
+			version, doc, err := unwrap(envelope)
+			if err != nil {
+				return 0, err
+			}
+			if doc, err = upcast(entityType, version, doc); err != nil {
+				return 0, err
+			}
+			docsToUpdate[id] = arp.NewTakenProcessEntity(nil, map[string]any{versionKey: current, entityKey: doc})
+		}
+		return len(docsToUpdate), docStore.SaveAll(ctx, nil, docsToUpdate)
+	})
+}
+
+//每batchSize个id一批调用migrateBatch，出错时返回之前的批次迁移的数量
+func inBatches(ids []any, batchSize int, migrateBatch func(ids []any) (int, error)) (migrated int, err error) {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		n, err := migrateBatch(ids[start:end])
+		if err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+	return migrated, nil
+}
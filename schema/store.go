@@ -0,0 +1,123 @@
+package schema
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/util"
+)
+
+//带版本的store装饰器，被装饰的docStore保存文档（比如文档数据库的store，或者用codec.JSONCodec的FileStore）。
+//加载时先用注册的Upcaster把文档升级到当前版本再转换成实体，保存时把实体文档和当前版本一起保存。
+//和VersionedCodec不同，不要求store基于codec，任何保存map[string]any的store都可以
+type VersionedStore[T any] struct {
+	docStore arp.Store[map[string]any]
+}
+
+func (store *VersionedStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	envelope, found, err := store.docStore.Load(ctx, id)
+	if err != nil || !found {
+		return entity, found, err
+	}
+	entity, err = unwrapEntity[T](envelope)
+	if err != nil {
+		return entity, false, err
+	}
+	return entity, true, nil
+}
+
+func (store *VersionedStore[T]) Save(ctx context.Context, id any, entity T) error {
+	envelope, err := wrap(entity)
+	if err != nil {
+		return err
+	}
+	return store.docStore.Save(ctx, id, envelope)
+}
+
+func (store *VersionedStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	docsToInsert := make(map[any]any, len(entitiesToInsert))
+	for id, entity := range entitiesToInsert {
+		envelope, err := wrap(entity.(T))
+		if err != nil {
+			return err
+		}
+		docsToInsert[id] = envelope
+	}
+	docsToUpdate := make(map[any]*arp.ProcessEntity, len(entitiesToUpdate))
+	for id, processEntity := range entitiesToUpdate {
+		envelope, err := wrap(processEntity.Entity().(T))
+		if err != nil {
+			return err
+		}
+		docsToUpdate[id] = processEntity.WithEntity(envelope)
+	}
+	return store.docStore.SaveAll(ctx, docsToInsert, docsToUpdate)
+}
+
+func (store *VersionedStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	return store.docStore.RemoveAll(ctx, ids)
+}
+
+func (store *VersionedStore[T]) QueryAllIds(ctx context.Context) ([]any, error) {
+	queryStore, ok := store.docStore.(arp.QueryStore[map[string]any])
+	if !ok {
+		return nil, arp.ErrQueryUnsupported
+	}
+	return queryStore.QueryAllIds(ctx)
+}
+
+func (store *VersionedStore[T]) Count(ctx context.Context) (uint64, error) {
+	queryStore, ok := store.docStore.(arp.QueryStore[map[string]any])
+	if !ok {
+		return 0, arp.ErrQueryUnsupported
+	}
+	return queryStore.Count(ctx)
+}
+
+//不同版本的文档中字段可能不同，所以逐个加载升级之后再比较，需要扫描全部实体
+func (store *VersionedStore[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
+	ids, err := store.QueryAllIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entities []T
+	for _, id := range ids {
+		entity, found, err := store.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if value, ok := util.FieldValue(entity, fieldName); ok && reflect.DeepEqual(value, fieldValue) {
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
+func (store *VersionedStore[T]) QueryIdsByField(ctx context.Context, fieldName string, fieldValue any) ([]any, error) {
+	ids, err := store.QueryAllIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []any
+	for _, id := range ids {
+		entity, found, err := store.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if value, ok := util.FieldValue(entity, fieldName); ok && reflect.DeepEqual(value, fieldValue) {
+			matched = append(matched, id)
+		}
+	}
+	return matched, nil
+}
+
+func NewVersionedStore[T any](docStore arp.Store[map[string]any]) *VersionedStore[T] {
+	return &VersionedStore[T]{docStore}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/copy"
+	"github.com/framework-arp/ARP4G/repoimpl"
+	"github.com/framework-arp/ARP4G/test/gen"
+)
+
+func TestArpgenUpToDate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go run")
+	}
+	output := filepath.Join(t.TempDir(), "folder_arpgen.go")
+	cmd := exec.Command("go", "run", "../cmd/arpgen", "-type", "Folder", "-output", output, "-tree", "./gen")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("arpgen failed: %v\n%s", err, out)
+	}
+	generated, err := os.ReadFile(output)
+	AssertNoError(t, err)
+	committed, err := os.ReadFile("gen/folder_arpgen.go")
+	AssertNoError(t, err)
+	AssertTrue(t, bytes.Equal(generated, committed))
+	AssertTrue(t, bytes.Contains(committed, []byte("c.thumbnail = nil\n")))
+
+	//Folder通过children []*Folder引用自己，没有-tree时拒绝生成
+	cmd = exec.Command("go", "run", "../cmd/arpgen", "-type", "Folder", "-output", output, "./gen")
+	out, err := cmd.CombinedOutput()
+	AssertTrue(t, err != nil)
+	AssertTrue(t, bytes.Contains(out, []byte("type Folder references itself through a pointer")))
+}
+
+func TestArpgenDeepCopyAndEqual(t *testing.T) {
+	folder := gen.NewFolder("1", 2, 3)
+	copied := folder.DeepCopy()
+	AssertTrue(t, copied != folder)
+	AssertTrue(t, reflect.DeepEqual(folder, copied))
+	AssertTrue(t, folder.Equal(copied))
+
+	copied.TouchDeepest()
+	AssertFalse(t, reflect.DeepEqual(folder, copied))
+	AssertFalse(t, folder.Equal(copied))
+	AssertTrue(t, reflect.DeepEqual(folder, gen.NewFolder("1", 2, 3)))
+
+	copied = folder.DeepCopy()
+	copied.Rename("renamed")
+	AssertFalse(t, folder.Equal(copied))
+	AssertEqual(t, "folder 1", folder.Name())
+
+	folder.SetQuota(big.NewInt(100))
+	folder.SetThumbnail([]byte{1})
+	copied = folder.DeepCopy()
+	AssertTrue(t, copied.Quota() == folder.Quota())
+	AssertTrue(t, copied.Thumbnail() == nil)
+	AssertTrue(t, folder.Equal(copied))
+	AssertTrue(t, copy.Equal(folder, copied))
+}
+
+func TestArpgenUsedByRepository(t *testing.T) {
+	repo := repoimpl.NewMemRepository(func() *gen.Folder { return &gen.Folder{} })
+	bg := context.Background()
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, "1", gen.NewFolder("1", 1, 2))
+		return nil
+	}))
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		folder, _ := repo.Take(ctx, "1")
+		folder.Rename("renamed")
+		folder.TouchDeepest()
+		return nil
+	}))
+	folder, _ := repo.Find(bg, "1")
+	AssertEqual(t, "renamed", folder.Name())
+	expected := gen.NewFolder("1", 1, 2)
+	expected.Rename("renamed")
+	expected.TouchDeepest()
+	AssertTrue(t, folder.Equal(expected))
+}
+
+func BenchmarkCopyReflective(b *testing.B) {
+	copier := copy.GenerateEntityCopier(reflect.TypeOf(gen.Folder{}), make(map[string]*copy.EntityCopier))
+	folder := gen.NewFolder("1", 3, 4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copier.Copy(folder, &gen.Folder{})
+	}
+}
+
+func BenchmarkCopyGenerated(b *testing.B) {
+	folder := gen.NewFolder("1", 3, 4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		folder.DeepCopy()
+	}
+}
+
+func BenchmarkEqualReflective(b *testing.B) {
+	folder, other := gen.NewFolder("1", 3, 4), gen.NewFolder("1", 3, 4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reflect.DeepEqual(folder, other)
+	}
+}
+
+func BenchmarkEqualGenerated(b *testing.B) {
+	folder, other := gen.NewFolder("1", 3, 4), gen.NewFolder("1", 3, 4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		folder.Equal(other)
+	}
+}
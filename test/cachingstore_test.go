@@ -0,0 +1,208 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/faultinject"
+	"github.com/framework-arp/ARP4G/middleware"
+	"github.com/framework-arp/ARP4G/repoext"
+)
+
+func TestCachingStoreWriteThrough(t *testing.T) {
+	bg := context.Background()
+	metrics := middleware.NewCallMetrics()
+	backing := arp.InterceptStore[*ProductStock](newStockMemStore(), middleware.Measure(metrics))
+	store := repoext.NewCachingStore(backing)
+	repo := newStockRepository(store, nil)
+
+	//不存在的id也被缓存
+	_, found := repo.Find(bg, 1)
+	AssertFalse(t, found)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		return nil
+	}))
+	AssertEqual(t, uint64(1), metrics.Stats("Load").Count)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(3)
+		return nil
+	}))
+	stock, _ := repo.Find(bg, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+	AssertEqual(t, uint64(1), metrics.Stats("Load").Count)
+	AssertEqual(t, uint64(2), metrics.Stats("SaveAll").Count)
+
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Remove(ctx, 1)
+		return nil
+	}))
+	_, found = repo.Find(bg, 1)
+	AssertFalse(t, found)
+	AssertEqual(t, uint64(1), metrics.Stats("Load").Count)
+}
+
+func TestCachingStoreWriteBehind(t *testing.T) {
+	bg := context.Background()
+	metrics := middleware.NewCallMetrics()
+	memStore := newStockMemStore()
+	backing := arp.InterceptStore[*ProductStock](memStore, middleware.Measure(metrics))
+	var mutex sync.Mutex
+	var durable []any
+	store := repoext.NewCachingStore(backing, repoext.WithWriteMode(repoext.WriteBehind), repoext.WithFlushInterval(time.Hour),
+		repoext.WithDurabilityCallback(func(ids []any, err error) {
+			AssertNoError(t, err)
+			mutex.Lock()
+			durable = append(durable, ids...)
+			mutex.Unlock()
+		}))
+	repo := newStockRepository(store, nil)
+
+	//新增之后的修改合并成一次新增
+	for i := 0; i < 3; i++ {
+		AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+			stock := repo.TakeOrPutIfAbsent(ctx, 1, &ProductStock{1, 10})
+			stock.Decrease(1)
+			return nil
+		}))
+	}
+	stock, _ := repo.Find(bg, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+	_, found, _ := memStore.Load(bg, 1)
+	AssertFalse(t, found)
+
+	AssertNoError(t, store.Flush(bg))
+	stock, _, _ = memStore.Load(bg, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+	AssertEqual(t, uint64(1), metrics.Stats("SaveAll").Count)
+	mutex.Lock()
+	AssertEqual(t, 1, len(durable))
+	mutex.Unlock()
+
+	//删除在Close时写入，之后不能再写入
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Remove(ctx, 1)
+		return nil
+	}))
+	_, found = repo.Find(bg, 1)
+	AssertFalse(t, found)
+	AssertNoError(t, store.Close())
+	_, found, _ = memStore.Load(bg, 1)
+	AssertFalse(t, found)
+	AssertEqual(t, repoext.ErrStoreClosed, store.RemoveAll(bg, []any{1}))
+}
+
+func TestCachingStoreWriteBehindQueueFull(t *testing.T) {
+	bg := context.Background()
+	metrics := middleware.NewCallMetrics()
+	memStore := newStockMemStore()
+	backing := arp.InterceptStore[*ProductStock](memStore, middleware.Measure(metrics))
+	store := repoext.NewCachingStore(backing, repoext.WithWriteMode(repoext.WriteBehind), repoext.WithFlushInterval(time.Hour), repoext.WithWriteQueueSize(2))
+	defer store.Close()
+	repo := newStockRepository(store, nil)
+
+	//队列满了之后等待后台写入
+	for id := 1; id <= 5; id++ {
+		AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+			repo.Put(ctx, id, &ProductStock{id, 10})
+			return nil
+		}))
+	}
+	AssertTrue(t, metrics.Stats("SaveAll").Count >= 2)
+	_, found, _ := memStore.Load(bg, 1)
+	AssertTrue(t, found)
+}
+
+//记录每次SaveAll新增的id
+type insertRecordingStore struct {
+	arp.Store[*ProductStock]
+	mutex    sync.Mutex
+	inserted []any
+}
+
+func (store *insertRecordingStore) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	store.mutex.Lock()
+	for id := range entitiesToInsert {
+		store.inserted = append(store.inserted, id)
+	}
+	store.mutex.Unlock()
+	return store.Store.SaveAll(ctx, entitiesToInsert, entitiesToUpdate)
+}
+
+func TestCachingStoreWriteBehindSaveAllFailure(t *testing.T) {
+	bg := context.Background()
+	memStore := newStockMemStore()
+	injector := faultinject.NewInjector(1).Add(faultinject.Rule{Method: "SaveAll", Id: 2, Err: faultinject.ErrInjected})
+	var mutex sync.Mutex
+	durable := make(map[any]error)
+	store := repoext.NewCachingStore(faultinject.Store[*ProductStock](memStore, injector), repoext.WithWriteMode(repoext.WriteBehind), repoext.WithFlushInterval(time.Hour),
+		repoext.WithDurabilityCallback(func(ids []any, err error) {
+			mutex.Lock()
+			for _, id := range ids {
+				durable[id] = err
+			}
+			mutex.Unlock()
+		}))
+	defer store.Close()
+	repo := newStockRepository(store, nil)
+
+	//不相关的过程的修改合并在一批里，一个失败不影响其他的
+	for id := 1; id <= 3; id++ {
+		AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+			repo.Put(ctx, id, &ProductStock{id, 10})
+			return nil
+		}))
+	}
+	AssertTrue(t, store.Flush(bg) != nil)
+	for _, id := range []int{1, 3} {
+		_, found, _ := memStore.Load(bg, id)
+		AssertTrue(t, found)
+	}
+	_, found, _ := memStore.Load(bg, 2)
+	AssertFalse(t, found)
+	_, found = repo.Find(bg, 2)
+	AssertFalse(t, found)
+	mutex.Lock()
+	AssertEqual(t, map[any]error{1: nil, 2: faultinject.ErrInjected, 3: nil}, durable)
+	mutex.Unlock()
+
+	//新增要先看被缓存的store里是否已经存在
+	AssertNoError(t, memStore.Save(bg, 4, &ProductStock{4, 10}))
+	AssertTrue(t, store.Save(bg, 4, &ProductStock{4, 5}) != nil)
+}
+
+func TestCachingStoreWriteBehindRebase(t *testing.T) {
+	bg := context.Background()
+	injector := faultinject.NewInjector(1).Add(faultinject.Rule{Method: "SaveAll", Id: 1, Nth: 1, Latency: 50 * time.Millisecond, Err: faultinject.ErrInjected})
+	backing := &insertRecordingStore{Store: newStockMemStore()}
+	store := repoext.NewCachingStore(faultinject.Store[*ProductStock](backing, injector), repoext.WithWriteMode(repoext.WriteBehind), repoext.WithFlushInterval(time.Hour))
+	defer store.Close()
+	repo := newStockRepository(store, nil)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		return nil
+	}))
+
+	//新增正在写入时修改，新增失败之后修改要当作新增写入
+	flushed := make(chan error)
+	go func() {
+		flushed <- store.Flush(bg)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(1)
+		return nil
+	}))
+	AssertTrue(t, <-flushed != nil)
+	AssertNoError(t, store.Flush(bg))
+	backing.mutex.Lock()
+	AssertEqual(t, []any{1}, backing.inserted)
+	backing.mutex.Unlock()
+	stock, _, _ := backing.Load(bg, 1)
+	AssertEqual(t, 9, stock.freeAmount)
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+type Category struct {
+	id       string
+	name     string
+	parent   *Category
+	children []*Category
+	featured *Category
+	//按值保存的历史版本，元素里还有指针
+	history []Category
+}
+
+func (category *Category) addChild(child *Category) {
+	child.parent = category
+	category.children = append(category.children, child)
+}
+
+func TestCopyRecursiveEntity(t *testing.T) {
+	repo := repoimpl.NewMemRepository(func() *Category { return &Category{} })
+	bg := context.Background()
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		root := &Category{id: "root", name: "root"}
+		root.addChild(&Category{id: "a", name: "a"})
+		root.addChild(&Category{id: "b", name: "b"})
+		root.featured = root.children[1]
+		root.history = []Category{{id: "root", name: "old", children: []*Category{{id: "c", name: "c"}}}}
+		repo.Put(ctx, "root", root)
+		return nil
+	}))
+
+	root, found := repo.Find(bg, "root")
+	AssertTrue(t, found)
+	AssertTrue(t, root.parent == nil)
+	AssertEqual(t, 2, len(root.children))
+	//环和共享的引用在复制之后保持
+	AssertTrue(t, root.children[0].parent == root)
+	AssertTrue(t, root.featured == root.children[1])
+
+	another, _ := repo.Find(bg, "root")
+	AssertTrue(t, another != root)
+	AssertTrue(t, another.children[0] != root.children[0])
+	AssertTrue(t, another.history[0].children[0] != root.history[0].children[0])
+
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		root, _ := repo.Take(ctx, "root")
+		root.featured.name = "b2"
+		root.history[0].children[0].name = "c2"
+		return nil
+	}))
+	root, _ = repo.Find(bg, "root")
+	AssertEqual(t, "b2", root.children[1].name)
+	AssertEqual(t, "c2", root.history[0].children[0].name)
+	AssertEqual(t, "b", another.children[1].name)
+}
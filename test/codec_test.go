@@ -0,0 +1,133 @@
+package test
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/codec"
+)
+
+type Shipment struct {
+	order     *Order
+	createdAt time.Time
+	tags      map[string]int
+	weights   []float64
+	note      *string
+	payload   []byte
+	sizes     [2]uint8
+	//指针接收者的MarshalText
+	total big.Int
+	fee   *big.Int
+}
+
+func newTestShipment() *Shipment {
+	note := "fragile"
+	return &Shipment{
+		order: &Order{id: 1, userId: 7, userAddress: "Beijing", state: 2, items: []OrderItem{
+			{product: Product{id: 11, name: "book", price: 30}, amount: 2},
+			{product: Product{id: 12, name: "pen", price: 5}, amount: 1},
+		}},
+		createdAt: time.Date(2022, 5, 1, 8, 0, 0, 0, time.UTC),
+		tags:      map[string]int{"a": 1, "b": 2},
+		weights:   []float64{1.5, 2.25},
+		note:      &note,
+		payload:   []byte{1, 2, 3},
+		sizes:     [2]uint8{3, 4},
+		total:     *big.NewInt(123456789),
+		fee:       big.NewInt(-42),
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	codecs := map[string]arp.Codec[*Shipment]{
+		"json":   codec.NewJSONCodec[*Shipment](),
+		"gob":    codec.NewGobCodec[*Shipment](),
+		"binary": codec.NewBinaryCodec[*Shipment](),
+	}
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			shipment := newTestShipment()
+			data, err := c.Encode(shipment)
+			AssertNoError(t, err)
+			decoded, err := c.Decode(data)
+			AssertNoError(t, err)
+			AssertTrue(t, reflect.DeepEqual(shipment, decoded))
+
+			//nil的字段解码之后仍然是nil
+			empty, err := c.Decode(mustEncode(t, c, &Shipment{}))
+			AssertNoError(t, err)
+			AssertTrue(t, empty.order == nil && empty.tags == nil && empty.weights == nil && empty.note == nil)
+		})
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	c := codec.NewBinaryCodec[*Shipment]()
+	data := mustEncode(t, c, newTestShipment())
+	for i := 0; i < len(data); i++ {
+		_, err := c.Decode(data[:i])
+		AssertTrue(t, err != nil)
+	}
+}
+
+func mustEncode(t *testing.T, c arp.Codec[*Shipment], shipment *Shipment) []byte {
+	data, err := c.Encode(shipment)
+	AssertNoError(t, err)
+	return data
+}
+
+//从json解码的文档重新编码时，数字仍然是数字
+func TestJSONCodecKeepsNumbers(t *testing.T) {
+	c := codec.NewJSONCodec[map[string]any]()
+	doc, err := c.Decode([]byte(`{"id":7,"price":1.5,"name":"book"}`))
+	AssertNoError(t, err)
+	data, err := c.Encode(doc)
+	AssertNoError(t, err)
+	AssertEqual(t, `{"id":7,"name":"book","price":1.5}`, string(data))
+}
+
+//有环的对象图返回错误，共享的引用按树编码
+func TestCodecsCycle(t *testing.T) {
+	root := &Category{id: "root"}
+	root.addChild(&Category{id: "a"})
+	_, err := codec.NewJSONCodec[*Category]().Encode(root)
+	AssertTrue(t, err != nil)
+	_, err = codec.NewBinaryCodec[*Category]().Encode(root)
+	AssertTrue(t, err != nil)
+	self := map[string]any{}
+	self["self"] = self
+	_, err = codec.ToDocument(self)
+	AssertTrue(t, err != nil)
+
+	shared := &Category{id: "shared"}
+	tree := &Category{id: "tree", children: []*Category{shared}, featured: shared}
+	data, err := codec.NewJSONCodec[*Category]().Encode(tree)
+	AssertNoError(t, err)
+	decoded, err := codec.NewJSONCodec[*Category]().Decode(data)
+	AssertNoError(t, err)
+	AssertEqual(t, "shared", decoded.featured.id)
+	_, err = codec.NewBinaryCodec[*Category]().Encode(tree)
+	AssertNoError(t, err)
+}
+
+//损坏的长度返回错误，不会panic或者循环很多次
+func TestBinaryCodecCorruptedLength(t *testing.T) {
+	for _, length := range []uint64{math.MaxUint64, 1 << 40, math.MaxInt32 + 2} {
+		data := binary.AppendUvarint(nil, length)
+		_, err := codec.NewBinaryCodec[[]struct{}]().Decode(data)
+		AssertTrue(t, err != nil)
+		_, err = codec.NewBinaryCodec[map[struct{}]struct{}]().Decode(data)
+		AssertTrue(t, err != nil)
+		_, err = codec.NewBinaryCodec[[]int]().Decode(data)
+		AssertTrue(t, err != nil)
+	}
+	//大小为0的元素不占字节
+	empty, err := codec.NewBinaryCodec[[]struct{}]().Decode(binary.AppendUvarint(nil, 1001))
+	AssertNoError(t, err)
+	AssertEqual(t, 1000, len(empty))
+}
@@ -0,0 +1,21 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+// 未导出的结构体字段也被深拷贝
+func TestCopyUnexportedStructFields(t *testing.T) {
+	repoimpl.NewMemRepository(func() *Order { return &Order{} })
+	order := &Order{id: 1, items: []OrderItem{{Product{1, "apple", 5}, 2}}, userId: 1}
+	copied := arp.CopyEntity(reflect.TypeOf(Order{}).PkgPath()+".Order", order).(*Order)
+	copied.items[0].product.name = "pear"
+	copied.items[0].amount = 3
+	AssertEqual(t, "apple", order.items[0].product.name)
+	AssertEqual(t, 2, order.items[0].amount)
+	AssertEqual(t, "pear", copied.items[0].product.name)
+}
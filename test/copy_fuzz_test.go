@@ -0,0 +1,326 @@
+package test
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/copy"
+	"github.com/framework-arp/ARP4G/util"
+)
+
+type fuzzItem struct {
+	name string
+	qty  *int
+	tags []string
+}
+
+type fuzzTree map[string]fuzzTree
+
+//覆盖各种Kind的实体
+type fuzzEntity struct {
+	id      int
+	flag    bool
+	ratio   float64
+	count   *int
+	label   *string
+	pp      **int
+	nums    []*int
+	data    []byte
+	grid    [][]fuzzItem
+	groups  map[string][]fuzzItem
+	nested  map[string]map[int]string
+	items   map[int]*fuzzItem
+	keyed   map[[2]int]*int
+	arr     [2][]int
+	ptrArr  [2]*fuzzItem
+	matrix  [2][2]int
+	value   any
+	values  []any
+	tree    fuzzTree
+	item    fuzzItem
+	itemPtr *fuzzItem
+	anon    struct {
+		note *string
+		list []int
+	}
+}
+
+type fuzzGenerator struct {
+	rand *rand.Rand
+}
+
+func (g *fuzzGenerator) chance() bool {
+	return g.rand.Intn(3) > 0
+}
+
+func (g *fuzzGenerator) intPtr() *int {
+	if !g.chance() {
+		return nil
+	}
+	n := g.rand.Intn(100)
+	return &n
+}
+
+func (g *fuzzGenerator) strPtr() *string {
+	if !g.chance() {
+		return nil
+	}
+	s := string(rune('a' + g.rand.Intn(26)))
+	return &s
+}
+
+func (g *fuzzGenerator) size() int {
+	return g.rand.Intn(4)
+}
+
+func (g *fuzzGenerator) item() fuzzItem {
+	item := fuzzItem{name: *g.strPtrOr("item"), qty: g.intPtr()}
+	if g.chance() {
+		item.tags = make([]string, g.size(), 4)
+		for i := range item.tags {
+			item.tags[i] = *g.strPtrOr("tag")
+		}
+	}
+	return item
+}
+
+func (g *fuzzGenerator) itemPtr() *fuzzItem {
+	if !g.chance() {
+		return nil
+	}
+	item := g.item()
+	return &item
+}
+
+func (g *fuzzGenerator) strPtrOr(s string) *string {
+	if p := g.strPtr(); p != nil {
+		return p
+	}
+	return &s
+}
+
+func (g *fuzzGenerator) any() any {
+	switch g.rand.Intn(7) {
+	case 0:
+		return nil
+	case 1:
+		return g.rand.Intn(100)
+	case 2:
+		return g.intPtr()
+	case 3:
+		return []int{g.rand.Intn(100)}
+	case 4:
+		return map[string]any{"k": []int{g.rand.Intn(100)}}
+	case 5:
+		return g.item()
+	default:
+		return g.itemPtr()
+	}
+}
+
+func (g *fuzzGenerator) tree(depth int) fuzzTree {
+	if depth == 0 || !g.chance() {
+		return nil
+	}
+	tree := fuzzTree{}
+	for i := 0; i < g.size(); i++ {
+		tree[*g.strPtrOr("node")] = g.tree(depth - 1)
+	}
+	return tree
+}
+
+func (g *fuzzGenerator) entity() *fuzzEntity {
+	e := &fuzzEntity{id: g.rand.Int(), flag: g.chance(), ratio: g.rand.Float64(), count: g.intPtr(), label: g.strPtr()}
+	if g.chance() {
+		e.pp = new(*int)
+		*e.pp = g.intPtr()
+	}
+	if g.chance() {
+		e.nums = make([]*int, g.size())
+		for i := range e.nums {
+			e.nums[i] = g.intPtr()
+		}
+		//共享的指针
+		if len(e.nums) > 0 && e.count != nil {
+			e.nums[0] = e.count
+		}
+	}
+	if g.chance() {
+		e.data = make([]byte, g.size())
+		g.rand.Read(e.data)
+	}
+	if g.chance() {
+		e.grid = make([][]fuzzItem, g.size())
+		for i := range e.grid {
+			e.grid[i] = []fuzzItem{g.item()}
+		}
+	}
+	if g.chance() {
+		e.groups = map[string][]fuzzItem{}
+		for i := 0; i < g.size(); i++ {
+			e.groups[*g.strPtrOr("g")] = []fuzzItem{g.item(), g.item()}
+		}
+	}
+	if g.chance() {
+		e.nested = map[string]map[int]string{"a": {g.rand.Intn(10): *g.strPtrOr("v")}, "b": nil}
+	}
+	if g.chance() {
+		e.items = map[int]*fuzzItem{}
+		for i := 0; i < g.size(); i++ {
+			e.items[i] = g.itemPtr()
+		}
+	}
+	if g.chance() {
+		e.keyed = map[[2]int]*int{{1, g.rand.Intn(10)}: g.intPtr()}
+	}
+	for i := range e.arr {
+		if g.chance() {
+			e.arr[i] = []int{g.rand.Intn(10)}
+		}
+		e.ptrArr[i] = g.itemPtr()
+	}
+	e.matrix[1][1] = g.rand.Intn(10)
+	e.value = g.any()
+	for i := 0; i < g.size(); i++ {
+		e.values = append(e.values, g.any())
+	}
+	e.tree = g.tree(3)
+	e.item = g.item()
+	e.itemPtr = g.itemPtr()
+	e.anon.note = g.strPtr()
+	if g.chance() {
+		e.anon.list = []int{g.rand.Intn(10)}
+	}
+	return e
+}
+
+//参照用的深拷贝，不保留共享的引用
+func referenceDeepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(referenceDeepCopy(v.Elem()))
+		return p
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Cap())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(referenceDeepCopy(v.Index(i)))
+		}
+		return s
+	case reflect.Array:
+		a := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			a.Index(i).Set(referenceDeepCopy(v.Index(i)))
+		}
+		return a
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		m := reflect.MakeMap(v.Type())
+		iter := v.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(iter.Key(), referenceDeepCopy(iter.Value()))
+		}
+		return m
+	case reflect.Interface:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		i := reflect.New(v.Type()).Elem()
+		i.Set(referenceDeepCopy(v.Elem()))
+		return i
+	case reflect.Struct:
+		s := reflect.New(v.Type()).Elem()
+		if !v.CanAddr() {
+			addressable := reflect.New(v.Type()).Elem()
+			addressable.Set(v)
+			v = addressable
+		}
+		for i := 0; i < v.NumField(); i++ {
+			util.Accessible(s.Field(i)).Set(referenceDeepCopy(util.Accessible(v.Field(i))))
+		}
+		return s
+	default:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		return c
+	}
+}
+
+//修改v能够到达的所有值，用来检查复制出来的值和原来的值没有共享
+func mutateAll(v reflect.Value, visited map[uintptr]bool) {
+	switch v.Kind() {
+	case reflect.Int:
+		v.SetInt(v.Int() + 1)
+	case reflect.Uint8:
+		v.SetUint(v.Uint() + 1)
+	case reflect.String:
+		v.SetString(v.String() + "!")
+	case reflect.Bool:
+		v.SetBool(!v.Bool())
+	case reflect.Float64:
+		v.SetFloat(v.Float() + 1)
+	case reflect.Pointer:
+		if v.IsNil() || visited[v.Pointer()] {
+			return
+		}
+		visited[v.Pointer()] = true
+		mutateAll(v.Elem(), visited)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			mutateAll(v.Index(i), visited)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			mutateAll(value, visited)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		value := reflect.New(v.Elem().Type()).Elem()
+		value.Set(v.Elem())
+		mutateAll(value, visited)
+		v.Set(value)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			mutateAll(util.Accessible(v.Field(i)), visited)
+		}
+	}
+}
+
+func FuzzCopyEntity(f *testing.F) {
+	copier := copy.GenerateEntityCopier(reflect.TypeOf(fuzzEntity{}), make(map[string]*copy.EntityCopier))
+	for seed := int64(0); seed < 20; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		g := &fuzzGenerator{rand.New(rand.NewSource(seed))}
+		entity := g.entity()
+		expected := referenceDeepCopy(reflect.ValueOf(entity)).Interface().(*fuzzEntity)
+		copied := &fuzzEntity{}
+		copier.Copy(entity, copied)
+		if !reflect.DeepEqual(expected, copied) {
+			t.Fatalf("copy differs from reference deep copy, seed %d", seed)
+		}
+		if len(copied.nums) > 0 && copied.count != nil && copied.nums[0] != copied.count {
+			t.Fatalf("shared pointer not preserved, seed %d", seed)
+		}
+		mutateAll(reflect.ValueOf(copied), make(map[uintptr]bool))
+		if !reflect.DeepEqual(expected, entity) {
+			t.Fatalf("mutating the copy changed the original, seed %d", seed)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+var moneyCopies int
+
+//自己实现深拷贝和比较的值类型
+type Money struct {
+	cents    int64
+	currency *string
+}
+
+func (money Money) DeepCopy() Money {
+	moneyCopies++
+	currency := *money.currency
+	return Money{money.cents, &currency}
+}
+
+func (money Money) Equal(other Money) bool {
+	return money.cents == other.cents && *money.currency == *other.currency
+}
+
+type Wallet struct {
+	id      string
+	balance Money
+	opened  time.Time
+	//不可变，复制时共享
+	limit *big.Int `arp:"shared"`
+	//根据其他字段计算的缓存
+	summary string `arp:"-"`
+}
+
+type changeRecorder struct {
+	changes []*arp.ChangeSet
+}
+
+func (recorder *changeRecorder) Committed(ctx context.Context, changes *arp.ChangeSet) {
+	recorder.changes = append(recorder.changes, changes)
+}
+
+func (recorder *changeRecorder) Aborted(ctx context.Context, entityType string, ids []any) {
+}
+
+func newWallet(id string) *Wallet {
+	currency := "CNY"
+	return &Wallet{id: id, balance: Money{100, &currency},
+		opened:  time.Date(2024, 1, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600)),
+		limit:   big.NewInt(1000),
+		summary: "100 CNY"}
+}
+
+func TestCopyHooksAndTags(t *testing.T) {
+	repoimpl.NewMemRepository(func() *Wallet { return &Wallet{} })
+	wallet := newWallet("1")
+	copies := moneyCopies
+	copied := arp.CopyEntity(arp.TypeFullname[Wallet](), wallet).(*Wallet)
+	AssertEqual(t, copies+1, moneyCopies)
+	AssertTrue(t, copied.balance.currency != wallet.balance.currency)
+	AssertTrue(t, copied.balance.Equal(wallet.balance))
+	AssertTrue(t, copied.limit == wallet.limit)
+	AssertTrue(t, copied.opened.Equal(wallet.opened))
+	AssertEqual(t, "", copied.summary)
+}
+
+func TestChangeDetectionHonorsEqualAndSkippedFields(t *testing.T) {
+	repo := repoimpl.NewMemRepository(func() *Wallet { return &Wallet{} })
+	recorder := &changeRecorder{}
+	arp.AddProcessListener(arp.TypeFullname[Wallet](), recorder)
+	defer arp.RemoveProcessListener(arp.TypeFullname[Wallet](), recorder)
+	bg := context.Background()
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, "1", newWallet("1"))
+		return nil
+	}))
+
+	//只修改了不比较的字段，时间换了时区但还是同一时刻
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		wallet, _ := repo.Take(ctx, "1")
+		wallet.summary = "changed"
+		wallet.opened = wallet.opened.UTC()
+		return nil
+	}))
+	changes := recorder.changes[len(recorder.changes)-1]
+	AssertEqual(t, 0, len(changes.Updated))
+	AssertEqual(t, 1, len(changes.Unchanged))
+
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		wallet, _ := repo.Take(ctx, "1")
+		wallet.balance.cents += 50
+		return nil
+	}))
+	changes = recorder.changes[len(recorder.changes)-1]
+	AssertEqual(t, 1, len(changes.Updated))
+	wallet, _ := repo.Find(bg, "1")
+	AssertEqual(t, int64(150), wallet.balance.cents)
+}
@@ -0,0 +1,144 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoext"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+type Contact struct {
+	id      int
+	name    string
+	address string `arp:"encrypt"`
+	photo   []byte `arp:"encrypt"`
+}
+
+func newEncryptedContactRepository(t *testing.T) (arp.Repository[*Contact], *repoimpl.MemStore[*Contact], *repoext.KeyRing) {
+	keys, err := repoext.NewKeyRing("k1", []byte("0123456789abcdef"))
+	AssertNoError(t, err)
+	newZeroContact := func() *Contact { return &Contact{} }
+	memStore := repoimpl.NewMemStore(newZeroContact)
+	repo := arp.NewRepository[*Contact](repoext.NewEncryptedStore[*Contact](memStore, keys), repoimpl.NewMemMutexes(), newZeroContact)
+	return repo, memStore, keys
+}
+
+func TestEncryptedStore(t *testing.T) {
+	repo, memStore, keys := newEncryptedContactRepository(t)
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &Contact{id: 1, name: "neo", address: "Beijing", photo: []byte("jpeg")})
+		return nil
+	})
+	AssertNoError(t, err)
+
+	//store中保存的是密文
+	raw, _, _ := memStore.Load(context.Background(), 1)
+	AssertTrue(t, strings.HasPrefix(raw.address, "arpenc:v1:"))
+	AssertFalse(t, strings.Contains(raw.address, "Beijing"))
+	AssertFalse(t, strings.Contains(string(raw.photo), "jpeg"))
+	AssertEqual(t, "neo", raw.name)
+	contact, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, "Beijing", contact.address)
+	AssertEqual(t, "jpeg", string(contact.photo))
+
+	//轮换key之后，旧数据仍然可以读取，修改之后用新的key加密
+	AssertNoError(t, keys.Rotate("k2", []byte("fedcba9876543210fedcba9876543210")))
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		contact, _ := repo.Take(ctx, 1)
+		AssertEqual(t, "Beijing", contact.address)
+		contact.address = "Shanghai"
+		return nil
+	})
+	AssertNoError(t, err)
+	contact, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, "Shanghai", contact.address)
+	newRaw, _, _ := memStore.Load(context.Background(), 1)
+	AssertTrue(t, strings.HasPrefix(newRaw.address, "arpenc:v1:"))
+
+	//旧的key丢失之后无法解密
+	lostKeys, _ := repoext.NewKeyRing("k1", []byte("0123456789abcdef"))
+	_, _, err = repoext.NewEncryptedStore[*Contact](memStore, lostKeys).Load(context.Background(), 1)
+	AssertTrue(t, err != nil)
+}
+
+//密文和实体的id绑定，挪到别的实体上无法解密
+func TestEncryptedStoreCiphertextBoundToId(t *testing.T) {
+	repo, memStore, keys := newEncryptedContactRepository(t)
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &Contact{id: 1, address: "Beijing"})
+		repo.Put(ctx, 2, &Contact{id: 2, address: "Shanghai"})
+		return nil
+	})
+	AssertNoError(t, err)
+	raw1, _, _ := memStore.Load(context.Background(), 1)
+	raw2, _, _ := memStore.Load(context.Background(), 2)
+	raw2.address = raw1.address
+	AssertNoError(t, memStore.RemoveAll(context.Background(), []any{2}))
+	AssertNoError(t, memStore.Save(context.Background(), 2, raw2))
+
+	store := repoext.NewEncryptedStore[*Contact](memStore, keys)
+	_, _, err = store.Load(context.Background(), 2)
+	AssertTrue(t, err != nil)
+	contact, _, err := store.Load(context.Background(), 1)
+	AssertNoError(t, err)
+	AssertEqual(t, "Beijing", contact.address)
+}
+
+//启用加密之前保存的明文，即使以"arpenc:"开头也能正常读取，保存之后再读取也不变
+func TestEncryptedStorePlaintextWithPrefix(t *testing.T) {
+	repo, memStore, _ := newEncryptedContactRepository(t)
+	plaintexts := []string{"arpenc:", "arpenc:Beijing", "arpenc:v1:", "arpenc:v1:Beijing", "arpenc:v1:QUJD"}
+	for i, plaintext := range plaintexts {
+		AssertNoError(t, memStore.Save(context.Background(), i, &Contact{id: i, address: plaintext, photo: []byte{0xa7, 0x9e, 0x4e, 0x43, 0x01}}))
+		contact, found := repo.Find(context.Background(), i)
+		AssertTrue(t, found)
+		AssertEqual(t, plaintext, contact.address)
+		AssertEqual(t, string([]byte{0xa7, 0x9e, 0x4e, 0x43, 0x01}), string(contact.photo))
+	}
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 100, &Contact{id: 100, address: "arpenc:v1:Beijing"})
+		return nil
+	})
+	AssertNoError(t, err)
+	contact, found := repo.Find(context.Background(), 100)
+	AssertTrue(t, found)
+	AssertEqual(t, "arpenc:v1:Beijing", contact.address)
+}
+
+//按字段查询时逐个解密
+func TestEncryptedStoreQueryAllByField(t *testing.T) {
+	repo, _, _ := newEncryptedContactRepository(t)
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &Contact{id: 1, name: "neo", address: "Beijing"})
+		repo.Put(ctx, 2, &Contact{id: 2, name: "neo", address: "Shanghai"})
+		repo.Put(ctx, 3, &Contact{id: 3, name: "trinity", address: "Guangzhou"})
+		return nil
+	})
+	AssertNoError(t, err)
+	contacts, err := repo.(arp.QueryRepository[*Contact]).QueryAllByField(context.Background(), "name", "neo")
+	AssertNoError(t, err)
+	AssertEqual(t, 2, len(contacts))
+	addresses := map[string]bool{}
+	for _, contact := range contacts {
+		addresses[contact.address] = true
+	}
+	AssertTrue(t, addresses["Beijing"] && addresses["Shanghai"])
+}
+
+type Credential struct {
+	id     int
+	secret string `arp:"encrypt"`
+}
+
+//没有通过仓库注册的实体类型，保存时返回错误而不是panic
+func TestEncryptedStoreUnregisteredType(t *testing.T) {
+	keys, err := repoext.NewKeyRing("k1", []byte("0123456789abcdef"))
+	AssertNoError(t, err)
+	store := repoext.NewEncryptedStore[*Credential](repoimpl.NewMemStore(func() *Credential { return &Credential{} }), keys)
+	err = store.Save(context.Background(), 1, &Credential{1, "password"})
+	AssertTrue(t, errors.Is(err, arp.ErrEntityTypeNotRegistered))
+}
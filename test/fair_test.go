@@ -0,0 +1,79 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+func waitQueueLen(t *testing.T, mutexes *repoimpl.FairMutexes, id any, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for mutexes.QueueLen(id) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue length %d, want %d", mutexes.QueueLen(id), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairMutexes(t *testing.T) {
+	mutexes := repoimpl.NewFairMutexes()
+	ctx := context.Background()
+	ok, _ := mutexes.NewAndLock(ctx, 1)
+	AssertTrue(t, ok)
+
+	order := make(chan int, 4)
+	enqueue := func(name int, ctx context.Context) {
+		go func() {
+			mutexes.Lock(ctx, 1)
+			order <- name
+		}()
+	}
+	enqueue(1, ctx)
+	waitQueueLen(t, mutexes, 1, 1)
+	enqueue(2, ctx)
+	waitQueueLen(t, mutexes, 1, 2)
+	enqueue(3, ctx)
+	waitQueueLen(t, mutexes, 1, 3)
+	//高优先级的排到前面
+	enqueue(4, repoimpl.WithLockPriority(ctx, 1))
+	waitQueueLen(t, mutexes, 1, 4)
+
+	//超时的等待者离开队列
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, _, err := mutexes.Lock(timeoutCtx, 1)
+	cancel()
+	AssertError(t, err)
+	AssertEqual(t, 4, mutexes.QueueLen(1))
+
+	for _, want := range []int{4, 1, 2, 3} {
+		mutexes.UnlockAll(ctx, []any{1})
+		AssertEqual(t, want, <-order)
+	}
+	mutexes.UnlockAll(ctx, []any{1})
+	AssertEqual(t, 0, mutexes.QueueLen(1))
+	AssertEqual(t, 0, mutexes.Len())
+
+	waitTimes := mutexes.WaitTimes(1)
+	AssertEqual(t, uint64(5), waitTimes.Count)
+	AssertEqual(t, len(waitTimes.Bounds)+1, len(waitTimes.Counts))
+}
+
+//释放的锁被删除，统计数据只保留最近的一部分id
+func TestFairMutexesBounded(t *testing.T) {
+	mutexes := repoimpl.NewFairMutexes()
+	ctx := context.Background()
+	for id := 0; id < 5000; id++ {
+		ok, _ := mutexes.NewAndLock(ctx, id)
+		AssertTrue(t, ok)
+		mutexes.UnlockAll(ctx, []any{id})
+		_, absent, _ := mutexes.TryLock(ctx, id, 0)
+		AssertTrue(t, absent)
+	}
+	AssertEqual(t, 0, mutexes.Len())
+	AssertEqual(t, uint64(0), mutexes.WaitTimes(0).Count)
+	AssertEqual(t, uint64(1), mutexes.WaitTimes(4999).Count)
+}
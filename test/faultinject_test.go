@@ -0,0 +1,142 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/faultinject"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+func TestFaultInjectSaveAll(t *testing.T) {
+	injector := faultinject.NewInjector(1).Add(faultinject.Rule{EntityType: "ProductStock", Method: "SaveAll", Nth: 2, Err: faultinject.ErrInjected})
+	mutexes := repoimpl.NewMemMutexes()
+	repo := newStockQueryRepository(faultinject.Store[*ProductStock](newStockMemStore(), injector), faultinject.Mutexes[*ProductStock](mutexes, injector))
+	decrease := func() error {
+		return arp.Go(context.Background(), func(ctx context.Context) error {
+			stock := repo.TakeOrPutIfAbsent(ctx, 1, &ProductStock{1, 10})
+			stock.Decrease(1)
+			return nil
+		})
+	}
+	AssertNoError(t, decrease())
+	AssertTrue(t, errors.Is(decrease(), faultinject.ErrInjected))
+	//失败的过程释放了锁，数据没有变化
+	AssertEqual(t, 0, mutexes.Len())
+	stock, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 9, stock.freeAmount)
+	AssertNoError(t, decrease())
+	stock, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, 8, stock.freeAmount)
+}
+
+func TestFaultInjectPutIfAbsentSave(t *testing.T) {
+	injector := faultinject.NewInjector(1).Add(faultinject.Rule{Method: "Save", Id: 1, Nth: 1, Err: faultinject.ErrInjected})
+	mutexes := repoimpl.NewMemMutexes()
+	repo := newStockRepository(faultinject.Store[*ProductStock](newStockMemStore(), injector), faultinject.Mutexes[*ProductStock](mutexes, injector))
+	put := func() error {
+		return arp.Go(context.Background(), func(ctx context.Context) error {
+			repo.PutIfAbsent(ctx, 1, &ProductStock{1, 10})
+			return nil
+		})
+	}
+	AssertTrue(t, put() != nil)
+	//保存失败也要释放新建时加的锁，否则再次加锁会一直等待
+	if mutexes.Len() != 0 {
+		t.Fatalf("lock not released after Save failed")
+	}
+	AssertNoError(t, put())
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, found := repo.Take(ctx, 1)
+		AssertTrue(t, found)
+		stock.Decrease(1)
+		return nil
+	})
+	AssertNoError(t, err)
+	stock, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 9, stock.freeAmount)
+}
+
+func TestFaultInjectPanicAndLockTimeout(t *testing.T) {
+	injector := faultinject.NewInjector(1)
+	mutexes := repoimpl.NewMemMutexes()
+	repo := newStockQueryRepository(faultinject.Store[*ProductStock](newStockMemStore(), injector), faultinject.Mutexes[*ProductStock](mutexes, injector))
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		repo.Put(ctx, 2, &ProductStock{2, 10})
+		return nil
+	})
+	AssertNoError(t, err)
+
+	//保存时panic
+	injector.Add(faultinject.Rule{Method: "SaveAll", Id: 1, Nth: 1, Panic: "disk on fire"})
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(1)
+		return nil
+	})
+	AssertEqual(t, "disk on fire", err.Error())
+	AssertEqual(t, 0, mutexes.Len())
+
+	//id为2的锁超时，已经拿到的锁被释放
+	injector.Add(faultinject.Rule{Method: faultinject.AnyLock, Id: 2, Latency: 5 * time.Millisecond, Err: faultinject.ErrLockTimeout})
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Take(ctx, 1)
+		repo.Take(ctx, 2)
+		return nil
+	})
+	AssertTrue(t, err != nil)
+	AssertEqual(t, 0, mutexes.Len())
+	AssertEqual(t, 1, injector.Triggered("SaveAll"))
+	AssertEqual(t, 1, injector.Triggered("Lock"))
+
+	//没有指定方法的规则按实际触发的方法计数
+	injector.Reset()
+	injector.Add(faultinject.Rule{Id: 1, Nth: 1, Err: faultinject.ErrInjected})
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Take(ctx, 1)
+		return nil
+	})
+	AssertTrue(t, err != nil)
+	AssertEqual(t, 1, injector.Triggered("Lock"))
+	AssertEqual(t, 0, injector.Triggered("SaveAll"))
+}
+
+func TestFaultInjectPartialRemove(t *testing.T) {
+	injector := faultinject.NewInjector(1)
+	repo := newStockQueryRepository(faultinject.Store[*ProductStock](newStockMemStore(), injector), nil)
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		for id := 1; id <= 3; id++ {
+			repo.Put(ctx, id, &ProductStock{id, 10})
+		}
+		return nil
+	})
+	AssertNoError(t, err)
+	injector.Add(faultinject.Rule{Method: "RemoveAll", Partial: 1, Err: faultinject.ErrInjected})
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		for id := 1; id <= 3; id++ {
+			repo.Remove(ctx, id)
+		}
+		return nil
+	})
+	AssertTrue(t, errors.Is(err, faultinject.ErrInjected))
+	count, _ := repo.Count(context.Background())
+	AssertEqual(t, uint64(2), count)
+}
+
+func TestFaultInjectDeterministic(t *testing.T) {
+	fire := func(seed int64) []bool {
+		injector := faultinject.NewInjector(seed).Add(faultinject.Rule{Method: "Load", Probability: 0.5, Err: faultinject.ErrInjected})
+		store := faultinject.Store[*ProductStock](newStockMemStore(), injector)
+		var fired []bool
+		for i := 0; i < 20; i++ {
+			_, _, err := store.Load(context.Background(), i)
+			fired = append(fired, err != nil)
+		}
+		return fired
+	}
+	AssertEqual(t, fire(42), fire(42))
+}
@@ -0,0 +1,140 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package test
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+const fileMutexesHelperEnv = "ARP4G_FILE_MUTEXES_HELPER_DIR"
+
+//在子进程中运行，锁住id然后一直持有
+func TestFileMutexesHelperProcess(t *testing.T) {
+	dir := os.Getenv(fileMutexesHelperEnv)
+	if dir == "" {
+		t.Skip("helper process only")
+	}
+	mutexes, _ := repoimpl.NewFileMutexes(dir)
+	if ok, _, _ := mutexes.Lock(context.Background(), "order-1"); !ok {
+		mutexes.NewAndLock(context.Background(), "order-1")
+	}
+	os.Stdout.WriteString("locked\n")
+	time.Sleep(time.Minute)
+}
+
+func TestFileMutexes(t *testing.T) {
+	dir := t.TempDir()
+	mutexes, err := repoimpl.NewFileMutexes(dir)
+	AssertNoError(t, err)
+	ctx := context.Background()
+
+	ok, absent, err := mutexes.Lock(ctx, "order-1")
+	AssertNoError(t, err)
+	AssertFalse(t, ok)
+	AssertTrue(t, absent)
+
+	ok, err = mutexes.NewAndLock(ctx, "order-1")
+	AssertNoError(t, err)
+	AssertTrue(t, ok)
+	ok, err = mutexes.NewAndLock(ctx, "order-1")
+	AssertNoError(t, err)
+	AssertFalse(t, ok)
+
+	//另一个FileMutexes（相当于另一个进程）要等到锁释放，释放时删除了文件，等到的是absent
+	other, _ := repoimpl.NewFileMutexes(dir)
+	locked := make(chan bool)
+	go func() {
+		ok, absent, _ := other.Lock(ctx, "order-1")
+		locked <- !ok && absent
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock acquired while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	mutexes.UnlockAll(ctx, []any{"order-1"})
+	select {
+	case absent := <-locked:
+		AssertTrue(t, absent)
+	case <-time.After(time.Second):
+		t.Fatal("lock not acquired after unlock")
+	}
+	//锁文件不会留在目录里
+	entries, _ := os.ReadDir(dir)
+	AssertEqual(t, 0, len(entries))
+
+	//持有锁的进程死掉之后锁可以被再次获得
+	cmd := exec.Command(os.Args[0], "-test.run=TestFileMutexesHelperProcess")
+	cmd.Env = append(os.Environ(), fileMutexesHelperEnv+"="+dir)
+	stdout, _ := cmd.StdoutPipe()
+	AssertNoError(t, cmd.Start())
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	AssertEqual(t, "locked\n", line)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, _, err = mutexes.Lock(timeoutCtx, "order-1")
+	cancel()
+	AssertError(t, err)
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	timeoutCtx, cancel = context.WithTimeout(ctx, time.Second)
+	ok, _, err = mutexes.Lock(timeoutCtx, "order-1")
+	cancel()
+	AssertNoError(t, err)
+	AssertTrue(t, ok)
+	mutexes.UnlockAll(ctx, []any{"order-1"})
+	entries, _ = os.ReadDir(dir)
+	AssertEqual(t, 0, len(entries))
+}
+
+//多个FileMutexes交替释放（删除文件）和补锁（重新创建文件），同一时间只有一个持有锁
+func TestFileMutexesRecreate(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	var holders atomic.Int32
+	var overlapped atomic.Bool
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		mutexes, err := repoimpl.NewFileMutexes(dir)
+		AssertNoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				//和仓库一样，锁不存在时补锁，补锁失败再去加锁
+				for {
+					ok, absent, err := mutexes.Lock(ctx, "order-1")
+					AssertNoError(t, err)
+					if ok {
+						break
+					}
+					if absent {
+						if ok, _ = mutexes.NewAndLock(ctx, "order-1"); ok {
+							break
+						}
+					}
+				}
+				if holders.Add(1) > 1 {
+					overlapped.Store(true)
+				}
+				time.Sleep(100 * time.Microsecond)
+				holders.Add(-1)
+				mutexes.UnlockAll(ctx, []any{"order-1"})
+			}
+		}()
+	}
+	wg.Wait()
+	AssertFalse(t, overlapped.Load())
+	entries, _ := os.ReadDir(dir)
+	AssertEqual(t, 0, len(entries))
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/codec"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+type Account struct {
+	Id      int
+	Owner   string
+	Balance int
+}
+
+func openAccountRepository(t *testing.T, dir string, opts ...repoimpl.FileStoreOption) (arp.QueryRepository[*Account], *repoimpl.FileStore[*Account]) {
+	t.Helper()
+	store, err := repoimpl.OpenFileStore[*Account](dir, codec.NewJSONCodec[*Account](), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arp.NewQueryRepository[*Account](store, repoimpl.NewMemMutexes(), func() *Account { return &Account{} }), store
+}
+
+func deposit(repo arp.Repository[*Account], id int, amount int) error {
+	return arp.Go(context.Background(), func(ctx context.Context) error {
+		account := repo.TakeOrPutIfAbsent(ctx, id, &Account{Id: id})
+		account.Balance += amount
+		return nil
+	})
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	repo, store := openAccountRepository(t, dir)
+	AssertNoError(t, deposit(repo, 1, 10))
+	AssertNoError(t, deposit(repo, 2, 20))
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Remove(ctx, 2)
+		repo.Put(ctx, 3, &Account{Id: 3, Owner: "tom", Balance: 30})
+		return nil
+	})
+	AssertNoError(t, err)
+	AssertNoError(t, store.Close())
+
+	repo, store = openAccountRepository(t, dir)
+	account, found := repo.Find(context.Background(), 1)
+	AssertTrue(t, found)
+	AssertEqual(t, 10, account.Balance)
+	_, found = repo.Find(context.Background(), 2)
+	AssertFalse(t, found)
+	account, _ = repo.Find(context.Background(), 3)
+	AssertEqual(t, "tom", account.Owner)
+	ids, _ := repo.QueryAllIds(context.Background())
+	AssertEqual(t, 2, len(ids))
+
+	//最后一条记录写到一半时崩溃
+	AssertNoError(t, deposit(repo, 1, 5))
+	AssertNoError(t, store.Close())
+	walPath := filepath.Join(dir, "wal.log")
+	info, _ := os.Stat(walPath)
+	AssertNoError(t, os.Truncate(walPath, info.Size()-3))
+
+	repo, store = openAccountRepository(t, dir)
+	account, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, 10, account.Balance)
+	AssertNoError(t, deposit(repo, 1, 7))
+	AssertNoError(t, store.Close())
+
+	//损坏的记录被丢弃之后，后面追加的记录正常
+	repo, store = openAccountRepository(t, dir)
+	account, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, 17, account.Balance)
+	AssertNoError(t, store.Close())
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	repo, store := openAccountRepository(t, dir, repoimpl.WithCompactThreshold(3), repoimpl.WithFsyncPolicy(repoimpl.FsyncNever))
+	for i := 0; i < 10; i++ {
+		AssertNoError(t, deposit(repo, i%2, 1))
+	}
+	AssertNoError(t, store.Close())
+	_, err := os.Stat(filepath.Join(dir, "snapshot.json"))
+	AssertNoError(t, err)
+
+	repo, store = openAccountRepository(t, dir)
+	account, _ := repo.Find(context.Background(), 0)
+	AssertEqual(t, 5, account.Balance)
+	account, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, 5, account.Balance)
+	AssertNoError(t, store.Close())
+}
+
+func TestFileStoreCorruptedWal(t *testing.T) {
+	dir := t.TempDir()
+	repo, store := openAccountRepository(t, dir)
+	for i := 0; i < 3; i++ {
+		AssertNoError(t, deposit(repo, 1, 10))
+	}
+	AssertNoError(t, store.Close())
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := os.ReadFile(walPath)
+	AssertNoError(t, err)
+	//每条记录是4字节长度、4字节长度的校验和、4字节内容的校验和加上内容
+	var offsets []int
+	for offset := 0; offset < len(wal); offset += 12 + int(binary.LittleEndian.Uint32(wal[offset:])) {
+		offsets = append(offsets, offset)
+	}
+	last := len(offsets) - 1
+
+	//中间的记录损坏，不能丢弃后面的记录
+	corrupted := append([]byte(nil), wal...)
+	corrupted[offsets[last-1]+12] ^= 0xff
+	AssertNoError(t, os.WriteFile(walPath, corrupted, 0644))
+	_, err = repoimpl.OpenFileStore[*Account](dir, codec.NewJSONCodec[*Account]())
+	AssertTrue(t, errors.Is(err, repoimpl.ErrCorruptedWal))
+
+	//中间记录的长度损坏，超出了文件末尾，也不能当作写到一半
+	corrupted = append([]byte(nil), wal...)
+	corrupted[offsets[last-1]+3] = 0x7f
+	AssertNoError(t, os.WriteFile(walPath, corrupted, 0644))
+	_, err = repoimpl.OpenFileStore[*Account](dir, codec.NewJSONCodec[*Account]())
+	AssertTrue(t, errors.Is(err, repoimpl.ErrCorruptedWal))
+
+	//崩溃之后末尾填充了0
+	AssertNoError(t, os.WriteFile(walPath, append(append([]byte(nil), wal...), make([]byte, 20)...), 0644))
+	repo, store = openAccountRepository(t, dir)
+	account, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 30, account.Balance)
+	AssertNoError(t, store.Close())
+
+	//最后一条记录损坏，当作写到一半崩溃
+	corrupted = append([]byte(nil), wal...)
+	corrupted[offsets[last]+12] ^= 0xff
+	AssertNoError(t, os.WriteFile(walPath, corrupted, 0644))
+	repo, store = openAccountRepository(t, dir)
+	account, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, 20, account.Balance)
+	AssertNoError(t, store.Close())
+}
+
+//压缩失败时已经写入WAL的提交仍然成功，下一次写入时再压缩
+func TestFileStoreCompactFailure(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(defaultLogger)
+	dir := t.TempDir()
+	repo, store := openAccountRepository(t, dir, repoimpl.WithCompactThreshold(2))
+	//快照的位置被目录占用，无法写入快照
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	AssertNoError(t, os.MkdirAll(filepath.Join(snapshotPath, "occupied"), 0755))
+	AssertNoError(t, deposit(repo, 1, 10))
+	AssertNoError(t, deposit(repo, 1, 10))
+	AssertTrue(t, strings.Contains(logs.String(), "file store compaction failed"))
+
+	AssertNoError(t, os.RemoveAll(snapshotPath))
+	AssertNoError(t, deposit(repo, 1, 10))
+	_, err := os.Stat(snapshotPath)
+	AssertNoError(t, err)
+	AssertNoError(t, store.Close())
+	repo, store = openAccountRepository(t, dir)
+	account, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 30, account.Balance)
+	AssertNoError(t, store.Close())
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+type Ticket struct {
+	id    int
+	state string
+}
+
+type abortRecorder struct {
+	aborted []any
+}
+
+func (recorder *abortRecorder) Committed(ctx context.Context, changes *arp.ChangeSet) {
+}
+
+func (recorder *abortRecorder) Aborted(ctx context.Context, entityType string, ids []any) {
+	recorder.aborted = append(recorder.aborted, ids...)
+}
+
+//flush中store panic时Finish返回错误，通知过程中止并释放锁
+func TestFinishStorePanic(t *testing.T) {
+	newZero := func() *Ticket { return &Ticket{} }
+	failing := false
+	store := arp.InterceptStore[*Ticket](repoimpl.NewMemStore(newZero), func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		if failing && method == "SaveAll" {
+			panic("disk on fire")
+		}
+		return call(ctx)
+	})
+	mutexes := repoimpl.NewMemMutexes()
+	repo := arp.NewRepository[*Ticket](store, mutexes, newZero)
+	recorder := &abortRecorder{}
+	arp.AddProcessListener(arp.TypeFullname[Ticket](), recorder)
+	defer arp.RemoveProcessListener(arp.TypeFullname[Ticket](), recorder)
+	AssertNoError(t, arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &Ticket{1, "open"})
+		return nil
+	}))
+
+	failing = true
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		ticket, _ := repo.Take(ctx, 1)
+		ticket.state = "closed"
+		return nil
+	})
+	AssertEqual(t, "disk on fire", err.Error())
+	AssertEqual(t, []any{1}, recorder.aborted)
+	AssertEqual(t, 0, mutexes.Len())
+
+	//手动调用Finish也一样
+	ctx := arp.Start(context.Background())
+	ticket, _ := repo.Take(ctx, 1)
+	ticket.state = "closed"
+	err = arp.Finish(ctx)
+	AssertEqual(t, "disk on fire", err.Error())
+	AssertEqual(t, []any{1, 1}, recorder.aborted)
+	AssertEqual(t, 0, mutexes.Len())
+
+	failing = false
+	ticket, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, "open", ticket.state)
+}
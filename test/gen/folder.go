@@ -0,0 +1,100 @@
+package gen
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+//go:generate go run ../../cmd/arpgen -type Folder -tree
+
+//用来测试arpgen的聚合，字段覆盖生成代码的各种情况
+type Folder struct {
+	Id       string
+	name     string
+	size     *int64
+	tags     []string
+	files    []File
+	children []*Folder
+	attrs    map[string][]string
+	meta     any
+	created  time.Time
+	acl      [2]map[string]bool
+	Owner
+	tree     Tree
+	status   Status
+	onChange func()
+	//不可变的值，复制时共享
+	quota *big.Int `arp:"shared"`
+	//可以重新计算的缓存，不复制也不比较
+	thumbnail []byte `arp:"-"`
+}
+
+type File struct {
+	name   string
+	size   int64
+	chunks [][]byte
+}
+
+type Owner struct {
+	ownerName string
+}
+
+type Tree map[string]Tree
+
+type Status int
+
+func NewFolder(id string, depth int, width int) *Folder {
+	size := int64(depth * width)
+	folder := &Folder{Id: id, name: "folder " + id, size: &size, tags: []string{"a", "b"},
+		attrs:   map[string][]string{"color": {"red"}},
+		meta:    map[string]any{"depth": depth},
+		created: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		acl:     [2]map[string]bool{{"read": true}, nil},
+		Owner:   Owner{"owner " + id},
+		tree:    Tree{"root": Tree{"leaf": nil}},
+		status:  Status(depth)}
+	for i := 0; i < width; i++ {
+		folder.files = append(folder.files, File{fmt.Sprintf("file %d", i), int64(i), [][]byte{{byte(i)}}})
+		if depth > 0 {
+			folder.children = append(folder.children, NewFolder(fmt.Sprintf("%s.%d", id, i), depth-1, width))
+		}
+	}
+	return folder
+}
+
+func (folder *Folder) Rename(name string) {
+	folder.name = name
+}
+
+//修改最深处的一个值
+func (folder *Folder) TouchDeepest() {
+	for len(folder.children) > 0 {
+		folder = folder.children[len(folder.children)-1]
+	}
+	if len(folder.files) > 0 {
+		folder.files[0].chunks[0][0]++
+	} else {
+		*folder.size++
+	}
+}
+
+func (folder *Folder) Name() string {
+	return folder.name
+}
+
+func (folder *Folder) SetQuota(quota *big.Int) {
+	folder.quota = quota
+}
+
+func (folder *Folder) Quota() *big.Int {
+	return folder.quota
+}
+
+func (folder *Folder) SetThumbnail(thumbnail []byte) {
+	folder.thumbnail = thumbnail
+}
+
+func (folder *Folder) Thumbnail() []byte {
+	return folder.thumbnail
+}
@@ -0,0 +1,257 @@
+// Code generated by arpgen. DO NOT EDIT.
+
+package gen
+
+import arpcopy "github.com/framework-arp/ARP4G/copy"
+
+// DeepCopy返回一个深拷贝
+func (x *File) DeepCopy() *File {
+	if x == nil {
+		return nil
+	}
+	c := new(File)
+	*c = *x
+	if x.chunks != nil {
+		c.chunks = make([][]byte, len(x.chunks), cap(x.chunks))
+		copy(c.chunks, x.chunks)
+		for i1 := range x.chunks {
+			if x.chunks[i1] != nil {
+				c.chunks[i1] = make([]byte, len(x.chunks[i1]), cap(x.chunks[i1]))
+				copy(c.chunks[i1], x.chunks[i1])
+			}
+		}
+	}
+	return c
+}
+
+// Equal和arpcopy.Equal(x, o)的结果一致
+func (x *File) Equal(o *File) bool {
+	if x == o {
+		return true
+	}
+	if x == nil || o == nil {
+		return false
+	}
+	if x.name != o.name {
+		return false
+	}
+	if x.size != o.size {
+		return false
+	}
+	if (x.chunks == nil) != (o.chunks == nil) || len(x.chunks) != len(o.chunks) {
+		return false
+	}
+	for i2 := range x.chunks {
+		if (x.chunks[i2] == nil) != (o.chunks[i2] == nil) || len(x.chunks[i2]) != len(o.chunks[i2]) {
+			return false
+		}
+		for i3 := range x.chunks[i2] {
+			if x.chunks[i2][i3] != o.chunks[i2][i3] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// DeepCopy返回一个深拷贝
+func (x *Folder) DeepCopy() *Folder {
+	if x == nil {
+		return nil
+	}
+	c := new(Folder)
+	*c = *x
+	if x.size != nil {
+		c.size = new(int64)
+		*c.size = *x.size
+	}
+	if x.tags != nil {
+		c.tags = make([]string, len(x.tags), cap(x.tags))
+		copy(c.tags, x.tags)
+	}
+	if x.files != nil {
+		c.files = make([]File, len(x.files), cap(x.files))
+		copy(c.files, x.files)
+		for i1 := range x.files {
+			c.files[i1] = *x.files[i1].DeepCopy()
+		}
+	}
+	if x.children != nil {
+		c.children = make([]*Folder, len(x.children), cap(x.children))
+		copy(c.children, x.children)
+		for i2 := range x.children {
+			c.children[i2] = x.children[i2].DeepCopy()
+		}
+	}
+	if x.attrs != nil {
+		m3 := make(map[string][]string, len(x.attrs))
+		for k4, v5 := range x.attrs {
+			c6 := v5
+			if v5 != nil {
+				c6 = make([]string, len(v5), cap(v5))
+				copy(c6, v5)
+			}
+			m3[k4] = c6
+		}
+		c.attrs = m3
+	}
+	c.meta = arpcopy.DeepCopyValue(x.meta)
+	c.created = arpcopy.DeepCopyValue(x.created)
+	for i7 := range x.acl {
+		if x.acl[i7] != nil {
+			m8 := make(map[string]bool, len(x.acl[i7]))
+			for k9, v10 := range x.acl[i7] {
+				m8[k9] = v10
+			}
+			c.acl[i7] = m8
+		}
+	}
+	if x.tree != nil {
+		m11 := make(Tree, len(x.tree))
+		for k12, v13 := range x.tree {
+			m11[k12] = arpcopy.DeepCopyValue(v13)
+		}
+		c.tree = m11
+	}
+	c.thumbnail = nil
+	return c
+}
+
+// Equal和arpcopy.Equal(x, o)的结果一致
+func (x *Folder) Equal(o *Folder) bool {
+	if x == o {
+		return true
+	}
+	if x == nil || o == nil {
+		return false
+	}
+	if x.Id != o.Id {
+		return false
+	}
+	if x.name != o.name {
+		return false
+	}
+	if (x.size == nil) != (o.size == nil) {
+		return false
+	}
+	if x.size != nil && x.size != o.size {
+		if (*x.size) != (*o.size) {
+			return false
+		}
+	}
+	if (x.tags == nil) != (o.tags == nil) || len(x.tags) != len(o.tags) {
+		return false
+	}
+	for i14 := range x.tags {
+		if x.tags[i14] != o.tags[i14] {
+			return false
+		}
+	}
+	if (x.files == nil) != (o.files == nil) || len(x.files) != len(o.files) {
+		return false
+	}
+	for i15 := range x.files {
+		if !x.files[i15].Equal(&o.files[i15]) {
+			return false
+		}
+	}
+	if (x.children == nil) != (o.children == nil) || len(x.children) != len(o.children) {
+		return false
+	}
+	for i16 := range x.children {
+		if !x.children[i16].Equal(o.children[i16]) {
+			return false
+		}
+	}
+	if (x.attrs == nil) != (o.attrs == nil) || len(x.attrs) != len(o.attrs) {
+		return false
+	}
+	for k17, av18 := range x.attrs {
+		bv19, ok20 := o.attrs[k17]
+		if !ok20 {
+			return false
+		}
+		if (av18 == nil) != (bv19 == nil) || len(av18) != len(bv19) {
+			return false
+		}
+		for i21 := range av18 {
+			if av18[i21] != bv19[i21] {
+				return false
+			}
+		}
+	}
+	if !arpcopy.Equal(x.meta, o.meta) {
+		return false
+	}
+	if !arpcopy.Equal(x.created, o.created) {
+		return false
+	}
+	for i22 := range x.acl {
+		if (x.acl[i22] == nil) != (o.acl[i22] == nil) || len(x.acl[i22]) != len(o.acl[i22]) {
+			return false
+		}
+		for k23, av24 := range x.acl[i22] {
+			bv25, ok26 := o.acl[i22][k23]
+			if !ok26 {
+				return false
+			}
+			if av24 != bv25 {
+				return false
+			}
+		}
+	}
+	if !x.Owner.Equal(&o.Owner) {
+		return false
+	}
+	if (x.tree == nil) != (o.tree == nil) || len(x.tree) != len(o.tree) {
+		return false
+	}
+	for k27, av28 := range x.tree {
+		bv29, ok30 := o.tree[k27]
+		if !ok30 {
+			return false
+		}
+		if !arpcopy.Equal(av28, bv29) {
+			return false
+		}
+	}
+	if x.status != o.status {
+		return false
+	}
+	if x.onChange != nil || o.onChange != nil {
+		return false
+	}
+	if (x.quota == nil) != (o.quota == nil) {
+		return false
+	}
+	if x.quota != nil && x.quota != o.quota {
+		if !arpcopy.Equal((*x.quota), (*o.quota)) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeepCopy返回一个深拷贝
+func (x *Owner) DeepCopy() *Owner {
+	if x == nil {
+		return nil
+	}
+	c := new(Owner)
+	*c = *x
+	return c
+}
+
+// Equal和arpcopy.Equal(x, o)的结果一致
+func (x *Owner) Equal(o *Owner) bool {
+	if x == o {
+		return true
+	}
+	if x == nil || o == nil {
+		return false
+	}
+	if x.ownerName != o.ownerName {
+		return false
+	}
+	return true
+}
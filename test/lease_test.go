@@ -0,0 +1,117 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	clock.now = clock.now.Add(d)
+	clock.mutex.Unlock()
+}
+
+//租约过期后锁被别人获得，原持有者的写入被拒绝
+func TestLeaseExpired(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	repo := newStockRepository(nil, repoimpl.NewMemLeasedMutexes(time.Minute, clock))
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		return nil
+	})
+	AssertNoError(t, err)
+
+	ctxA := arp.Start(context.Background())
+	stockA, _ := repo.Take(ctxA, 1)
+	stockA.Increase(1)
+
+	clock.Advance(2 * time.Minute)
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Increase(5)
+		return nil
+	})
+	AssertNoError(t, err)
+
+	err = arp.Finish(ctxA)
+	AssertTrue(t, errors.Is(err, arp.ErrStaleFencingToken))
+	stock, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 15, stock.freeAmount)
+
+	//原持有者的释放不会影响别人的锁，锁仍然可以正常获得
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Increase(1)
+		return nil
+	})
+	AssertNoError(t, err)
+	stock, _ = repo.Find(context.Background(), 1)
+	AssertEqual(t, 16, stock.freeAmount)
+}
+
+func TestLeaseRenew(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	mutexes := repoimpl.NewMemLeasedMutexes(time.Minute, clock)
+	ctx := context.Background()
+
+	token1, ok, _, err := mutexes.LockLease(ctx, 1)
+	AssertNoError(t, err)
+	AssertTrue(t, ok)
+	clock.Advance(50 * time.Second)
+	err = mutexes.Renew(ctx, []any{1})
+	AssertError(t, err)
+
+	mutexes.UnlockAll(ctx, []any{1})
+	token2, _, _, _ := mutexes.LockLease(ctx, 1)
+	AssertTrue(t, token2 > token1)
+}
+
+//过程持有锁期间自动续约
+func TestLeaseKeepAlive(t *testing.T) {
+	repo := newStockRepository(nil, repoimpl.NewMemLeasedMutexes(60*time.Millisecond, nil))
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		return nil
+	})
+	AssertNoError(t, err)
+
+	ctxA := arp.Start(context.Background())
+	stockA, _ := repo.Take(ctxA, 1)
+	stockA.Increase(1)
+
+	done := make(chan error)
+	go func() {
+		done <- arp.Go(context.Background(), func(ctx context.Context) error {
+			stock, _ := repo.Take(ctx, 1)
+			stock.Increase(5)
+			return nil
+		})
+	}()
+	select {
+	case <-done:
+		t.Fatal("lease expired while process alive")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	AssertNoError(t, arp.Finish(ctxA))
+	AssertNoError(t, <-done)
+	stock, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 16, stock.freeAmount)
+}
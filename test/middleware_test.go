@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/middleware"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+//前failures次SaveAll返回暂时性错误，Load一直等到ctx结束
+type flakyStore struct {
+	*repoimpl.MemStore[*ProductStock]
+	failures int
+	slowLoad bool
+}
+
+func (store *flakyStore) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	if store.failures > 0 {
+		store.failures--
+		return middleware.ErrTransient
+	}
+	return store.MemStore.SaveAll(ctx, entitiesToInsert, entitiesToUpdate)
+}
+
+func (store *flakyStore) Load(ctx context.Context, id any) (*ProductStock, bool, error) {
+	if store.slowLoad {
+		<-ctx.Done()
+		return nil, false, ctx.Err()
+	}
+	return store.MemStore.Load(ctx, id)
+}
+
+func TestMiddlewareLoggingAndMetrics(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	storeMetrics := middleware.NewCallMetrics()
+	mutexesMetrics := middleware.NewCallMetrics()
+	repo := repoimpl.NewMemRepository(newZeroProductStock,
+		arp.WithStoreMiddleware(
+			middleware.ForStore[*ProductStock](middleware.Logging(logger)),
+			middleware.ForStore[*ProductStock](middleware.Measure(storeMetrics))),
+		arp.WithMutexesMiddleware(middleware.ForMutexes(middleware.Measure(mutexesMetrics))))
+
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		stock := repo.TakeOrPutIfAbsent(ctx, 1, &ProductStock{1, 10})
+		stock.Decrease(3)
+		return nil
+	})
+	AssertNoError(t, err)
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(3)
+		return nil
+	})
+	AssertNoError(t, err)
+
+	AssertEqual(t, uint64(2), storeMetrics.Stats("SaveAll").Count)
+	AssertTrue(t, storeMetrics.Stats("Load").Count >= 1)
+	AssertEqual(t, uint64(0), storeMetrics.Stats("Load").Errors)
+	AssertTrue(t, mutexesMetrics.Stats("UnlockAll").Count >= 2)
+	AssertTrue(t, strings.Contains(logs.String(), "method=SaveAll"))
+}
+
+func TestMiddlewareRetry(t *testing.T) {
+	store := &flakyStore{MemStore: newStockMemStore(), failures: 2}
+	repo := newStockRepository(store, nil, arp.WithStoreMiddleware(
+		middleware.ForStore[*ProductStock](middleware.Retry(middleware.WithMaxAttempts(3), middleware.WithBackoff(time.Millisecond, 5*time.Millisecond)))))
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, _ := repo.PutIfAbsent(ctx, 1, &ProductStock{1, 10})
+		stock.Increase(1)
+		return nil
+	})
+	AssertNoError(t, err)
+	stock, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 11, stock.freeAmount)
+
+	//超过重试次数
+	store.failures = 3
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Increase(1)
+		return nil
+	})
+	AssertTrue(t, errors.Is(err, middleware.ErrTransient))
+}
+
+func TestMiddlewareTimeout(t *testing.T) {
+	store := &flakyStore{MemStore: newStockMemStore(), slowLoad: true}
+	metrics := middleware.NewCallMetrics()
+	repo := newStockRepository(store, nil, arp.WithStoreMiddleware(
+		middleware.ForStore[*ProductStock](middleware.Measure(metrics)),
+		middleware.ForStore[*ProductStock](middleware.Timeout(20*time.Millisecond))))
+	func() {
+		defer func() {
+			AssertTrue(t, recover() != nil)
+		}()
+		repo.Find(context.Background(), 1)
+	}()
+	AssertEqual(t, uint64(1), metrics.Stats("Load").Errors)
+}
+
+func TestInterceptPreservesInterfaces(t *testing.T) {
+	noop := func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		return call(ctx)
+	}
+	_, ok := arp.InterceptStore[*ProductStock](newStockMemStore(), noop).(arp.QueryStore[*ProductStock])
+	AssertTrue(t, ok)
+
+	leased := arp.InterceptMutexes(repoimpl.NewMemLeasedMutexes(time.Second, nil), noop)
+	_, ok = leased.(arp.TryLeasedMutexes)
+	AssertTrue(t, ok)
+	_, ok = leased.(arp.TryMutexes)
+	AssertTrue(t, ok)
+
+	striped := arp.InterceptMutexes(repoimpl.NewStripedMutexes(4), noop)
+	_, ok = striped.(arp.TryMutexes)
+	AssertTrue(t, ok)
+	_, ok = striped.(arp.LeasedMutexes)
+	AssertFalse(t, ok)
+}
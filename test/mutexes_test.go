@@ -0,0 +1,268 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/faultinject"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+//锁在不再使用之后要被回收
+func TestMemMutexesCleanup(t *testing.T) {
+	mutexes := repoimpl.NewMemMutexes()
+	repo := newStockRepository(nil, mutexes)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*200)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := i % 20
+				errs <- arp.Go(context.Background(), func(ctx context.Context) error {
+					stock := repo.TakeOrPutIfAbsent(ctx, id, &ProductStock{id, 0})
+					stock.Increase(1)
+					return nil
+				})
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		AssertNoError(t, err)
+	}
+	AssertEqual(t, 0, mutexes.Len())
+
+	for id := 0; id < 20; id++ {
+		stock, found := repo.Find(context.Background(), id)
+		AssertTrue(t, found)
+		AssertEqual(t, 80, stock.freeAmount)
+	}
+
+	for id := 0; id < 20; id++ {
+		err := arp.Go(context.Background(), func(ctx context.Context) error {
+			repo.Remove(ctx, id)
+			return nil
+		})
+		AssertNoError(t, err)
+	}
+	AssertEqual(t, 0, mutexes.Len())
+
+	//已删除的entity取不到，也不会留下锁
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		_, found := repo.Take(ctx, 1)
+		AssertFalse(t, found)
+		return nil
+	})
+	AssertNoError(t, err)
+	AssertEqual(t, 0, mutexes.Len())
+
+	//锁被回收后PutIfAbsent仍然能发现已存在的entity
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 5})
+		return nil
+	})
+	AssertNoError(t, err)
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		actual, absent := repo.PutIfAbsent(ctx, 1, &ProductStock{1, 0})
+		AssertFalse(t, absent)
+		AssertEqual(t, 5, actual.freeAmount)
+		return nil
+	})
+	AssertNoError(t, err)
+	AssertEqual(t, 0, mutexes.Len())
+}
+
+//补锁失败之后，抢先补锁的过程在再次加锁之前就释放了，锁被回收，阻塞的Take要重新补锁而不是报告被占用
+func TestMemMutexesRelockAfterCleanup(t *testing.T) {
+	mutexes := repoimpl.NewMemMutexes()
+	var repo arp.Repository[*ProductStock]
+	//Put的时候不拦截
+	var intercepted atomic.Bool
+	intercepted.Store(true)
+	interceptor := func(ctx context.Context, method string, ids []any, call func(ctx context.Context) error) error {
+		if method != "NewAndLock" || !intercepted.CompareAndSwap(false, true) {
+			return call(ctx)
+		}
+		//另一个过程抢先补锁并持有，直到这个NewAndLock失败之后才释放
+		taken, release, done := make(chan struct{}), make(chan struct{}), make(chan error)
+		go func() {
+			done <- arp.Go(context.Background(), func(ctx context.Context) error {
+				stock, _ := repo.Take(ctx, 1)
+				stock.Increase(1)
+				close(taken)
+				<-release
+				return nil
+			})
+		}()
+		<-taken
+		err := call(ctx)
+		close(release)
+		AssertNoError(t, <-done)
+		return err
+	}
+	repo = newStockRepository(nil, arp.InterceptMutexes(mutexes, interceptor))
+	AssertNoError(t, arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 0})
+		return nil
+	}))
+	intercepted.Store(false)
+
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		stock, found := repo.Take(ctx, 1)
+		AssertTrue(t, found)
+		stock.Increase(1)
+		return nil
+	})
+	AssertNoError(t, err)
+	AssertTrue(t, intercepted.Load())
+	stock, _ := repo.Find(context.Background(), 1)
+	AssertEqual(t, 2, stock.freeAmount)
+	AssertEqual(t, 0, mutexes.Len())
+}
+
+func TestStripedMutexes(t *testing.T) {
+	//段数少于id数，同一过程会锁到同一段中的多个id
+	repo := newStockRepository(nil, repoimpl.NewStripedMutexes(2))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				arp.Go(context.Background(), func(ctx context.Context) error {
+					for id := 0; id < 5; id++ {
+						stock := repo.TakeOrPutIfAbsent(ctx, id, &ProductStock{id, 0})
+						stock.Increase(1)
+					}
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id := 0; id < 5; id++ {
+		stock, found := repo.Find(context.Background(), id)
+		AssertTrue(t, found)
+		AssertEqual(t, 800, stock.freeAmount)
+	}
+}
+
+//不同过程以相反的顺序TakeAll多个id，LockAll按段的序号加锁，不会互相死锁
+func TestStripedMutexesTakeAll(t *testing.T) {
+	//每次加锁都等一会儿，逐个加锁的话两个过程各持有一个id等另一个
+	injector := faultinject.NewInjector(1).Add(faultinject.Rule{Method: faultinject.AnyLock, Latency: time.Millisecond})
+	mutexes := faultinject.Mutexes[*ProductStock](repoimpl.NewStripedMutexes(2), injector)
+	repo := newStockRepository(nil, mutexes).(arp.TakeAllRepository[*ProductStock])
+	AssertNoError(t, arp.Go(context.Background(), func(ctx context.Context) error {
+		for id := 0; id < 5; id++ {
+			repo.Put(ctx, id, &ProductStock{id, 0})
+		}
+		return nil
+	}))
+	ascending := []any{0, 1, 2, 3, 4, 5}
+	descending := []any{5, 4, 3, 2, 1, 0}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*50)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			ids := ascending
+			if g%2 == 1 {
+				ids = descending
+			}
+			for i := 0; i < 50; i++ {
+				//死锁的话超时返回错误
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				errs <- arp.Go(ctx, func(ctx context.Context) error {
+					stocks := repo.TakeAll(ctx, ids)
+					//不存在的id不在结果中
+					AssertEqual(t, 5, len(stocks))
+					for _, stock := range stocks {
+						stock.Increase(1)
+					}
+					return nil
+				})
+				cancel()
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		AssertNoError(t, err)
+	}
+	for id := 0; id < 5; id++ {
+		stock, _ := repo.Find(context.Background(), id)
+		AssertEqual(t, 400, stock.freeAmount)
+	}
+}
+
+//等待者只等自己的id，释放同一段中的其他id不会让它获得锁，ctx取消时放弃等待
+func TestStripedMutexesWaitPerId(t *testing.T) {
+	mutexes := repoimpl.NewStripedMutexes(1)
+	ctx := context.Background()
+	mutexes.NewAndLock(ctx, 1)
+	mutexes.NewAndLock(ctx, 2)
+	waitCtx, cancel := context.WithCancel(ctx)
+	locked := make(chan error)
+	go func() {
+		ok, _, err := mutexes.Lock(waitCtx, 1)
+		AssertFalse(t, ok)
+		locked <- err
+	}()
+	mutexes.UnlockAll(ctx, []any{2})
+	ok, _, _ := mutexes.TryLock(ctx, 2, 0)
+	AssertTrue(t, ok)
+	ok, _, _ = mutexes.TryLock(ctx, 1, 10*time.Millisecond)
+	AssertFalse(t, ok)
+	cancel()
+	AssertTrue(t, errors.Is(<-locked, context.Canceled))
+
+	mutexes.UnlockAll(ctx, []any{1})
+	ok, _, _ = mutexes.TryLock(ctx, 1, 0)
+	AssertTrue(t, ok)
+}
+
+func benchmarkModifyStock(b *testing.B, mutexes arp.Mutexes) {
+	orderService := &OrderService{
+		repoimpl.NewMemRepository(func() *Product { return &Product{} }),
+		newStockRepository(nil, mutexes),
+		repoimpl.NewMemRepository(func() *Order { return &Order{} })}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			productId := i % 4
+			arp.Go(context.Background(), func(ctx context.Context) error {
+				if i%2 == 0 {
+					orderService.IncreaseStock(ctx, productId, 1)
+				} else {
+					orderService.DecreaseStock(ctx, productId, 1)
+				}
+				return nil
+			})
+			i++
+		}
+	})
+}
+
+func BenchmarkModifyStockMemMutexes(b *testing.B) {
+	benchmarkModifyStock(b, repoimpl.NewMemMutexes())
+}
+
+func BenchmarkModifyStockStripedMutexes(b *testing.B) {
+	benchmarkModifyStock(b, repoimpl.NewStripedMutexes(64))
+}
@@ -14,7 +14,7 @@ import (
 func TestPlaceOrder(t *testing.T) {
 	orderService := &OrderService{
 		repoimpl.NewMemRepository(func() *Product { return &Product{} }),
-		repoimpl.NewMemRepository(func() *ProductStock { return &ProductStock{} }),
+		repoimpl.NewMemRepository(newZeroProductStock),
 		repoimpl.NewMemRepository(func() *Order { return &Order{} })}
 
 	err := arp.Go(context.Background(), func(ctx context.Context) error {
@@ -73,7 +73,7 @@ func TestPlaceOrder(t *testing.T) {
 func TestModifyStock(t *testing.T) {
 	orderService := &OrderService{
 		repoimpl.NewMemRepository(func() *Product { return &Product{} }),
-		repoimpl.NewMemRepository(func() *ProductStock { return &ProductStock{} }),
+		repoimpl.NewMemRepository(newZeroProductStock),
 		repoimpl.NewMemRepository(func() *Order { return &Order{} })}
 
 	err := arp.Go(context.Background(), func(ctx context.Context) error {
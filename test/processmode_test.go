@@ -0,0 +1,143 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/codec"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+func TestStrictProcessMode(t *testing.T) {
+	repo := repoimpl.NewMemRepository(newZeroProductStock, arp.WithProcessMode(arp.ProcessModeStrict))
+
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		return nil
+	})
+	AssertNoError(t, err)
+
+	func() {
+		defer func() {
+			r := recover()
+			err, _ := r.(error)
+			AssertTrue(t, errors.Is(err, arp.ErrNoProcess))
+		}()
+		repo.Take(context.Background(), 1)
+	}()
+
+	//只读的Find不受影响
+	stock, found := repo.Find(context.Background(), 1)
+	AssertTrue(t, found)
+	AssertEqual(t, 10, stock.freeAmount)
+}
+
+func TestAutoProcessMode(t *testing.T) {
+	repo := repoimpl.NewMemRepository(newZeroProductStock, arp.WithProcessMode(arp.ProcessModeAuto))
+
+	repo.Put(context.Background(), 1, &ProductStock{1, 10})
+	stock, found := repo.Find(context.Background(), 1)
+	AssertTrue(t, found)
+	AssertEqual(t, 10, stock.freeAmount)
+
+	//锁在自动过程结束时已释放
+	repo.Take(context.Background(), 1)
+	done := make(chan struct{})
+	go func() {
+		arp.Go(context.Background(), func(ctx context.Context) error {
+			stock, _ := repo.Take(ctx, 1)
+			stock.Increase(1)
+			return nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("entity still locked")
+	}
+
+	removed, exists := repo.Remove(context.Background(), 1)
+	AssertTrue(t, exists)
+	AssertEqual(t, 11, removed.freeAmount)
+	_, found = repo.Find(context.Background(), 1)
+	AssertFalse(t, found)
+}
+
+type StrictCounter struct {
+	count int
+}
+
+type AutoCounter struct {
+	count int
+}
+
+func TestStrictProcessModeSingleton(t *testing.T) {
+	repo := arp.NewSingletonRepository(&StrictCounter{}, arp.WithProcessMode(arp.ProcessModeStrict))
+	_, err := repo.Take(context.Background())
+	AssertTrue(t, errors.Is(err, arp.ErrNoProcess))
+	err = repo.Put(context.Background(), &StrictCounter{1})
+	AssertTrue(t, errors.Is(err, arp.ErrNoProcess))
+
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		counter, err := repo.Take(ctx)
+		if err != nil {
+			return err
+		}
+		counter.count++
+		return nil
+	})
+	AssertNoError(t, err)
+	counter, _ := repo.Get(context.Background())
+	AssertEqual(t, 1, counter.count)
+
+	path := filepath.Join(t.TempDir(), "counter.json")
+	stored := repoimpl.NewFileSingletonRepository[StrictCounter](path, codec.NewJSONCodec[*StrictCounter](), func() *StrictCounter { return &StrictCounter{} }, arp.WithProcessMode(arp.ProcessModeStrict))
+	_, err = stored.Take(context.Background())
+	AssertTrue(t, errors.Is(err, arp.ErrNoProcess))
+	err = stored.Put(context.Background(), &StrictCounter{1})
+	AssertTrue(t, errors.Is(err, arp.ErrNoProcess))
+	_, err = os.Stat(path)
+	AssertTrue(t, os.IsNotExist(err))
+}
+
+func TestAutoProcessModeSingleton(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter.json")
+	repo := repoimpl.NewFileSingletonRepository[AutoCounter](path, codec.NewJSONCodec[*AutoCounter](), func() *AutoCounter { return &AutoCounter{} }, arp.WithProcessMode(arp.ProcessModeAuto))
+
+	AssertNoError(t, repo.Put(context.Background(), &AutoCounter{10}))
+	counter, _ := repo.Get(context.Background())
+	AssertEqual(t, 10, counter.count)
+
+	//锁在自动过程结束时已释放，Take得到的实体上的修改不会被保存
+	counter, err := repo.Take(context.Background())
+	AssertNoError(t, err)
+	counter.count = 100
+	done := make(chan error)
+	go func() {
+		done <- arp.Go(context.Background(), func(ctx context.Context) error {
+			counter, err := repo.Take(ctx)
+			if err != nil {
+				return err
+			}
+			counter.count++
+			return nil
+		})
+	}()
+	select {
+	case err = <-done:
+		AssertNoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("singleton still locked")
+	}
+
+	reloaded := repoimpl.NewFileSingletonRepository[AutoCounter](path, codec.NewJSONCodec[*AutoCounter](), func() *AutoCounter { return &AutoCounter{} })
+	counter, err = reloaded.Get(context.Background())
+	AssertNoError(t, err)
+	AssertEqual(t, 11, counter.count)
+}
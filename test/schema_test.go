@@ -0,0 +1,188 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/codec"
+	"github.com/framework-arp/ARP4G/repoimpl"
+	"github.com/framework-arp/ARP4G/schema"
+)
+
+//版本3的Customer，版本1中地址字段叫address，版本2增加了level
+type Customer struct {
+	id          int
+	name        string
+	userAddress string
+	level       int
+	vip         bool
+}
+
+func init() {
+	schema.RegisterUpcaster[*Customer](1, func(doc map[string]any) (map[string]any, error) {
+		doc["userAddress"] = doc["address"]
+		delete(doc, "address")
+		return doc, nil
+	})
+	schema.RegisterUpcaster[*Customer](2, func(doc map[string]any) (map[string]any, error) {
+		var level int
+		if err := codec.FromDocument(doc["level"], &level); err != nil {
+			return nil, err
+		}
+		doc["vip"] = level >= 3
+		return doc, nil
+	})
+}
+
+func TestSchemaUpcastAndMigrate(t *testing.T) {
+	dir := t.TempDir()
+	//用旧版本的程序写入的数据
+	oldStore, err := repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	AssertNoError(t, err)
+	AssertNoError(t, oldStore.Save(context.Background(), 1, map[string]any{"id": 1, "name": "tom", "address": "Beijing"}))
+	AssertNoError(t, oldStore.Save(context.Background(), 2, map[string]any{
+		"$schemaVersion": 2, "$entity": map[string]any{"id": 2, "name": "amy", "userAddress": "Shanghai", "level": 5}}))
+	AssertNoError(t, oldStore.Close())
+
+	AssertEqual(t, 3, schema.CurrentVersion[*Customer]())
+	store, err := repoimpl.OpenFileStore[*Customer](dir, schema.NewVersionedCodec[*Customer](codec.NewJSONCodec[map[string]any]()))
+	AssertNoError(t, err)
+	customer, found, err := store.Load(context.Background(), 1)
+	AssertNoError(t, err)
+	AssertTrue(t, found)
+	AssertEqual(t, "Beijing", customer.userAddress)
+	AssertFalse(t, customer.vip)
+	customer, _, _ = store.Load(context.Background(), 2)
+	AssertEqual(t, "Shanghai", customer.userAddress)
+	AssertTrue(t, customer.vip)
+
+	migrated, err := schema.Migrate[*Customer](context.Background(), store, 1)
+	AssertNoError(t, err)
+	AssertEqual(t, 2, migrated)
+	AssertNoError(t, store.Close())
+
+	//迁移之后保存的都是当前版本
+	rawStore, err := repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	AssertNoError(t, err)
+	for _, id := range []int{1, 2} {
+		raw, _, err := rawStore.Load(context.Background(), id)
+		AssertNoError(t, err)
+		AssertEqual(t, 3, docVersion(t, raw))
+	}
+	AssertNoError(t, rawStore.Close())
+}
+
+func TestSchemaUnknownVersion(t *testing.T) {
+	c := codec.NewJSONCodec[map[string]any]()
+	data, err := c.Encode(map[string]any{"$schemaVersion": 9, "$entity": map[string]any{"id": 1}})
+	AssertNoError(t, err)
+	_, err = schema.NewVersionedCodec[*Customer](c).Decode(data)
+	AssertTrue(t, errors.Is(err, schema.ErrUnknownVersion))
+}
+
+//字段名恰好是schemaVersion和entity的实体，没有版本信息时不能被当作带版本的文档
+type Envelope struct {
+	schemaVersion int
+	entity        string
+}
+
+func TestVersionedStoreAndMigrateDocuments(t *testing.T) {
+	dir := t.TempDir()
+	bg := context.Background()
+	docStore, err := repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	AssertNoError(t, err)
+	AssertNoError(t, docStore.Save(bg, 1, map[string]any{"id": 1, "name": "tom", "address": "Beijing"}))
+	AssertNoError(t, docStore.Save(bg, 2, map[string]any{
+		"$schemaVersion": 2, "$entity": map[string]any{"id": 2, "name": "amy", "userAddress": "Shanghai", "level": 5}}))
+
+	//可以装饰任何保存文档的store，用在仓库中
+	store := schema.NewVersionedStore[*Customer](docStore)
+	repo := arp.NewQueryRepository[*Customer](store, repoimpl.NewMemMutexes(), func() *Customer { return &Customer{} })
+	customer, found := repo.Find(bg, 1)
+	AssertTrue(t, found)
+	AssertEqual(t, "Beijing", customer.userAddress)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		customer, _ := repo.Take(ctx, 2)
+		customer.name = "amy2"
+		repo.Put(ctx, 3, &Customer{id: 3, name: "bob", level: 3, vip: true})
+		return nil
+	}))
+	customers, err := repo.QueryAllByField(bg, "vip", true)
+	AssertNoError(t, err)
+	AssertEqual(t, 2, len(customers))
+	doc, _, _ := docStore.Load(bg, 2)
+	AssertEqual(t, 3, docVersion(t, doc))
+
+	migrated, err := schema.MigrateDocuments(bg, arp.TypeFullname[*Customer](), docStore, 2)
+	AssertNoError(t, err)
+	AssertEqual(t, 3, migrated)
+	doc, _, _ = docStore.Load(bg, 1)
+	AssertEqual(t, 3, docVersion(t, doc))
+	AssertEqual(t, "Beijing", doc["$entity"].(map[string]any)["userAddress"])
+
+	//重新打开之后迁移过的实体仍然可以加载，数字没有变成字符串
+	AssertNoError(t, docStore.Close())
+	docStore, err = repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	AssertNoError(t, err)
+	store = schema.NewVersionedStore[*Customer](docStore)
+	for _, expected := range []*Customer{
+		{id: 1, name: "tom", userAddress: "Beijing"},
+		{id: 2, name: "amy2", userAddress: "Shanghai", level: 5, vip: true},
+		{id: 3, name: "bob", level: 3, vip: true},
+	} {
+		customer, found, err := store.Load(bg, expected.id)
+		AssertNoError(t, err)
+		AssertTrue(t, found)
+		AssertEqual(t, expected, customer)
+	}
+
+	envelopes := schema.NewVersionedStore[*Envelope](docStore)
+	AssertNoError(t, docStore.Save(bg, 4, map[string]any{"schemaVersion": 1, "entity": "letter"}))
+	envelope, found, err := envelopes.Load(bg, 4)
+	AssertNoError(t, err)
+	AssertTrue(t, found)
+	AssertEqual(t, "letter", envelope.entity)
+	AssertNoError(t, docStore.Close())
+}
+
+type Tally struct {
+	id    int
+	count int
+	ratio float64
+}
+
+func TestArpmigrate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go run")
+	}
+	dir := t.TempDir()
+	docStore, err := repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	AssertNoError(t, err)
+	AssertNoError(t, docStore.Save(context.Background(), 1, map[string]any{"id": 1, "count": 7, "ratio": 0.5}))
+	AssertNoError(t, docStore.Close())
+
+	//命令中没有注册Upcaster，只会加上版本1
+	out, err := exec.Command("go", "run", "../cmd/arpmigrate", "-type", arp.TypeFullname[*Tally](), dir).CombinedOutput()
+	AssertNoError(t, err)
+	AssertTrue(t, strings.Contains(string(out), "migrated 1 entities"))
+	docStore, err = repoimpl.OpenFileStore[map[string]any](dir, codec.NewJSONCodec[map[string]any]())
+	AssertNoError(t, err)
+	doc, _, _ := docStore.Load(context.Background(), 1)
+	AssertEqual(t, 1, docVersion(t, doc))
+	tally, found, err := schema.NewVersionedStore[*Tally](docStore).Load(context.Background(), 1)
+	AssertNoError(t, err)
+	AssertTrue(t, found)
+	AssertEqual(t, &Tally{1, 7, 0.5}, tally)
+	AssertNoError(t, docStore.Close())
+}
+
+func docVersion(t *testing.T, doc map[string]any) int {
+	t.Helper()
+	var version int
+	AssertNoError(t, codec.FromDocument(doc["$schemaVersion"], &version))
+	return version
+}
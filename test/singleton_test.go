@@ -0,0 +1,71 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/codec"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+//字段都是未导出的，和仓库里其他的聚合一样
+type SystemConfig struct {
+	orderSeq int
+	name     string
+}
+
+func TestStoredSingletonRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	repo := repoimpl.NewFileSingletonRepository[SystemConfig](path, codec.NewJSONCodec[*SystemConfig](), func() *SystemConfig { return &SystemConfig{} })
+
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		config, err := repo.Take(ctx)
+		if err != nil {
+			return err
+		}
+		config.orderSeq++
+		config.name = "shop"
+		return nil
+	})
+	AssertNoError(t, err)
+
+	//Get得到的是副本
+	config, err := repo.Get(context.Background())
+	AssertNoError(t, err)
+	AssertEqual(t, 1, config.orderSeq)
+	config.orderSeq = 100
+	config, _ = repo.Get(context.Background())
+	AssertEqual(t, 1, config.orderSeq)
+
+	//过程失败，变化不会保存
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		config, _ := repo.Take(ctx)
+		config.orderSeq++
+		return errors.New("abort")
+	})
+	AssertError(t, err)
+	config, _ = repo.Get(context.Background())
+	AssertEqual(t, 1, config.orderSeq)
+
+	//同一过程中多次Take
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		config, _ := repo.Take(ctx)
+		config.orderSeq++
+		config, _ = repo.Take(ctx)
+		config.orderSeq++
+		inProcess, _ := repo.Get(ctx)
+		AssertEqual(t, 3, inProcess.orderSeq)
+		return nil
+	})
+	AssertNoError(t, err)
+
+	//重新从文件加载
+	reloaded := repoimpl.NewFileSingletonRepository[SystemConfig](path, codec.NewJSONCodec[*SystemConfig](), func() *SystemConfig { return &SystemConfig{} })
+	config, err = reloaded.Get(context.Background())
+	AssertNoError(t, err)
+	AssertEqual(t, 3, config.orderSeq)
+	AssertEqual(t, "shop", config.name)
+}
@@ -0,0 +1,37 @@
+package test
+
+import (
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+//测试中共用的ProductStock仓库和store
+func newZeroProductStock() *ProductStock {
+	return &ProductStock{}
+}
+
+func newStockMemStore() *repoimpl.MemStore[*ProductStock] {
+	return repoimpl.NewMemStore(newZeroProductStock)
+}
+
+//store为nil时使用MemStore，mutexes为nil时使用MemMutexes
+func newStockRepository(store arp.Store[*ProductStock], mutexes arp.Mutexes, opts ...arp.RepositoryOption) arp.Repository[*ProductStock] {
+	store, mutexes = stockStoreAndMutexes(store, mutexes)
+	return arp.NewRepository[*ProductStock](store, mutexes, newZeroProductStock, opts...)
+}
+
+//store需要实现QueryStore
+func newStockQueryRepository(store arp.Store[*ProductStock], mutexes arp.Mutexes, opts ...arp.RepositoryOption) arp.QueryRepository[*ProductStock] {
+	store, mutexes = stockStoreAndMutexes(store, mutexes)
+	return arp.NewQueryRepository[*ProductStock](store.(arp.QueryStore[*ProductStock]), mutexes, newZeroProductStock, opts...)
+}
+
+func stockStoreAndMutexes(store arp.Store[*ProductStock], mutexes arp.Mutexes) (arp.Store[*ProductStock], arp.Mutexes) {
+	if store == nil {
+		store = newStockMemStore()
+	}
+	if mutexes == nil {
+		mutexes = repoimpl.NewMemMutexes()
+	}
+	return store, mutexes
+}
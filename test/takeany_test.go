@@ -0,0 +1,113 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/faultinject"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+type Job struct {
+	id     int
+	state  string
+	worker int
+}
+
+func TestTakeAny(t *testing.T) {
+	repo := repoimpl.NewMemQueryRepository(func() *Job { return &Job{} })
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		for i := 0; i < 10; i++ {
+			repo.Put(ctx, i, &Job{i, "pending", 0})
+		}
+		return nil
+	})
+	AssertNoError(t, err)
+
+	pending := arp.QueryFilter{FieldName: "state", FieldValue: "pending"}
+	var wg sync.WaitGroup
+	for worker := 1; worker <= 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			err := arp.Go(context.Background(), func(ctx context.Context) error {
+				jobs, err := repo.TakeAny(ctx, pending, 2)
+				if err != nil {
+					return err
+				}
+				AssertEqual(t, 2, len(jobs))
+				for _, job := range jobs {
+					job.state = "running"
+					job.worker = worker
+				}
+				//持有一段时间，让别的worker领取时遇到被占用的任务
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			})
+			AssertNoError(t, err)
+		}(worker)
+	}
+	wg.Wait()
+
+	running, err := repo.QueryAllByField(context.Background(), "state", "running")
+	AssertNoError(t, err)
+	AssertEqual(t, 8, len(running))
+	jobsByWorker := make(map[int]int)
+	for _, job := range running {
+		jobsByWorker[job.worker]++
+	}
+	AssertEqual(t, map[int]int{1: 2, 2: 2, 3: 2, 4: 2}, jobsByWorker)
+
+	count, _ := repo.Count(context.Background())
+	AssertEqual(t, uint64(10), count)
+
+	//剩下的都能领取到，不符合条件的不会被占用
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		jobs, _ := repo.TakeAny(ctx, pending, 5)
+		AssertEqual(t, 2, len(jobs))
+		return nil
+	})
+	AssertNoError(t, err)
+}
+
+func TestTakeAnyErrors(t *testing.T) {
+	newZeroJob := func() *Job { return &Job{} }
+	store := repoimpl.NewMemStore(newZeroJob)
+	mutexes := repoimpl.NewMemMutexes()
+	injector := faultinject.NewInjector(1).Add(faultinject.Rule{Method: "TryLock", Id: 3, Err: faultinject.ErrInjected})
+	repo := arp.NewQueryRepository[*Job](store, faultinject.Mutexes[*Job](mutexes, injector), newZeroJob)
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		for i := 0; i < 5; i++ {
+			repo.Put(ctx, i, &Job{i, "pending", 0})
+		}
+		return nil
+	})
+	AssertNoError(t, err)
+	pending := arp.QueryFilter{FieldName: "state", FieldValue: "pending"}
+
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		_, err := repo.TakeAny(ctx, pending, -1)
+		return err
+	})
+	AssertTrue(t, err != nil)
+
+	//加锁出错时返回错误，已经取得的锁在过程结束时释放
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		_, err := repo.TakeAny(ctx, pending, 5)
+		return err
+	})
+	AssertTrue(t, errors.Is(err, faultinject.ErrInjected))
+	AssertEqual(t, 0, mutexes.Len())
+
+	//不支持尝试加锁的mutexes
+	repo = arp.NewQueryRepository[*Job](store, struct{ arp.Mutexes }{mutexes}, newZeroJob)
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		_, err := repo.TakeAny(ctx, pending, 1)
+		return err
+	})
+	AssertTrue(t, errors.Is(err, arp.ErrTryLockUnsupported))
+}
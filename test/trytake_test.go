@@ -0,0 +1,95 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/repoext"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+func TestTryTake(t *testing.T) {
+	allMutexes := map[string]arp.Mutexes{
+		"mem":     repoimpl.NewMemMutexes(),
+		"striped": repoimpl.NewStripedMutexes(4),
+		"fair":    repoimpl.NewFairMutexes(),
+		"leased":  repoimpl.NewMemLeasedMutexes(time.Minute, nil),
+	}
+	for name, mutexes := range allMutexes {
+		t.Run(name, func(t *testing.T) {
+			repo := newStockRepository(nil, mutexes).(arp.TryRepository[*ProductStock])
+			err := arp.Go(context.Background(), func(ctx context.Context) error {
+				repo.Put(ctx, 1, &ProductStock{1, 10})
+				return nil
+			})
+			AssertNoError(t, err)
+
+			ctxA := arp.Start(context.Background())
+			stock, found, occupied := repo.TryTake(ctxA, 1)
+			AssertTrue(t, found)
+			AssertFalse(t, occupied)
+			stock.Increase(1)
+
+			err = arp.Go(context.Background(), func(ctx context.Context) error {
+				_, found, occupied := repo.TryTake(ctx, 1)
+				AssertFalse(t, found)
+				AssertTrue(t, occupied)
+				start := time.Now()
+				_, _, occupied = repo.TakeWithin(ctx, 1, 30*time.Millisecond)
+				AssertTrue(t, occupied)
+				AssertTrue(t, time.Since(start) >= 30*time.Millisecond)
+				//不存在的entity
+				_, found, occupied = repo.TryTake(ctx, 2)
+				AssertFalse(t, found)
+				AssertFalse(t, occupied)
+				return nil
+			})
+			AssertNoError(t, err)
+
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				arp.Finish(ctxA)
+			}()
+			err = arp.Go(context.Background(), func(ctx context.Context) error {
+				stock, found, occupied := repo.TakeWithin(ctx, 1, time.Second)
+				AssertTrue(t, found)
+				AssertFalse(t, occupied)
+				stock.Increase(1)
+				return nil
+			})
+			AssertNoError(t, err)
+			stock, _ = repo.Find(context.Background(), 1)
+			AssertEqual(t, 12, stock.freeAmount)
+		})
+	}
+}
+
+//只实现了Mutexes，不支持TryLock
+type plainMutexes struct {
+	arp.Mutexes
+}
+
+//错误信息里是实际调用的方法名，装饰的仓库不支持时也返回错误
+func TestTryTakeUnsupported(t *testing.T) {
+	repo := newStockRepository(nil, &plainMutexes{repoimpl.NewMemMutexes()}).(arp.TryRepository[*ProductStock])
+	err := arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.TakeWithin(ctx, 1, time.Millisecond)
+		return nil
+	})
+	AssertTrue(t, strings.HasPrefix(err.Error(), "TakeWithin error: "+arp.ErrTryLockUnsupported.Error()))
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.TryTake(ctx, 1)
+		return nil
+	})
+	AssertTrue(t, strings.HasPrefix(err.Error(), "TryTake error: "+arp.ErrTryLockUnsupported.Error()))
+
+	cached := repoext.NewViewCachedRepository[*ProductStock](&countingStockRepository{Repository: repo}).(arp.TryRepository[*ProductStock])
+	err = arp.Go(context.Background(), func(ctx context.Context) error {
+		cached.TakeWithin(ctx, 1, time.Millisecond)
+		return nil
+	})
+	AssertEqual(t, "TakeWithin error: "+arp.ErrTryTakeUnsupported.Error(), err.Error())
+}
@@ -0,0 +1,478 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+	"github.com/framework-arp/ARP4G/faultinject"
+	"github.com/framework-arp/ARP4G/repoext"
+	"github.com/framework-arp/ARP4G/repoimpl"
+)
+
+func TestViewCachedRepositoryCommitted(t *testing.T) {
+	injector := faultinject.NewInjector(1)
+	store := faultinject.Store[*ProductStock](newStockMemStore(), injector)
+	repo := repoext.NewViewCachedRepository(newStockRepository(store, nil))
+	bg := context.Background()
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		//过程之外看不到未提交的新实体
+		_, found := repo.Find(bg, 1)
+		AssertFalse(t, found)
+		return nil
+	}))
+	stock, _ := repo.Find(bg, 1)
+	AssertEqual(t, 10, stock.freeAmount)
+
+	//未提交的修改只有本过程能看到
+	ctx := arp.Start(bg)
+	stock, _ = repo.Take(ctx, 1)
+	stock.Decrease(3)
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 10, stock.freeAmount)
+	stock, _ = repo.Find(ctx, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+	AssertNoError(t, arp.Finish(ctx))
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+
+	//放弃的过程不影响缓存
+	ctx = arp.Start(bg)
+	stock, _ = repo.Take(ctx, 1)
+	stock.Decrease(3)
+	arp.Abort(ctx)
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+
+	//保存失败的过程也不影响缓存
+	injector.Add(faultinject.Rule{Method: "SaveAll", Nth: 1, Err: faultinject.ErrInjected})
+	err := arp.Go(bg, func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(3)
+		return nil
+	})
+	AssertTrue(t, err != nil)
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 7, stock.freeAmount)
+
+	//删除提交之后缓存中也不存在了
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Remove(ctx, 1)
+		_, found := repo.Find(ctx, 1)
+		AssertFalse(t, found)
+		return nil
+	}))
+	_, found := repo.Find(bg, 1)
+	AssertFalse(t, found)
+}
+
+func TestViewCachedRepositoryEviction(t *testing.T) {
+	bg := context.Background()
+	for _, policy := range []repoext.EvictionPolicy{repoext.EvictLRU, repoext.EvictLFU} {
+		store := newStockMemStore()
+		for id := 1; id <= 3; id++ {
+			AssertNoError(t, store.Save(bg, id, &ProductStock{id, 10}))
+		}
+		repo := repoext.NewViewCachedRepository(newStockRepository(store, nil),
+			repoext.WithMaxEntries(2), repoext.WithEvictionPolicy(policy)).(*repoext.ViewCachedRepository[*ProductStock])
+		repo.Find(bg, 1)
+		repo.Find(bg, 1)
+		repo.Find(bg, 1)
+		repo.Find(bg, 2)
+		repo.Find(bg, 2)
+		//LRU淘汰最久没有访问的1，LFU淘汰访问次数少的2
+		repo.Find(bg, 3)
+		stats := repo.Stats()
+		AssertEqual(t, uint64(1), stats.Evictions)
+		AssertEqual(t, 2, stats.Size)
+		AssertEqual(t, uint64(3), stats.Hits)
+		AssertEqual(t, uint64(3), stats.Misses)
+		repo.Find(bg, 1)
+		if policy == repoext.EvictLRU {
+			AssertEqual(t, uint64(4), repo.Stats().Misses)
+		} else {
+			AssertEqual(t, uint64(3), repo.Stats().Misses)
+		}
+	}
+}
+
+//LFU会老化，以前访问很多的条目在不再访问之后也会被淘汰
+func TestViewCachedRepositoryLFUAging(t *testing.T) {
+	bg := context.Background()
+	store := newStockMemStore()
+	for id := 1; id <= 12; id++ {
+		AssertNoError(t, store.Save(bg, id, &ProductStock{id, 10}))
+	}
+	repo := repoext.NewViewCachedRepository(newStockRepository(store, nil),
+		repoext.WithMaxEntries(2), repoext.WithEvictionPolicy(repoext.EvictLFU)).(*repoext.ViewCachedRepository[*ProductStock])
+	for i := 0; i < 6; i++ {
+		repo.Find(bg, 1)
+	}
+	//之后的新条目从当前年龄开始计数，年龄随着淘汰增长，最终追上1的访问次数
+	for id := 2; id <= 12; id++ {
+		repo.Find(bg, id)
+	}
+	misses := repo.Stats().Misses
+	repo.Find(bg, 1)
+	AssertEqual(t, misses+1, repo.Stats().Misses)
+}
+
+func TestViewCachedRepositoryTTL(t *testing.T) {
+	bg := context.Background()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newStockMemStore()
+	AssertNoError(t, store.Save(bg, 1, &ProductStock{1, 10}))
+	repo := repoext.NewViewCachedRepository(newStockRepository(store, nil),
+		repoext.WithTTL(time.Minute), repoext.WithNegativeTTL(time.Second), repoext.WithCacheClock(clock)).(*repoext.ViewCachedRepository[*ProductStock])
+
+	_, found := repo.Find(bg, 2)
+	AssertFalse(t, found)
+	repo.Find(bg, 1)
+	//绕过仓库直接写入store
+	AssertNoError(t, store.Save(bg, 2, &ProductStock{2, 20}))
+	_, found = repo.Find(bg, 2)
+	AssertFalse(t, found)
+	clock.Advance(2 * time.Second)
+	stock, found := repo.Find(bg, 2)
+	AssertTrue(t, found)
+	AssertEqual(t, 20, stock.freeAmount)
+	AssertEqual(t, uint64(1), repo.Stats().Expirations)
+
+	clock.Advance(2 * time.Minute)
+	repo.Find(bg, 1)
+	AssertEqual(t, uint64(2), repo.Stats().Expirations)
+}
+
+//不是arp.RepositoryImpl的仓库
+type countingStockRepository struct {
+	arp.Repository[*ProductStock]
+	finds int
+}
+
+func (repo *countingStockRepository) Find(ctx context.Context, id any) (*ProductStock, bool) {
+	repo.finds++
+	return repo.Repository.Find(ctx, id)
+}
+
+func TestViewCachedRepositoryDecorator(t *testing.T) {
+	bg := context.Background()
+	inner := &countingStockRepository{Repository: repoimpl.NewMemRepository(newZeroProductStock)}
+	repo := repoext.NewViewCachedRepository[*ProductStock](inner)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, 1, &ProductStock{1, 10})
+		return nil
+	}))
+	stock, _ := repo.Find(bg, 1)
+	AssertEqual(t, 10, stock.freeAmount)
+	AssertEqual(t, 0, inner.finds)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(4)
+		return nil
+	}))
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 6, stock.freeAmount)
+	_, found := repo.Find(bg, 2)
+	AssertFalse(t, found)
+	repo.Find(bg, 2)
+	AssertEqual(t, 1, inner.finds)
+	_, err := repo.(arp.QueryRepository[*ProductStock]).QueryAllIds(bg)
+	AssertTrue(t, errors.Is(err, arp.ErrQueryUnsupported))
+}
+
+//被装饰的仓库的查询、TakeAny和TakeAll不会被挡住
+func TestViewCachedRepositoryForwardQuery(t *testing.T) {
+	bg := context.Background()
+	vcr := repoext.NewViewCachedRepository[*ProductStock](newStockQueryRepository(nil, nil))
+	repo, ok := vcr.(arp.QueryRepository[*ProductStock])
+	AssertTrue(t, ok)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		for id := 1; id <= 3; id++ {
+			repo.Put(ctx, id, &ProductStock{id, 10})
+		}
+		return nil
+	}))
+	ids, err := repo.QueryAllIds(bg)
+	AssertNoError(t, err)
+	AssertEqual(t, 3, len(ids))
+	stocks, err := repo.QueryAllByField(bg, "freeAmount", 10)
+	AssertNoError(t, err)
+	AssertEqual(t, 3, len(stocks))
+
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		stocks, err := repo.TakeAny(ctx, arp.QueryFilter{FieldName: "freeAmount", FieldValue: 10}, 2)
+		if err != nil {
+			return err
+		}
+		AssertEqual(t, 2, len(stocks))
+		for _, stock := range stocks {
+			stock.Decrease(1)
+		}
+		taken := vcr.(arp.TakeAllRepository[*ProductStock]).TakeAll(ctx, []any{1, 2, 3, 4})
+		AssertEqual(t, 3, len(taken))
+		return nil
+	}))
+	stocks, _ = repo.QueryAllByField(bg, "freeAmount", 9)
+	AssertEqual(t, 2, len(stocks))
+}
+
+type countingStockQueryRepository struct {
+	arp.QueryRepository[*ProductStock]
+	finds int
+}
+
+func (repo *countingStockQueryRepository) Find(ctx context.Context, id any) (*ProductStock, bool) {
+	repo.finds++
+	return repo.QueryRepository.Find(ctx, id)
+}
+
+func TestViewCachedRepositoryCountAndWarmUp(t *testing.T) {
+	bg := context.Background()
+	inner := &countingStockQueryRepository{QueryRepository: repoimpl.NewMemQueryRepository(newZeroProductStock)}
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		for id := 1; id <= 5; id++ {
+			inner.Put(ctx, id, &ProductStock{id, 10})
+		}
+		return nil
+	}))
+	repo := repoext.NewViewCachedRepository[*ProductStock](inner).(*repoext.ViewCachedRepository[*ProductStock])
+	AssertNoError(t, repo.WarmUp(bg))
+	AssertEqual(t, 5, inner.finds)
+	for id := 1; id <= 5; id++ {
+		stock, found := repo.Find(bg, id)
+		AssertTrue(t, found)
+		AssertEqual(t, 10, stock.freeAmount)
+	}
+	AssertEqual(t, 5, inner.finds)
+
+	count, err := repo.Count(bg)
+	AssertNoError(t, err)
+	AssertEqual(t, uint64(5), count)
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.Put(ctx, 6, &ProductStock{6, 10})
+		repo.Put(ctx, 7, &ProductStock{7, 10})
+		repo.Remove(ctx, 1)
+		return nil
+	}))
+	count, _ = repo.Count(bg)
+	AssertEqual(t, uint64(6), count)
+	storeCount, _ := inner.Count(bg)
+	AssertEqual(t, storeCount, count)
+
+	//PutIfAbsent和TakeOrPutIfAbsent直接保存的新实体也要计数
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		repo.PutIfAbsent(ctx, 8, &ProductStock{8, 10})
+		return nil
+	}))
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		stock := repo.TakeOrPutIfAbsent(ctx, 9, &ProductStock{9, 0})
+		stock.Increase(1)
+		return nil
+	}))
+	count, _ = repo.Count(bg)
+	AssertEqual(t, uint64(8), count)
+	storeCount, _ = inner.Count(bg)
+	AssertEqual(t, storeCount, count)
+
+	//不支持查询的仓库
+	plain := repoext.NewViewCachedRepository[*ProductStock](&countingStockRepository{Repository: repoimpl.NewMemRepository(newZeroProductStock)}).(*repoext.ViewCachedRepository[*ProductStock])
+	_, err = plain.Count(bg)
+	AssertTrue(t, errors.Is(err, arp.ErrQueryUnsupported))
+	AssertTrue(t, errors.Is(plain.WarmUp(bg), arp.ErrQueryUnsupported))
+}
+
+//缓存了不存在之后创建的实体，过程中取出但没有修改，提交后也要能找到
+func TestViewCachedRepositoryNegativeEntryRefreshed(t *testing.T) {
+	bg := context.Background()
+	store := newStockMemStore()
+	repo := repoext.NewViewCachedRepository(newStockRepository(store, nil))
+	defer repo.(*repoext.ViewCachedRepository[*ProductStock]).Close()
+	_, found := repo.Find(bg, 1)
+	AssertFalse(t, found)
+	_, found = repo.Find(bg, 2)
+	AssertFalse(t, found)
+
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		_, absent := repo.PutIfAbsent(ctx, 1, &ProductStock{1, 10})
+		AssertTrue(t, absent)
+		return nil
+	}))
+	stock, found := repo.Find(bg, 1)
+	AssertTrue(t, found)
+	AssertEqual(t, 10, stock.freeAmount)
+
+	//绕过仓库创建的
+	AssertNoError(t, store.Save(bg, 2, &ProductStock{2, 20}))
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		_, found := repo.Take(ctx, 2)
+		AssertTrue(t, found)
+		return nil
+	}))
+	stock, found = repo.Find(bg, 2)
+	AssertTrue(t, found)
+	AssertEqual(t, 20, stock.freeAmount)
+}
+
+//只在这个测试中使用的实体类型，不会收到别的测试的过程通知
+type Memo struct {
+	text string
+}
+
+type panickingListener struct {
+	aborted []any
+}
+
+func (listener *panickingListener) Committed(ctx context.Context, changes *arp.ChangeSet) {
+	panic("listener failed")
+}
+
+func (listener *panickingListener) Aborted(ctx context.Context, entityType string, ids []any) {
+	listener.aborted = append(listener.aborted, ids...)
+}
+
+//Committed panic时记录日志，并用涉及的id调用Aborted
+func TestProcessListenerPanic(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(defaultLogger)
+	repo := repoimpl.NewMemRepository(func() *Memo { return &Memo{} })
+	listener := &panickingListener{}
+	arp.AddProcessListener(arp.TypeFullname[Memo](), listener)
+	defer arp.RemoveProcessListener(arp.TypeFullname[Memo](), listener)
+
+	AssertNoError(t, arp.Go(context.Background(), func(ctx context.Context) error {
+		repo.Put(ctx, 1, &Memo{"hello"})
+		return nil
+	}))
+	AssertEqual(t, []any{1}, listener.aborted)
+	AssertTrue(t, strings.Contains(logs.String(), "process listener panicked"))
+	AssertTrue(t, strings.Contains(logs.String(), "listener failed"))
+}
+
+func TestViewCachedRepositoryInvalidationBus(t *testing.T) {
+	bg := context.Background()
+	store := newStockMemStore()
+	AssertNoError(t, store.Save(bg, 1, &ProductStock{1, 10}))
+	bus := repoext.NewMemInvalidationBus()
+	var messages []repoext.InvalidationMessage
+	unsubscribe := bus.Subscribe(func(message repoext.InvalidationMessage) {
+		messages = append(messages, message)
+	})
+	defer unsubscribe()
+	repo := repoext.NewViewCachedRepository(newStockRepository(store, nil), repoext.WithInvalidationBus(bus))
+	defer repo.(*repoext.ViewCachedRepository[*ProductStock]).Close()
+	stock, _ := repo.Find(bg, 1)
+	AssertEqual(t, 10, stock.freeAmount)
+
+	//其他实例修改了store，收到通知之前读到的是缓存
+	AssertNoError(t, store.SaveAll(bg, nil, map[any]*arp.ProcessEntity{1: arp.NewTakenProcessEntity(nil, &ProductStock{1, 8})}))
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 10, stock.freeAmount)
+	AssertNoError(t, bus.Publish(bg, repoext.InvalidationMessage{Sender: "other", EntityType: arp.TypeFullname[*ProductStock](), Ids: []string{"1"}}))
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 8, stock.freeAmount)
+
+	//本实例提交之后发出通知，自己忽略这个通知，缓存仍然有效
+	messages = nil
+	AssertNoError(t, arp.Go(bg, func(ctx context.Context) error {
+		stock, _ := repo.Take(ctx, 1)
+		stock.Decrease(3)
+		return nil
+	}))
+	AssertEqual(t, 1, len(messages))
+	AssertEqual(t, "1", messages[0].Ids[0])
+	misses := repo.(*repoext.ViewCachedRepository[*ProductStock]).Stats().Misses
+	stock, _ = repo.Find(bg, 1)
+	AssertEqual(t, 5, stock.freeAmount)
+	AssertEqual(t, misses, repo.(*repoext.ViewCachedRepository[*ProductStock]).Stats().Misses)
+}
+
+//1和"1"转换成字符串后相同，失效通知让它们都失效
+func TestViewCachedRepositoryInvalidationSameKey(t *testing.T) {
+	bg := context.Background()
+	store := newStockMemStore()
+	AssertNoError(t, store.Save(bg, 1, &ProductStock{1, 10}))
+	AssertNoError(t, store.Save(bg, "1", &ProductStock{1, 20}))
+	bus := repoext.NewMemInvalidationBus()
+	repo := repoext.NewViewCachedRepository(newStockRepository(store, nil), repoext.WithInvalidationBus(bus))
+	defer repo.(*repoext.ViewCachedRepository[*ProductStock]).Close()
+	repo.Find(bg, 1)
+	repo.Find(bg, "1")
+
+	AssertNoError(t, store.SaveAll(bg, nil, map[any]*arp.ProcessEntity{
+		1:   arp.NewTakenProcessEntity(nil, &ProductStock{1, 8}),
+		"1": arp.NewTakenProcessEntity(nil, &ProductStock{1, 18}),
+	}))
+	AssertNoError(t, bus.Publish(bg, repoext.InvalidationMessage{Sender: "other", EntityType: arp.TypeFullname[*ProductStock](), Ids: []string{"1"}}))
+	stock, _ := repo.Find(bg, 1)
+	AssertEqual(t, 8, stock.freeAmount)
+	stock, _ = repo.Find(bg, "1")
+	AssertEqual(t, 18, stock.freeAmount)
+}
+
+func TestUDPInvalidationBus(t *testing.T) {
+	bus1, err := repoext.NewUDPInvalidationBus("127.0.0.1:0")
+	AssertNoError(t, err)
+	defer bus1.Close()
+	bus2, err := repoext.NewUDPInvalidationBus("127.0.0.1:0", bus1.LocalAddr())
+	AssertNoError(t, err)
+	defer bus2.Close()
+	AssertNoError(t, bus1.AddPeer(bus2.LocalAddr()))
+
+	received := make(chan repoext.InvalidationMessage, 1)
+	bus2.Subscribe(func(message repoext.InvalidationMessage) {
+		received <- message
+	})
+	AssertNoError(t, bus1.Publish(context.Background(), repoext.InvalidationMessage{Sender: "node1", EntityType: "ProductStock", Ids: []string{"1", "2"}}))
+	select {
+	case message := <-received:
+		AssertEqual(t, "node1", message.Sender)
+		AssertEqual(t, 2, len(message.Ids))
+	case <-time.After(time.Second):
+		t.Fatal("invalidation not received")
+	}
+}
+
+//JSON转义之后变长的id也按编码之后的长度分成多个报文
+func TestUDPInvalidationBusLargeMessage(t *testing.T) {
+	bus1, err := repoext.NewUDPInvalidationBus("127.0.0.1:0")
+	AssertNoError(t, err)
+	defer bus1.Close()
+	bus2, err := repoext.NewUDPInvalidationBus("127.0.0.1:0")
+	AssertNoError(t, err)
+	defer bus2.Close()
+	AssertNoError(t, bus1.AddPeer(bus2.LocalAddr()))
+
+	received := make(chan repoext.InvalidationMessage, 100)
+	bus2.Subscribe(func(message repoext.InvalidationMessage) {
+		received <- message
+	})
+	var ids []string
+	//原始长度只有12KB，编码之后超过了一个报文
+	for i := 0; i < 3; i++ {
+		ids = append(ids, fmt.Sprintf("%d%s", i, strings.Repeat("<", 4000)))
+	}
+	AssertNoError(t, bus1.Publish(context.Background(), repoext.InvalidationMessage{Sender: "node1", EntityType: "ProductStock", Ids: ids}))
+	count := 0
+	for count < len(ids) {
+		select {
+		case message := <-received:
+			count += len(message.Ids)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d ids", count, len(ids))
+		}
+	}
+	AssertEqual(t, len(ids), count)
+
+	//一个id编码之后就超过报文长度时返回错误
+	err = bus1.Publish(context.Background(), repoext.InvalidationMessage{Sender: "node1", EntityType: "ProductStock", Ids: []string{strings.Repeat("<", 20000)}})
+	AssertTrue(t, err != nil)
+}
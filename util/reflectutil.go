@@ -0,0 +1,49 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+//取得struct或者struct指针的字段值，未导出的字段也可以取得
+func FieldValue(entity any, fieldName string) (value any, ok bool) {
+	entityValue := reflect.ValueOf(entity)
+	if entityValue.Kind() == reflect.Pointer {
+		if entityValue.IsNil() {
+			return nil, false
+		}
+		entityValue = entityValue.Elem()
+	}
+	if entityValue.Kind() != reflect.Struct {
+		return nil, false
+	}
+	if !entityValue.CanAddr() {
+		addressable := reflect.New(entityValue.Type()).Elem()
+		addressable.Set(entityValue)
+		entityValue = addressable
+	}
+	field := entityValue.FieldByName(fieldName)
+	if !field.IsValid() {
+		return nil, false
+	}
+	return Accessible(field).Interface(), true
+}
+
+//使可寻址的未导出字段可以读写
+func Accessible(value reflect.Value) reflect.Value {
+	if value.CanInterface() || !value.CanAddr() {
+		return value
+	}
+	return reflect.NewAt(value.Type(), unsafe.Pointer(value.UnsafeAddr())).Elem()
+}
+
+//字段的arp标签中是否有option，arp标签可以有多个用逗号分隔的选项，比如`arp:"encrypt"`
+func HasArpTagOption(field reflect.StructField, option string) bool {
+	for _, o := range strings.Split(field.Tag.Get("arp"), ",") {
+		if strings.TrimSpace(o) == option {
+			return true
+		}
+	}
+	return false
+}